@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+
+	"github.com/kgwinnup/go-yara/yara"
+	"github.com/kgwinnup/go-yara/yara/archive"
+	"github.com/kgwinnup/go-yara/yara/decode"
+)
+
+// scanArchive scans the files unpacked from the file at path if it is a
+// container, and their decoded views if encodings is not 0, handing the
+// rules of each to fn. The members that could not be unpacked are handed
+// to fn with their error.
+func (s *selector) scanArchive(rules *yara.Yara, path string, limits archive.Limits, encodings decode.Encoding, timeout int, strs bool, fn func(scanned)) {
+	f, err := os.Open(path)
+	if err != nil {
+		// a pid, or a file already reported
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	archive.Unpack(path, f, info.Size(), limits, func(member archive.Member) error {
+		if member.Err != nil {
+			fn(scanned{path: member.Path, err: member.Err})
+			return nil
+		}
+
+		// an error scanning a member, e.g. a timeout, does not stop the
+		// others
+		output := make([]*yara.ScanOutput, 0)
+		err := rules.ScanWithCallback(member.Data, timeout, strs, s.collect(&output))
+		if err == nil {
+			err = s.addLines(output, member.Data)
+		}
+
+		fn(scanned{path: member.Path, output: output, err: err})
+
+		if encodings != 0 {
+			s.scanViews(rules, member.Path, member.Data, encodings, timeout, strs, fn)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/kgwinnup/go-yara/yara"
+	"github.com/kgwinnup/go-yara/yara/decode"
+)
+
+// scanViews scans the views of data decoding its segments in the
+// encodings, handing the rules of each view with a rule to fn. The rules
+// have the name of the view in View, e.g. base64@0x1f, and the offsets
+// and lengths of their strings are in the input.
+func (s *selector) scanViews(rules *yara.Yara, path string, data []byte, encodings decode.Encoding, timeout int, strs bool, fn func(scanned)) {
+	for _, view := range decode.Views(data, encodings) {
+		output := make([]*yara.ScanOutput, 0)
+		err := rules.ScanWithCallback(view.Data, timeout, strs, s.collect(&output))
+
+		if err == nil && len(output) == 0 {
+			continue
+		}
+
+		for _, match := range output {
+			match.View = view.Name()
+
+			for _, str := range match.Strings {
+				str.Offset, str.Length = view.SourceSpan(str.Offset, str.Length)
+			}
+		}
+
+		if err == nil {
+			err = s.addLines(output, data)
+		}
+
+		fn(scanned{path: path, output: output, err: err})
+	}
+}
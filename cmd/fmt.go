@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kgwinnup/go-yara/yara/ast"
+	"github.com/kgwinnup/go-yara/yara/format"
+)
+
+// printSyntaxErrors prints each syntax error of the rules in name.
+func printSyntaxErrors(name string, err error) {
+	var errs ast.Errors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+		return
+	}
+
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%v:%v:%v: %v\n", name, e.Row, e.Col, e.Message)
+	}
+}
+
+// formatFile formats the rules in path, rewriting the file if write is
+// true and printing them otherwise.
+func formatFile(path string, write bool) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := format.Source(src)
+	if err != nil {
+		printSyntaxErrors(path, err)
+		return err
+	}
+
+	if !write {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	if bytes.Equal(src, out) {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, out, info.Mode().Perm())
+}
+
+// runFmt runs 'yara fmt [-w] files...', with no files the rules are read
+// from stdin and printed. It returns the exit code.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result to the file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: yara fmt [-w] [files...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(os.Stderr, "cannot use -w with stdin\n")
+			return 2
+		}
+
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+
+		out, err := format.Source(src)
+		if err != nil {
+			printSyntaxErrors("<stdin>", err)
+			return 1
+		}
+
+		os.Stdout.Write(out)
+		return 0
+	}
+
+	code := 0
+
+	for _, path := range flags.Args() {
+		if err := formatFile(path, *write); err != nil {
+			var errs ast.Errors
+			if !errors.As(err, &errs) {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+
+			code = 1
+		}
+	}
+
+	return code
+}
@@ -1,72 +1,268 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+	"strconv"
+	"sync"
 
 	"github.com/kgwinnup/go-yara/yara"
+	"github.com/kgwinnup/go-yara/yara/archive"
+	"github.com/kgwinnup/go-yara/yara/decode"
 )
 
-func main() {
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
 
-	debug := flag.Bool("debug", false, "debug rules")
-	showString := flag.Bool("s", false, "show string matches and offsets")
-	flag.Parse()
+// isPid reports whether an argument is the pid of a process to scan, a
+// number that is not a file.
+func isPid(arg string) bool {
+	_, err := strconv.Atoi(arg)
+	return err == nil && !exists(arg)
+}
+
+// printCompileErrors prints each error of the rules followed by the
+// line it is on.
+func printCompileErrors(err error) {
+	var errs yara.CompileErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
 
-	rule := ""
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
 
-	if len(flag.Args()) > 0 {
-		bs, err := ioutil.ReadFile(flag.Args()[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			os.Exit(1)
+		if e.Snippet != "" {
+			fmt.Fprintf(os.Stderr, "%v\n", e.Snippet)
 		}
+	}
+}
+
+// scanned is a file to scan and the rules matching it.
+type scanned struct {
+	path   string
+	output []*yara.ScanOutput
+	err    error
+}
+
+func main() {
+
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(runFmt(os.Args[2:]))
+	}
+
+	debug := flag.Bool("debug", false, "print the instructions of each rule before and after optimizing")
+	showStrings := boolFlag("s", "print-strings", "print the string matches of the rules")
+	showMeta := boolFlag("m", "print-meta", "print the meta of the rules")
+	showTags := boolFlag("g", "print-tags", "print the tags of the rules")
+	showNamespace := boolFlag("e", "print-namespace", "print the namespace of the rules")
+	negate := boolFlag("n", "negate", "print the rules not matching")
+	count := boolFlag("c", "count", "print the number of rules matching each input")
+	fast := boolFlag("f", "fast-scan", "fast matching mode, only the first match of each string is found")
+	noWarnings := boolFlag("w", "no-warnings", "do not print warnings")
+	recursive := boolFlag("r", "recursive", "scan the files in the subdirectories of a directory")
+	tags := listFlag("t", "tag", "print only the rules with the tag, can be repeated")
+	identifiers := listFlag("i", "identifier", "print only the rules with the name, can be repeated")
+	defines := listFlag("d", "define", "define an external variable, name=value, can be repeated")
+	moduleData := listFlag("x", "module-data", "pass the file to a module, module=file, can be repeated")
+	timeout := flag.Int("a", 1000000, "abort scanning after the given number of seconds")
+	flag.IntVar(timeout, "timeout", 1000000, "same as -a")
+	threads := flag.Int("p", 1, "number of files scanned in parallel")
+	flag.IntVar(threads, "threads", 1, "same as -p")
+	failOnWarnings := flag.Bool("fail-on-warnings", false, "fail compiling the rules if they have warnings")
+	outputFormat := flag.String("output", "text", "output format of the matches, json, ndjson or text")
+	followSymlinks := flag.Bool("follow-symlinks", false, "follow the symlinks found in a directory")
+	maxFileSize := flag.Int64("max-filesize", 0, "skip the files larger than the given number of bytes")
+	archives := flag.Bool("archives", false, "scan the files inside zip, tar, gzip and bzip2 containers")
+	archiveDepth := flag.Int("archive-depth", archive.DefaultLimits.MaxDepth, "unpack the containers nested up to the given depth")
+	archiveSize := flag.Int64("archive-max-size", archive.DefaultLimits.MaxSize, "unpack at most the given number of bytes from a container")
+	decodeViews := flag.String("decode", "", "also scan the segments of the inputs decoded from base64, hex, percent or utf16le, comma separated, or all")
+	lines := flag.Bool("lines", false, "print the line and the column of the string matches and the line they are on")
+	context := flag.Int("context", 0, "print the given number of lines around the string matches, implies -lines")
+	profile := flag.Bool("profile", false, "print the most expensive rules and strings to stderr once the scan is done")
+	profileTop := flag.Int("profile-top", 10, "number of rules and strings printed by -profile, 0 for all")
+	var excludes patterns
+	flag.Var(&excludes, "exclude", "skip the files and directories matching the glob pattern, can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: yara [options] rules.yar [file|dir|pid]...\n")
+		fmt.Fprintf(os.Stderr, "the options can come before or after the arguments and short options combine, e.g. -sr\n")
+		flag.PrintDefaults()
+	}
+
+	args, err := parseArgs(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if *threads < 1 {
+		fmt.Fprintf(os.Stderr, "the number of threads must be at least 1\n")
+		os.Exit(2)
+	}
+
+	out, err := newOutput(*outputFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	out.strings = *showStrings
+	out.meta = *showMeta
+	out.tags = *showTags
+	out.namespace = *showNamespace
+	out.count = *count
+
+	// the lines are only known from the string matches
+	around := -1
+	if *lines || *context > 0 {
+		around = *context
+		*showStrings = true
+		out.strings = true
+		out.lines = true
+	}
+
+	if err := checkModuleData(*moduleData, !*noWarnings); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	var rules *yara.Yara
+
+	compiler := yara.NewCompiler()
+	compiler.WarningsAsErrors = *failOnWarnings
+	compiler.FastScan = *fast
+	compiler.Profile = *profile
 
-		rule = string(bs)
+	if err := defineVariables(compiler, *defines); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) > 0 {
+		rules, err = compiler.CompileFile(args[0])
 	} else {
-		bs, err := ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
+		bs, rerr := ioutil.ReadAll(os.Stdin)
+		if rerr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", rerr)
 			os.Exit(1)
 		}
 
-		rule = string(bs)
+		rules, err = compiler.Compile(string(bs))
+	}
+
+	// warnings are errors with -fail-on-warnings
+	if !*failOnWarnings && !*noWarnings {
+		for _, warning := range compiler.Warnings() {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+		}
 	}
 
-	yara, err := yara.New(rule)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+		printCompileErrors(err)
 		os.Exit(1)
 	}
 
 	if *debug {
-		yara.Debug()
+		rules.Debug()
 	}
 
-	for i, arg := range flag.Args() {
-
-		if i == 0 {
-			continue
-		}
+	selector := &selector{negate: *negate, tags: *tags, identifiers: *identifiers}
 
-		contents, err := ioutil.ReadFile(arg)
+	var encodings decode.Encoding
+	if *decodeViews != "" {
+		encodings, err = decode.ParseEncoding(*decodeViews)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
-			continue
+			os.Exit(2)
 		}
+	}
 
-		output, err := yara.Scan(contents, 3, *showString)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			continue
-		}
+	limits := archive.DefaultLimits
+	limits.MaxDepth = *archiveDepth
+	limits.MaxSize = *archiveSize
+
+	walker := &walker{
+		recursive:      *recursive,
+		followSymlinks: *followSymlinks,
+		maxFileSize:    *maxFileSize,
+		excludes:       excludes,
+	}
 
-		for _, obj := range output {
-			fmt.Println("Rule:", obj.Name, strings.Join(obj.Tags, ","))
+	selector.context = around
+
+	files := make(chan scanned)
+	results := make(chan scanned)
+
+	go func() {
+		// the first argument is the rules, read from stdin without one
+		for i, arg := range args {
+			if i == 0 {
+				continue
+			}
+
+			walker.walk(arg, func(path string, err error) {
+				files <- scanned{path: path, err: err}
+			})
 		}
+
+		close(files)
+	}()
+
+	// the workers share the compiled rules, the results are written by
+	// this goroutine alone so the output of two files never interleaves
+	var wg sync.WaitGroup
+
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for file := range files {
+				if file.err == nil {
+					file.output, file.err = selector.scan(rules, file.path, *timeout, *showStrings)
+				}
+
+				results <- file
+
+				if file.err != nil {
+					continue
+				}
+
+				send := func(result scanned) {
+					results <- result
+				}
+
+				if encodings != 0 && !isPid(file.path) {
+					if data, err := ioutil.ReadFile(file.path); err == nil {
+						selector.scanViews(rules, file.path, data, encodings, *timeout, *showStrings, send)
+					}
+				}
+
+				if *archives {
+					selector.scanArchive(rules, file.path, limits, encodings, *timeout, *showStrings, send)
+				}
+			}
+		}()
 	}
 
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		out.write(result.path, result.output, result.err)
+	}
+
+	out.close()
+
+	if *profile {
+		printProfile(os.Stderr, rules.Profile(), *profileTop)
+	}
 }
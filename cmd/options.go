@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/yara"
+)
+
+// list is a flag that can be given more than once.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// boolFlag defines a bool flag with a short and a long name, like the
+// options of yara, e.g. -s and --print-strings.
+func boolFlag(short, long string, usage string) *bool {
+	value := flag.Bool(short, false, usage)
+	flag.BoolVar(value, long, false, "same as -"+short)
+
+	return value
+}
+
+// listFlag defines a repeatable flag with a short and a long name.
+func listFlag(short, long string, usage string) *list {
+	value := &list{}
+	flag.Var(value, short, usage)
+	flag.Var(value, long, "same as -"+short)
+
+	return value
+}
+
+// parseArgs parses the flags in args like yara, the flags can also come
+// after the rules and the inputs, e.g. 'yara rules.yar file -s', and the
+// short flags combine, e.g. -sr for -s -r. The arguments after -- are
+// never flags. It returns the arguments that are not flags, in order.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		expanded = append(expanded, splitShort(flags, arg)...)
+	}
+
+	positional := make([]string, 0)
+
+	// Parse stops at the first argument that is not a flag, take it
+	// and parse the flags after it
+	for {
+		if err := flags.Parse(expanded); err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		expanded = flags.Args()[1:]
+	}
+
+	return append(positional, rest...), nil
+}
+
+// splitShort splits combined short flags, e.g. -sr is -s -r. Every flag
+// but the last must be a bool, the last can take a value, e.g. -sa 10.
+// Anything else is returned as is.
+func splitShort(flags *flag.FlagSet, arg string) []string {
+	if len(arg) < 3 || arg[0] != '-' || arg[1] == '-' || strings.Contains(arg, "=") || flags.Lookup(arg[1:]) != nil {
+		return []string{arg}
+	}
+
+	split := make([]string, 0, len(arg)-1)
+
+	for i, c := range arg[1:] {
+		f := flags.Lookup(string(c))
+		if f == nil || (i < len(arg)-2 && !isBoolFlag(f)) {
+			return []string{arg}
+		}
+
+		split = append(split, "-"+string(c))
+	}
+
+	return split
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// selector picks the rules printed for an input, like the -n, -t and -i
+// options of yara.
+type selector struct {
+	// print the rules not matching instead of the rules matching
+	negate bool
+	// the rules printed have one of the tags, any rule if empty
+	tags list
+	// the rules printed have one of the names, any rule if empty
+	identifiers list
+	// the lines around the string matches set, -1 for no lines, see
+	// yara.AddLines
+	context int
+}
+
+func (s *selector) selected(rule *yara.ScanOutput, matching bool) bool {
+	if matching == s.negate {
+		return false
+	}
+
+	if len(s.identifiers) > 0 && !contains(s.identifiers, rule.Name) {
+		return false
+	}
+
+	if len(s.tags) == 0 {
+		return true
+	}
+
+	for _, tag := range rule.Tags {
+		if contains(s.tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// collect returns a Callback appending the rules the selector picks to
+// output.
+func (s *selector) collect(output *[]*yara.ScanOutput) yara.Callback {
+	return func(event yara.Event) yara.Action {
+		if event.Type != yara.RuleMatching && event.Type != yara.RuleNotMatching {
+			return yara.Continue
+		}
+
+		if s.selected(event.Rule, event.Type == yara.RuleMatching) {
+			*output = append(*output, event.Rule)
+		}
+
+		return yara.Continue
+	}
+}
+
+// scan scans the file at path and returns the rules the selector picks,
+// like yara an argument that is not a file but is a number is the pid of
+// a process to scan.
+func (s *selector) scan(rules *yara.Yara, path string, timeout int, strs bool) ([]*yara.ScanOutput, error) {
+	output := make([]*yara.ScanOutput, 0)
+
+	var err error
+
+	if isPid(path) {
+		pid, _ := strconv.Atoi(path)
+		err = rules.ScanProcessWithCallback(pid, timeout, strs, s.collect(&output))
+	} else {
+		err = rules.ScanFileWithCallback(path, timeout, strs, s.collect(&output))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.context >= 0 && !isPid(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yara.AddLines(output, yara.NewLineIndex(f, info.Size()), s.context); err != nil {
+			return nil, err
+		}
+	}
+
+	return output, nil
+}
+
+// addLines sets the lines of the string matches of the outputs scanned
+// from data, if asked for.
+func (s *selector) addLines(output []*yara.ScanOutput, data []byte) error {
+	if s.context < 0 {
+		return nil
+	}
+
+	return yara.AddLines(output, yara.NewLineIndex(bytes.NewReader(data), int64(len(data))), s.context)
+}
+
+// defineVariables defines the external variables given as name=value,
+// like yara the value is a bool, an integer or otherwise a string. The
+// conditions have no floats, a value like 1.5 is the string "1.5".
+func defineVariables(compiler *yara.Compiler, defines list) error {
+	for _, define := range defines {
+		parts := strings.SplitN(define, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New(fmt.Sprintf("invalid variable definition '%v', expecting name=value", define))
+		}
+
+		name, raw := parts[0], parts[1]
+
+		var value interface{} = raw
+
+		if raw == "true" || raw == "false" {
+			value = raw == "true"
+		} else if n, err := strconv.ParseInt(raw, 0, 64); err == nil {
+			value = n
+		}
+
+		if err := compiler.DefineVariable(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkModuleData checks the module data given as module=file. There are
+// no modules to hand the data to, so it is only reported as ignored.
+func checkModuleData(data list, warn bool) error {
+	for _, entry := range data {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New(fmt.Sprintf("invalid module data '%v', expecting module=file", entry))
+		}
+
+		if _, err := os.Stat(parts[1]); err != nil {
+			return err
+		}
+
+		if warn {
+			fmt.Fprintf(os.Stderr, "warning: module data for '%v' is ignored, modules are not supported\n", parts[0])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		strs       bool
+		recursive  bool
+		timeout    int
+		defines    list
+	}{
+		{[]string{"-s", "rules.yar", "file"}, []string{"rules.yar", "file"}, true, false, 0, nil},
+		{[]string{"rules.yar", "file", "-s"}, []string{"rules.yar", "file"}, true, false, 0, nil},
+		{[]string{"-sr", "rules.yar", "dir"}, []string{"rules.yar", "dir"}, true, true, 0, nil},
+		{[]string{"rules.yar", "-rsa", "10", "dir"}, []string{"rules.yar", "dir"}, true, true, 10, nil},
+		{[]string{"-d", "env=prod", "rules.yar", "--print-strings", "-d", "x=1", "file"}, []string{"rules.yar", "file"}, true, false, 0, list{"env=prod", "x=1"}},
+		{[]string{"rules.yar", "--", "-s", "file"}, []string{"rules.yar", "-s", "file"}, false, false, 0, nil},
+		{[]string{"-sx", "rules.yar"}, nil, false, false, 0, nil},
+	}
+
+	for _, test := range tests {
+		flags := flag.NewFlagSet("yara", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+
+		strs := flags.Bool("s", false, "")
+		flags.BoolVar(strs, "print-strings", false, "")
+		recursive := flags.Bool("r", false, "")
+		timeout := flags.Int("a", 0, "")
+		defines := &list{}
+		flags.Var(defines, "d", "")
+
+		positional, err := parseArgs(flags, test.args)
+		if test.positional == nil {
+			if err == nil {
+				t.Fatalf("%v: expecting an error", test.args)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+
+		if !reflect.DeepEqual(positional, test.positional) || *strs != test.strs || *recursive != test.recursive || *timeout != test.timeout {
+			t.Fatalf("%v: unexpected %v, -s %v, -r %v, -a %v", test.args, positional, *strs, *recursive, *timeout)
+		}
+
+		if len(*defines) != len(test.defines) || (len(test.defines) > 0 && !reflect.DeepEqual(*defines, test.defines)) {
+			t.Fatalf("%v: unexpected defines %v", test.args, *defines)
+		}
+	}
+}
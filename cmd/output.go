@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/yara"
+)
+
+// output writes the results of the scans in one of the output formats:
+// text lines, a JSON array of records written once every input is
+// scanned, or one JSON record per line as soon as an input is scanned.
+type output struct {
+	format string
+	// what the text output prints of each rule besides its name, like
+	// the -s, -m, -g and -e options of yara, or with count only the
+	// number of rules of each input
+	strings   bool
+	meta      bool
+	tags      bool
+	namespace bool
+	count     bool
+	// print the line and the column of the string matches and the lines
+	// around them
+	lines   bool
+	records []*yara.ScanOutput
+	// stdout, flushed once the output of an input is written
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newOutput(format string) (*output, error) {
+	switch format {
+	case "text", "json", "ndjson":
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown output format '%v', expecting json, ndjson or text", format))
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+
+	return &output{format: format, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// write writes the rules matching the input at path, or the error
+// scanning it.
+func (o *output) write(path string, matches []*yara.ScanOutput, err error) {
+	if err != nil {
+		if o.format == "text" {
+			fmt.Fprintf(os.Stderr, "error scanning %v: %v\n", path, err)
+			return
+		}
+
+		matches = []*yara.ScanOutput{{Path: path, Errors: []string{err.Error()}}}
+	}
+
+	defer o.writer.Flush()
+
+	if o.format == "text" && o.count {
+		name := path
+		if len(matches) > 0 {
+			name = viewPath(path, matches[0])
+		}
+
+		fmt.Fprintf(o.writer, "%v: %v\n", name, len(matches))
+		return
+	}
+
+	for _, match := range matches {
+		match.Path = path
+
+		switch o.format {
+		case "text":
+			o.text(viewPath(path, match), match)
+
+		case "json":
+			o.records = append(o.records, match)
+
+		case "ndjson":
+			if err := o.encoder.Encode(match); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
+	}
+}
+
+// viewPath returns the path a rule is printed with as text, the path of
+// the input followed by the view the rule matched, e.g.
+// script.ps1!base64@0x1f.
+func viewPath(path string, match *yara.ScanOutput) string {
+	if match.View == "" {
+		return path
+	}
+
+	return path + "!" + match.View
+}
+
+// close writes the records held until every input is scanned.
+func (o *output) close() {
+	if o.format != "json" {
+		return
+	}
+
+	if o.records == nil {
+		o.records = []*yara.ScanOutput{}
+	}
+
+	o.encoder.SetIndent("", "  ")
+	if err := o.encoder.Encode(o.records); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	o.writer.Flush()
+}
+
+// text writes a rule the way yara prints it, e.g.
+//
+//	default:Foo [tag1,tag2] [author="me",score=10] /path/to/file
+//	0x0:$a: MZ
+func (o *output) text(path string, match *yara.ScanOutput) {
+	if o.namespace {
+		fmt.Fprintf(o.writer, "%v:", match.Namespace)
+	}
+
+	fmt.Fprintf(o.writer, "%v ", match.Name)
+
+	if o.tags {
+		fmt.Fprintf(o.writer, "[%v] ", strings.Join(match.Tags, ","))
+	}
+
+	if o.meta {
+		values := make([]string, 0, len(match.Meta))
+
+		for _, key := range match.MetaKeys() {
+			// the strings are printed as they are written in the rule,
+			// escape sequences included
+			switch v := match.Meta[key].(type) {
+			case string:
+				values = append(values, fmt.Sprintf("%v=\"%v\"", key, v))
+			default:
+				values = append(values, fmt.Sprintf("%v=%v", key, v))
+			}
+		}
+
+		fmt.Fprintf(o.writer, "[%v] ", strings.Join(values, ","))
+	}
+
+	fmt.Fprintln(o.writer, path)
+
+	if o.strings {
+		for _, str := range match.Strings {
+			if !o.lines {
+				fmt.Fprintf(o.writer, "%v: %v\n", str, str.DataString())
+				continue
+			}
+
+			fmt.Fprintf(o.writer, "%v: line %v, col %v: %v\n", str, str.Line, str.Column, str.DataString())
+
+			// like grep -n, ':' after the number of the matching line
+			// and '-' after the others
+			for _, line := range str.Context {
+				sep := "-"
+				if line.Line == str.Line {
+					sep = ":"
+				}
+
+				fmt.Fprintf(o.writer, "    %v%v%v\n", line.Line, sep, line.Text)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kgwinnup/go-yara/yara"
+)
+
+// printProfile prints the top rules by the time spent on their
+// condition and the top strings by verifications, like the
+// --print-stats option of yara. A top of 0 or less prints them all.
+func printProfile(w io.Writer, profile *yara.Profile, top int) {
+	rules, strs := profile.Rules, profile.Strings
+
+	if top > 0 && len(rules) > top {
+		rules = rules[:top]
+	}
+
+	if top > 0 && len(strs) > top {
+		strs = strs[:top]
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "scans: %v\n\n", profile.Scans)
+
+	fmt.Fprintf(tw, "rule\tevaluations\tinstructions\ttime\n")
+	for _, rule := range rules {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", rule.Name, rule.Evaluations, rule.Instructions, rule.Time.Round(time.Microsecond))
+	}
+
+	fmt.Fprintf(tw, "\nstring\thits\tverifications\tmatches\n")
+	for _, str := range strs {
+		fmt.Fprintf(tw, "%v:%v\t%v\t%v\t%v\n", str.Rule, str.Name, str.Hits, str.Verifications, str.Matches)
+	}
+
+	tw.Flush()
+}
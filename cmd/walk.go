@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// patterns is a flag that can be given more than once, each value is a
+// glob pattern.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return err
+	}
+
+	*p = append(*p, value)
+	return nil
+}
+
+// walker finds the files to scan from the arguments of the command. Like
+// yara, a directory argument scans the files in it, and with recursive
+// the files in its subdirectories too.
+type walker struct {
+	recursive      bool
+	followSymlinks bool
+	// files larger than maxFileSize bytes are skipped, 0 for no limit
+	maxFileSize int64
+	// a file or directory matching one of the patterns, by name or by
+	// path, is skipped
+	excludes patterns
+	// the directories already walked, a symlink to a parent directory
+	// would be walked forever otherwise
+	visited map[string]bool
+}
+
+func (w *walker) excluded(path string) bool {
+	for _, pattern := range w.excludes {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walk calls fn with each file to scan under arg, or with the error
+// reading a file or directory. An argument that does not exist but is a
+// number is passed as is, it is the pid of a process.
+func (w *walker) walk(arg string, fn func(path string, err error)) {
+	if w.visited == nil {
+		w.visited = make(map[string]bool)
+	}
+
+	info, err := os.Stat(arg)
+	if err != nil {
+		if _, perr := strconv.Atoi(arg); perr == nil {
+			fn(arg, nil)
+			return
+		}
+
+		fn(arg, err)
+		return
+	}
+
+	// the files given as arguments are always scanned, e.g. a device
+	if !info.IsDir() {
+		if w.maxFileSize > 0 && info.Mode().IsRegular() && info.Size() > w.maxFileSize {
+			return
+		}
+
+		fn(arg, nil)
+		return
+	}
+
+	w.dir(arg, fn)
+}
+
+func (w *walker) dir(path string, fn func(path string, err error)) {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		if w.visited[real] {
+			return
+		}
+
+		w.visited[real] = true
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		fn(path, err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(path, entry.Name())
+
+		if w.excluded(name) {
+			continue
+		}
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if !w.followSymlinks {
+				continue
+			}
+
+			info, err := os.Stat(name)
+			if err != nil {
+				fn(name, err)
+				continue
+			}
+
+			entry = info
+		}
+
+		if entry.IsDir() {
+			if w.recursive {
+				w.dir(name, fn)
+			}
+
+			continue
+		}
+
+		// devices, pipes and sockets found in a directory are skipped
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		if w.maxFileSize > 0 && entry.Size() > w.maxFileSize {
+			continue
+		}
+
+		fn(name, nil)
+	}
+}
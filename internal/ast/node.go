@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -30,6 +29,8 @@ const (
 	IMPORT
 	SET
 	FOR
+	PERCENTAGE
+	WITH
 )
 
 // IsPrimitive returns true if the node is a primitive value like an
@@ -64,29 +65,114 @@ func IsModuleCall(node Node) bool {
 	return false
 }
 
+// TokenOf returns the token a node was parsed from, the position of
+// errors about the node. It is nil for nodes without one, e.g. a Set.
+func TokenOf(node Node) *lexer.Token {
+	switch n := node.(type) {
+	case *For:
+		return n.Expr
+	case *With:
+		return n.Token
+	case *Percentage:
+		return n.Token
+	case *Keyword:
+		return n.Token
+	case *Bytes:
+		return n.Token
+	case *Identity:
+		return n.Token
+	case *Variable:
+		return n.Token
+	case *Rule:
+		return n.Token
+	case *Prefix:
+		return n.Token
+	case *Infix:
+		return n.Token
+	case *String:
+		return n.Token
+	case *Bool:
+		return n.Token
+	case *Integer:
+		return n.Token
+	case *Import:
+		return n.Token
+	case *Assignment:
+		return n.Token
+	case *Regex:
+		return n.Token
+	}
+
+	return nil
+}
+
 type Node interface {
 	Type() int
 	String() string
 }
 
 type For struct {
-	Expr      *lexer.Token
-	StringSet Node
-	Var       string
-	Body      Node
+	// the quantifier, an integer, 'any', 'all' or 'none'
+	Expr *lexer.Token
+	// the integer quantifier is a percentage, e.g. 'for 50% of them'
+	Percent bool
+	// the set of strings for 'for any of ($a*)', or what the variables
+	// iterate over, a range, an enumeration or a module iterable
+	Iterable Node
+	// the loop variables, none when iterating over strings
+	Vars []string
+	Body Node
 }
 
 func (f For) String() string {
-	if f.Var == "" {
-		return fmt.Sprintf("for %v of %v : (%v)", f.Expr.Raw, f.StringSet, f.Body)
+	quantifier := f.Expr.Raw
+	if f.Percent {
+		quantifier += "%"
 	}
-	return fmt.Sprintf("for %v %v in %v : (%v)", f.Expr.Raw, f.Var, f.StringSet, f.Body)
+
+	if len(f.Vars) == 0 {
+		return fmt.Sprintf("for %v of %v : (%v)", quantifier, f.Iterable, f.Body)
+	}
+
+	return fmt.Sprintf("for %v %v in %v : (%v)", quantifier, strings.Join(f.Vars, ", "), f.Iterable, f.Body)
 }
 
 func (f For) Type() int {
 	return FOR
 }
 
+// Binding is a local variable of a with statement, e.g. 'x = @a[1]'
+type Binding struct {
+	Token *lexer.Token
+	Name  string
+	Value Node
+}
+
+func (b Binding) String() string {
+	return fmt.Sprintf("%v = %v", b.Name, b.Value)
+}
+
+// With binds local variables for its body, e.g. 'with x = @a[1], y =
+// x + 4 : (uint32(y) == x)'. A binding can refer to the ones before it.
+type With struct {
+	Token    *lexer.Token
+	Bindings []*Binding
+	Body     Node
+}
+
+func (w With) String() string {
+	bindings := make([]string, len(w.Bindings))
+	for i, binding := range w.Bindings {
+		bindings[i] = binding.String()
+	}
+
+	return fmt.Sprintf("with %v : (%v)", strings.Join(bindings, ", "), w.Body)
+}
+
+func (w *With) Type() int {
+	return WITH
+}
+
 type Set struct {
 	Nodes []Node
 }
@@ -110,6 +196,21 @@ func (s *Set) Type() int {
 	return SET
 }
 
+// Percentage is the quantifier of an 'of' expression, e.g. '50% of
+// them'
+type Percentage struct {
+	Token *lexer.Token
+	Value Node
+}
+
+func (p Percentage) String() string {
+	return fmt.Sprintf("%v%%", p.Value)
+}
+
+func (p *Percentage) Type() int {
+	return PERCENTAGE
+}
+
 type Keyword struct {
 	Token     *lexer.Token
 	Value     string
@@ -298,6 +399,8 @@ func (v *Variable) Type() int {
 }
 
 type Rule struct {
+	// the name of the rule
+	Token     *lexer.Token
 	Private   bool
 	Global    bool
 	Name      string
@@ -305,6 +408,13 @@ type Rule struct {
 	Condition Node
 	Strings   []Node
 	Meta      []Node
+	// the keywords starting the sections and the closing brace of the
+	// rule, nil for a missing section, to place the comments around
+	// them
+	MetaToken      *lexer.Token
+	StringsToken   *lexer.Token
+	ConditionToken *lexer.Token
+	End            *lexer.Token
 }
 
 func (r Rule) String() string {
@@ -460,7 +570,17 @@ func (i *Import) Type() int {
 	return IMPORT
 }
 
+// Comment is a '//' or '/* */' comment of the rules, Text includes the
+// delimiters. Comments are not part of the tree, they are kept aside
+// with their position.
+type Comment struct {
+	Token *lexer.Token
+	Text  string
+}
+
 type Assignment struct {
+	// the identifier of the string or meta
+	Token      *lexer.Token
 	Left       string
 	Right      Node
 	Attributes map[int]Node
@@ -479,13 +599,107 @@ func (a *Assignment) Type() int {
 	return ASSIGNMENT
 }
 
+// MaxAtomLength is the longest run of fixed bytes picked as the atom
+// for a hex string. Longer atoms rarely make an atom more selective,
+// they only make the automaton bigger.
+const MaxAtomLength = 4
+
+// MinRegexPrefix is the length below which the literal prefix of a
+// regex, its atom, matches too often.
+const MinRegexPrefix = 6
+
+// MinAtomQuality is the quality below which an atom is considered too
+// common, e.g. a single byte or a run of null bytes.
+const MinAtomQuality = 40
+
+// AtomQuality scores an atom the same way libyara does. Common bytes
+// like 0x00, 0x20, 0xcc and 0xff score lower than the rest, atoms
+// with more unique bytes score higher and atoms made of one repeated
+// common byte are heavily penalized.
+func AtomQuality(atom []byte) int {
+	var seen [256]bool
+	quality := 0
+	unique := 0
+
+	for _, b := range atom {
+		switch b {
+		case 0x00, 0x20, 0xcc, 0xff:
+			quality += 12
+		default:
+			if l := b | 0x20; l >= 'a' && l <= 'z' {
+				quality += 18
+			} else {
+				quality += 20
+			}
+		}
+
+		if !seen[b] {
+			seen[b] = true
+			unique++
+		}
+	}
+
+	if unique == 1 && (seen[0x00] || seen[0x20] || seen[0x90] || seen[0xcc] || seen[0xff]) {
+		quality -= 10 * len(atom)
+	} else {
+		quality += 2 * unique
+	}
+
+	return quality
+}
+
+// SelectAtom finds the best window of fixed bytes, anywhere in the
+// pattern, to feed into the automaton. It returns the atom, the offset
+// of the atom within the pattern and its quality. A nil atom is
+// returned when the pattern contains only wildcards.
+func SelectAtom(pattern []int) ([]byte, int, int) {
+	var best []byte
+	bestOffset := 0
+	bestQuality := 0
+
+	for i := 0; i < len(pattern); i++ {
+		atom := make([]byte, 0, MaxAtomLength)
+
+		for j := i; j < len(pattern) && j-i < MaxAtomLength; j++ {
+			if pattern[j]&0x1000 == 0x1000 {
+				break
+			}
+
+			atom = append(atom, byte(pattern[j]))
+
+			quality := AtomQuality(atom)
+			if best == nil || quality > bestQuality || (quality == bestQuality && len(atom) > len(best)) {
+				best = append([]byte{}, atom...)
+				bestOffset = i
+				bestQuality = quality
+			}
+		}
+	}
+
+	return best, bestOffset, bestQuality
+}
+
 type BytePattern struct {
-	Patterns        [][]byte
+	Patterns [][]byte
+	// offset of each pattern (atom) within the matching
+	// PartialPatterns entry
 	Offsets         []int
 	Nocase          bool
 	IsPartial       bool
 	PartialPatterns [][]int
 	Re              *regexp.Regexp
+	// slow patterns, e.g. a regex with a short prefix or a hex string
+	// made of common bytes
+	Warnings []*lexer.Error
+}
+
+func (b *BytePattern) warn(tok *lexer.Token, msg string) {
+	row, col := 0, 0
+	if tok != nil {
+		row, col = tok.Row, tok.Col
+	}
+
+	b.Warnings = append(b.Warnings, &lexer.Error{Row: row, Col: col, Message: msg})
 }
 
 type Regex struct {
@@ -507,15 +721,9 @@ func (r *Regex) BytePattern() ([]byte, error) {
 		return nil, err
 	}
 
-	min := 6
-
 	prefix, _ := re.LiteralPrefix()
-	if len(prefix) < min {
-		fmt.Fprintf(os.Stderr, fmt.Sprintf("warning %v:%v: slow regex, regex prefix should be greater than %v, '%v'\n", r.Token.Row, r.Token.Col, min, prefix))
-	}
-
 	if len(prefix) == 0 {
-		return nil, errors.New(fmt.Sprintf("error %v:%v: bad regex pattern, no valid prefix to match on", r.Token.Row, r.Token.Col))
+		return nil, &lexer.Error{Row: r.Token.Row, Col: r.Token.Col, Message: "bad regex pattern, no valid prefix to match on"}
 	}
 
 	return []byte(prefix), nil
@@ -583,6 +791,10 @@ func (a *Assignment) BytePattern() (*BytePattern, error) {
 			return nil, err
 		}
 
+		if len(pattern) < MinRegexPrefix {
+			ret.warn(r.Token, fmt.Sprintf("slow regex %v, regex prefix should be at least %v bytes, '%s'", a.Left, MinRegexPrefix, pattern))
+		}
+
 		ret.Patterns = append(ret.Patterns, pattern)
 		return ret, nil
 	}
@@ -595,19 +807,32 @@ func (a *Assignment) BytePattern() (*BytePattern, error) {
 
 		bytePatterns := make([][]byte, 0)
 
+		// the worst atom across all alternatives decides how slow
+		// this string is to scan for
+		worst := -1
+		missing := false
+
 		for _, pattern := range patterns {
-			temp := make([]byte, 0)
+			atom, offset, quality := SelectAtom(pattern)
 
-			for _, b := range pattern {
-				if b&0x1000 == 0x1000 {
-					ret.IsPartial = true
-					break
-				}
+			if len(atom) != len(pattern) {
+				ret.IsPartial = true
+			}
 
-				temp = append(temp, byte(b))
+			if len(atom) == 0 {
+				missing = true
+			} else if worst < 0 || quality < worst {
+				worst = quality
 			}
 
-			bytePatterns = append(bytePatterns, temp)
+			bytePatterns = append(bytePatterns, atom)
+			ret.Offsets = append(ret.Offsets, offset)
+		}
+
+		if missing {
+			ret.warn(bs.Token, fmt.Sprintf("no usable atom in %v, every offset will be verified", a.Left))
+		} else if worst < MinAtomQuality {
+			ret.warn(bs.Token, fmt.Sprintf("slow hex string %v, atoms are too common", a.Left))
 		}
 
 		ret.PartialPatterns = patterns
@@ -57,3 +57,34 @@ func TestBytesBytePattern2(t *testing.T) {
 	}
 
 }
+
+func TestSelectAtom(t *testing.T) {
+	// ?? ?? 8b 45 f8 c3
+	atom, offset, _ := SelectAtom([]int{0x1000, 0x1000, 0x8b, 0x45, 0xf8, 0xc3})
+
+	if offset != 2 {
+		t.Fatalf("expecting atom at offset 2, got %v", offset)
+	}
+
+	if len(atom) != 4 || atom[0] != 0x8b {
+		t.Fatalf("expecting atom 8b 45 f8 c3, got %x", atom)
+	}
+
+	// 00 00 ?? 41 42 43 44
+	atom, offset, _ = SelectAtom([]int{0x00, 0x00, 0x1000, 0x41, 0x42, 0x43, 0x44})
+
+	if offset != 3 || string(atom) != "ABCD" {
+		t.Fatalf("expecting atom ABCD at offset 3, got %x at %v", atom, offset)
+	}
+
+	atom, _, _ = SelectAtom([]int{0x1000, 0x1000})
+	if atom != nil {
+		t.Fatal("expecting no atom for a wildcard only pattern")
+	}
+}
+
+func TestAtomQuality(t *testing.T) {
+	if AtomQuality([]byte{0x00, 0x00, 0x00, 0x00}) >= AtomQuality([]byte{0x8b, 0x45}) {
+		t.Fatal("expecting null run to score lower than two rare bytes")
+	}
+}
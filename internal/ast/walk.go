@@ -0,0 +1,54 @@
+package ast
+
+// Walk calls fn for node and every node below it, depth first in source
+// order. Returning false from fn skips the nodes below the node.
+func Walk(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Rule:
+		for _, meta := range n.Meta {
+			Walk(meta, fn)
+		}
+
+		for _, str := range n.Strings {
+			Walk(str, fn)
+		}
+
+		Walk(n.Condition, fn)
+
+	case *Assignment:
+		Walk(n.Right, fn)
+
+	case *For:
+		Walk(n.Iterable, fn)
+		Walk(n.Body, fn)
+
+	case *With:
+		for _, binding := range n.Bindings {
+			Walk(binding.Value, fn)
+		}
+
+		Walk(n.Body, fn)
+
+	case *Set:
+		for _, item := range n.Nodes {
+			Walk(item, fn)
+		}
+
+	case *Percentage:
+		Walk(n.Value, fn)
+
+	case *Keyword:
+		Walk(n.Attribute, fn)
+
+	case *Prefix:
+		Walk(n.Right, fn)
+
+	case *Infix:
+		Walk(n.Left, fn)
+		Walk(n.Right, fn)
+	}
+}
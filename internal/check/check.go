@@ -0,0 +1,836 @@
+// Package check validates parsed rules before they are compiled. It
+// types every expression of a condition, finds the strings and rules a
+// condition refers to and reports every error of a rule, so the
+// compiler only ever sees well formed conditions.
+package check
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+)
+
+// Type is the type of an expression.
+type Type int
+
+const (
+	// Invalid is the type of an expression with an error, expressions
+	// using it report no more errors
+	Invalid Type = iota
+	Bool
+	Int
+	Float
+	String
+	Regex
+)
+
+func (t Type) String() string {
+	switch t {
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case String:
+		return "string"
+	case Regex:
+		return "regex"
+	default:
+		return "invalid"
+	}
+}
+
+func (t Type) numeric() bool {
+	return t == Int || t == Float
+}
+
+// boolean reports whether a value of the type can be used as a
+// condition, integers and floats are true if they are not zero and
+// strings if they are not empty.
+func (t Type) boolean() bool {
+	return t == Bool || t == String || t.numeric()
+}
+
+// Checker checks the rules of an input in the order they are declared,
+// a rule can only refer to the rules checked before it.
+type Checker struct {
+	modules map[string]bool
+	rules   map[string]bool
+	// the external variables defined outside of the rules
+	externals map[string]Type
+
+	// the state of the rule being checked
+	rule *ast.Rule
+	errs []error
+	// the strings of the rule, the ones the condition uses and the
+	// prefixes of the wildcards it uses, all of them for 'them'
+	strs     map[string]*ast.Assignment
+	used     map[string]bool
+	prefixes []string
+	all      bool
+	// the loop and with variables in scope
+	scope map[string]Type
+	// the anonymous $ refers to the string of an enclosing loop
+	inLoop bool
+}
+
+// New creates a Checker for rules importing modules.
+func New(modules []string) *Checker {
+	c := &Checker{
+		modules:   make(map[string]bool),
+		rules:     make(map[string]bool),
+		externals: make(map[string]Type),
+	}
+
+	for _, module := range modules {
+		c.modules[module] = true
+	}
+
+	return c
+}
+
+// Rule checks a rule and returns all of its errors, each a *lexer.Error
+// with the position of the error. The rule is declared even if it has
+// errors, the rules after it can refer to it.
+func (c *Checker) Rule(rule *ast.Rule) []error {
+	c.rule = rule
+	c.errs = nil
+	c.strs = make(map[string]*ast.Assignment)
+	c.used = make(map[string]bool)
+	c.all = false
+	c.scope = make(map[string]Type)
+	c.inLoop = false
+	c.prefixes = nil
+
+	if c.rules[rule.Name] {
+		c.errorf(rule, "duplicate rule name '%v'", rule.Name)
+	} else if _, ok := c.externals[rule.Name]; ok {
+		c.errorf(rule, "duplicate rule name '%v', it is already defined as an external variable", rule.Name)
+	}
+
+	for _, node := range rule.Strings {
+		assign, ok := node.(*ast.Assignment)
+		if !ok {
+			continue
+		}
+
+		if _, ok := c.strs[assign.Left]; ok {
+			c.errorf(assign, "duplicate string identifier %v", assign.Left)
+			continue
+		}
+
+		c.strs[assign.Left] = assign
+	}
+
+	if rule.Condition == nil {
+		c.errorf(rule, "missing condition")
+	} else if t := c.expr(rule.Condition); t != Invalid && !t.boolean() {
+		c.errorf(rule.Condition, "condition must be a boolean expression, got %v", t)
+	}
+
+	c.unused()
+
+	c.rules[rule.Name] = true
+
+	return c.errs
+}
+
+// Declare declares a rule without checking it, e.g. a rule that did
+// not parse, the rules referring to it get no errors.
+func (c *Checker) Declare(name string) {
+	c.rules[name] = true
+}
+
+// Define declares an external variable of type t, a value defined
+// outside of the rules, e.g. with yara's -d option.
+func (c *Checker) Define(name string, t Type) {
+	c.externals[name] = t
+}
+
+func (c *Checker) errorf(node ast.Node, format string, args ...interface{}) {
+	c.errorAt(ast.TokenOf(node), format, args...)
+}
+
+// errorAt reports an error at a token, at the start of the rule if the
+// token is nil.
+func (c *Checker) errorAt(tok *lexer.Token, format string, args ...interface{}) {
+	if tok == nil {
+		tok = c.rule.Token
+	}
+
+	row, col := 0, 0
+	if tok != nil {
+		row, col = tok.Row, tok.Col
+	}
+
+	c.errs = append(c.errs, &lexer.Error{Row: row, Col: col, Message: fmt.Sprintf(format, args...)})
+}
+
+// unused reports the strings the condition never refers to, like yara
+// strings starting with $_ can go unused.
+func (c *Checker) unused() {
+	if c.all {
+		return
+	}
+
+	for _, node := range c.rule.Strings {
+		assign, ok := node.(*ast.Assignment)
+		if !ok || c.used[assign.Left] || strings.HasPrefix(assign.Left, "$_") {
+			continue
+		}
+
+		used := false
+		for _, prefix := range c.prefixes {
+			if strings.HasPrefix(assign.Left, prefix) {
+				used = true
+				break
+			}
+		}
+
+		if !used {
+			c.errorf(assign, "unreferenced string %v", assign.Left)
+		}
+	}
+}
+
+// expr returns the type of an expression, reporting its errors.
+func (c *Checker) expr(node ast.Node) Type {
+	switch n := node.(type) {
+	case *ast.Integer:
+		return Int
+
+	case *ast.Bool:
+		return Bool
+
+	case *ast.String:
+		return String
+
+	case *ast.Regex:
+		return Regex
+
+	case *ast.Variable:
+		return c.variable(n)
+
+	case *ast.Identity:
+		return c.identity(n)
+
+	case *ast.Keyword:
+		return c.keyword(n)
+
+	case *ast.Prefix:
+		return c.prefix(n)
+
+	case *ast.Infix:
+		return c.infix(n)
+
+	case *ast.For:
+		return c.loop(n)
+
+	case *ast.With:
+		return c.with(n)
+
+	case *ast.Set:
+		c.errorf(n, "unexpected set %v, sets are only valid after 'of' or 'in'", n)
+
+	case *ast.Percentage:
+		c.errorf(n, "unexpected percentage %v, percentages are only valid before 'of'", n)
+
+	default:
+		c.errorf(n, "invalid expression %v", n)
+	}
+
+	return Invalid
+}
+
+// variable types $a, #a, @a and !a, the anonymous $, #, @ and ! refer to
+// the string of the enclosing loop.
+func (c *Checker) variable(v *ast.Variable) Type {
+	if strings.HasSuffix(v.Value, "*") {
+		c.errorf(v, "unexpected wildcard %v, wildcards are only valid in a set", v.Value)
+		return Invalid
+	}
+
+	if !c.useString(v, v.Value) {
+		return Invalid
+	}
+
+	if strings.HasPrefix(v.Value, "$") {
+		return Bool
+	}
+
+	return Int
+}
+
+// useString marks the string a variable refers to as used, reporting
+// strings that are not declared.
+func (c *Checker) useString(node ast.Node, value string) bool {
+	name := "$" + value[1:]
+
+	if name == "$" {
+		if !c.inLoop {
+			c.errorf(node, "anonymous %v outside of a loop over strings", value)
+			return false
+		}
+
+		return true
+	}
+
+	if strings.HasSuffix(name, "*") {
+		prefix := strings.TrimSuffix(name, "*")
+
+		for str := range c.strs {
+			if strings.HasPrefix(str, prefix) {
+				c.prefixes = append(c.prefixes, prefix)
+				return true
+			}
+		}
+
+		c.errorf(node, "no strings match %v", value)
+		return false
+	}
+
+	if _, ok := c.strs[name]; !ok {
+		c.errorf(node, "undefined string %v", name)
+		return false
+	}
+
+	c.used[name] = true
+
+	return true
+}
+
+func (c *Checker) identity(ident *ast.Identity) Type {
+	if t, ok := c.scope[ident.Value]; ok {
+		return t
+	}
+
+	// the result of a rule declared earlier
+	if c.rules[ident.Value] {
+		return Bool
+	}
+
+	if t, ok := c.externals[ident.Value]; ok {
+		return t
+	}
+
+	if c.modules[ident.Value] {
+		c.errorf(ident, "unknown identifier '%v', modules are not supported", ident.Value)
+		return Invalid
+	}
+
+	c.errorf(ident, "unknown identifier '%v'", ident.Value)
+	return Invalid
+}
+
+func (c *Checker) keyword(keyword *ast.Keyword) Type {
+	switch keyword.Token.Type {
+	case lexer.FILESIZE, lexer.ENTRYPOINT:
+		return Int
+
+	case lexer.INT8, lexer.INT16, lexer.INT32, lexer.INT8BE, lexer.INT16BE, lexer.INT32BE,
+		lexer.UINT8, lexer.UINT16, lexer.UINT32, lexer.UINT8BE, lexer.UINT16BE, lexer.UINT32BE:
+		if keyword.Attribute == nil {
+			c.errorf(keyword, "%v expects an offset", keyword.Value)
+			return Invalid
+		}
+
+		if !c.expect(keyword.Attribute, Int, "the offset of %v", keyword.Value) {
+			return Invalid
+		}
+
+		return Int
+
+	case lexer.THEM, lexer.ANY, lexer.ALL, lexer.NONE:
+		c.errorf(keyword, "unexpected '%v', it is only valid in an 'of' expression", keyword.Value)
+
+	default:
+		c.errorf(keyword, "invalid keyword '%v' in a condition", keyword.Value)
+	}
+
+	return Invalid
+}
+
+// expect checks that an expression has the type t, what describes the
+// expression in the error.
+func (c *Checker) expect(node ast.Node, t Type, what string, args ...interface{}) bool {
+	got := c.expr(node)
+	if got == Invalid {
+		return false
+	}
+
+	if got != t {
+		c.errorf(node, "%v must be %v, got %v", fmt.Sprintf(what, args...), t, got)
+		return false
+	}
+
+	return true
+}
+
+func (c *Checker) prefix(prefix *ast.Prefix) Type {
+	t := c.expr(prefix.Right)
+	if t == Invalid {
+		return Invalid
+	}
+
+	switch prefix.Token.Type {
+	case lexer.LPAREN:
+		return t
+
+	case lexer.MINUS:
+		if !t.numeric() {
+			c.errorf(prefix, "operator '-' expects an int or a float, got %v", t)
+			return Invalid
+		}
+
+		return t
+
+	case lexer.NOT:
+		if !t.boolean() {
+			c.errorf(prefix, "operator 'not' expects a boolean expression, got %v", t)
+			return Invalid
+		}
+
+		return Bool
+	}
+
+	c.errorf(prefix, "unsupported operator '%v'", prefix.Token.Raw)
+	return Invalid
+}
+
+func (c *Checker) infix(infix *ast.Infix) Type {
+	switch infix.Token.Type {
+	case lexer.OF:
+		return c.of(infix, nil)
+
+	case lexer.AT, lexer.IN:
+		return c.where(infix)
+
+	case lexer.LBRACKET:
+		return c.index(infix)
+
+	case lexer.DOT:
+		c.errorf(infix, "unknown identifier '%v', modules are not supported", infix)
+		return Invalid
+
+	case lexer.RANGE:
+		c.errorf(infix, "unexpected range %v, ranges are only valid after 'in'", infix)
+		return Invalid
+	}
+
+	left := c.expr(infix.Left)
+	right := c.expr(infix.Right)
+
+	if left == Invalid || right == Invalid {
+		return Invalid
+	}
+
+	op := infix.Token.Raw
+
+	switch infix.Token.Type {
+	case lexer.AND, lexer.OR:
+		if !left.boolean() || !right.boolean() {
+			return c.mismatch(infix, op, "boolean expressions", left, right)
+		}
+
+		return Bool
+
+	case lexer.PLUS, lexer.MINUS, lexer.ASTERISK, lexer.DIVIDE:
+		if !left.numeric() || !right.numeric() {
+			return c.mismatch(infix, op, "ints or floats", left, right)
+		}
+
+		if left == Float || right == Float {
+			return Float
+		}
+
+		return Int
+
+	case lexer.MOD, lexer.AMPERSAND, lexer.PIPE, lexer.CARET, lexer.SHIFTLEFT, lexer.SHIFTRIGHT:
+		if left != Int || right != Int {
+			return c.mismatch(infix, op, "ints", left, right)
+		}
+
+		return Int
+
+	case lexer.LT, lexer.LTE, lexer.GT, lexer.GTE:
+		if !(left.numeric() && right.numeric()) && !(left == String && right == String) {
+			return c.mismatch(infix, op, "ints, floats or strings", left, right)
+		}
+
+		return Bool
+
+	case lexer.EQUAL, lexer.NOTEQUAL:
+		if !(left.numeric() && right.numeric()) && (left != right || left == Regex) {
+			return c.mismatch(infix, op, "values of the same type", left, right)
+		}
+
+		return Bool
+
+	case lexer.CONTAINS, lexer.ICONTAINS, lexer.STARTSWITH, lexer.ISTARTSWITH,
+		lexer.ENDSWITH, lexer.IENDSWITH, lexer.IEQUALS:
+		if left != String || right != String {
+			return c.mismatch(infix, op, "strings", left, right)
+		}
+
+		return Bool
+
+	case lexer.MATCHES:
+		if left != String || right != Regex {
+			return c.mismatch(infix, op, "a string and a regex", left, right)
+		}
+
+		return Bool
+	}
+
+	c.errorf(infix, "unsupported operator '%v'", op)
+	return Invalid
+}
+
+func (c *Checker) mismatch(infix *ast.Infix, op string, expected string, left, right Type) Type {
+	c.errorf(infix, "operator '%v' expects %v, got %v and %v", op, expected, left, right)
+	return Invalid
+}
+
+// where checks '$a at 10', '$a in (0..10)' and the same forms with an
+// 'of' expression on the left.
+func (c *Checker) where(infix *ast.Infix) Type {
+	ok := true
+
+	if infix.Token.Type == lexer.AT {
+		ok = c.expect(infix.Right, Int, "the offset of 'at'")
+	} else {
+		ok = c.rangeOf(infix.Right)
+	}
+
+	if of, isOf := infix.Left.(*ast.Infix); isOf && of.Token.Type == lexer.OF {
+		if c.of(of, infix) == Invalid || !ok {
+			return Invalid
+		}
+
+		return Bool
+	}
+
+	v, isVar := infix.Left.(*ast.Variable)
+	if !isVar || !strings.HasPrefix(v.Value, "$") || strings.HasSuffix(v.Value, "*") {
+		c.errorf(infix, "the left side of '%v' must be a string, e.g. $a", infix.Token.Raw)
+		return Invalid
+	}
+
+	if !c.useString(v, v.Value) || !ok {
+		return Invalid
+	}
+
+	return Bool
+}
+
+// rangeOf checks a range of integers, e.g. (0..filesize).
+func (c *Checker) rangeOf(node ast.Node) bool {
+	if prefix, ok := node.(*ast.Prefix); ok && prefix.Token.Type == lexer.LPAREN {
+		node = prefix.Right
+	}
+
+	rng, ok := node.(*ast.Infix)
+	if !ok || rng.Token.Type != lexer.RANGE {
+		c.errorf(node, "expecting a range, e.g. (0..filesize), got %v", node)
+		return false
+	}
+
+	low := c.expect(rng.Left, Int, "the start of a range")
+	high := c.expect(rng.Right, Int, "the end of a range")
+
+	return low && high
+}
+
+// index checks '@a[i]' and '!a[i]'.
+func (c *Checker) index(infix *ast.Infix) Type {
+	v, ok := infix.Left.(*ast.Variable)
+	if !ok || !(strings.HasPrefix(v.Value, "@") || strings.HasPrefix(v.Value, "!")) || strings.HasSuffix(v.Value, "*") {
+		c.errorf(infix, "only offsets and lengths can be indexed, e.g. @a[1]")
+		return Invalid
+	}
+
+	used := c.useString(v, v.Value)
+	if !c.expect(infix.Right, Int, "the index of %v", v.Value) || !used {
+		return Invalid
+	}
+
+	return Int
+}
+
+// of checks 'any of them' and the sets of strings and rules of 'of'
+// expressions, where is the enclosing 'at' or 'in', if any.
+func (c *Checker) of(of *ast.Infix, where *ast.Infix) Type {
+	ok := c.quantifier(of.Left)
+
+	set := of.Right
+	if prefix, isGroup := set.(*ast.Prefix); isGroup && prefix.Token.Type == lexer.LPAREN {
+		set = prefix.Right
+	}
+
+	if !c.set(set, where == nil) {
+		return Invalid
+	}
+
+	if !ok {
+		return Invalid
+	}
+
+	return Bool
+}
+
+func (c *Checker) quantifier(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.Integer:
+		return true
+
+	case *ast.Percentage:
+		percent, ok := n.Value.(*ast.Integer)
+		if !ok || percent.Value < 1 || percent.Value > 100 {
+			c.errorf(n, "percentage must be an integer between 1 and 100")
+			return false
+		}
+
+		return true
+
+	case *ast.Keyword:
+		switch n.Token.Type {
+		case lexer.ANY, lexer.ALL, lexer.NONE:
+			return true
+		}
+	}
+
+	c.errorf(node, "invalid quantifier %v, expecting an integer, a percentage, 'any', 'all' or 'none'", node)
+	return false
+}
+
+// set checks a set of strings or, if rules is true, a set of rules.
+func (c *Checker) set(set ast.Node, rules bool) bool {
+	if keyword, ok := set.(*ast.Keyword); ok && keyword.Token.Type == lexer.THEM {
+		c.all = true
+		return true
+	}
+
+	items := []ast.Node{set}
+	if s, ok := set.(*ast.Set); ok {
+		items = s.Nodes
+	}
+
+	ok := true
+
+	for _, item := range items {
+		switch n := item.(type) {
+		case *ast.Variable:
+			if !strings.HasPrefix(n.Value, "$") {
+				c.errorf(n, "invalid set item %v, expecting a string, e.g. $a", n.Value)
+				ok = false
+			} else if !c.useString(n, n.Value) {
+				ok = false
+			}
+
+		case *ast.Identity:
+			if !rules {
+				c.errorf(n, "invalid set item %v, only strings have offsets", n.Value)
+				ok = false
+			} else if !c.ruleSet(n) {
+				ok = false
+			}
+
+		default:
+			c.errorf(item, "invalid set item %v, expecting a string or a rule", item)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// ruleSet checks a rule or a rule wildcard in a set, e.g. Rule*.
+func (c *Checker) ruleSet(ident *ast.Identity) bool {
+	prefix := strings.TrimSuffix(ident.Value, "*")
+
+	if prefix == ident.Value {
+		if !c.rules[ident.Value] {
+			c.errorf(ident, "unknown rule '%v', rules can only refer to the rules before them", ident.Value)
+			return false
+		}
+
+		return true
+	}
+
+	for name := range c.rules {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	c.errorf(ident, "no rules before this one match %v", ident.Value)
+	return false
+}
+
+func (c *Checker) loop(loop *ast.For) Type {
+	ok := true
+
+	if loop.Percent {
+		if n, err := strconv.ParseInt(loop.Expr.Raw, 0, 64); err != nil || n < 1 || n > 100 {
+			c.errorf(loop, "percentage must be an integer between 1 and 100")
+			ok = false
+		}
+	}
+
+	// for any of ($a, $b) : ( $ at 0 )
+	if len(loop.Vars) == 0 {
+		set := loop.Iterable
+		if prefix, isGroup := set.(*ast.Prefix); isGroup && prefix.Token.Type == lexer.LPAREN {
+			set = prefix.Right
+		}
+
+		if !c.set(set, false) {
+			ok = false
+		}
+
+		outer := c.inLoop
+		c.inLoop = true
+		body := c.body(loop.Body)
+		c.inLoop = outer
+
+		if !ok || !body {
+			return Invalid
+		}
+
+		return Bool
+	}
+
+	if len(loop.Vars) > 1 {
+		c.errorf(loop, "unknown iterable '%v', only module dictionaries take two loop variables and modules are not supported", loop.Iterable)
+		return Invalid
+	}
+
+	// the slot of the variable only holds integers, the items must be
+	// integers too
+	items := true
+
+	switch iterable := loop.Iterable.(type) {
+	case *ast.Infix:
+		switch iterable.Token.Type {
+		case lexer.DOT:
+			c.errorf(iterable, "unknown iterable '%v', modules are not supported", iterable)
+			items = false
+		case lexer.RANGE:
+			items = c.rangeOf(iterable)
+		default:
+			items = c.expect(iterable, Int, "the items of a loop")
+		}
+
+	case *ast.Set:
+		for _, item := range iterable.Nodes {
+			items = c.expect(item, Int, "the items of a loop") && items
+		}
+
+	default:
+		items = c.expect(iterable, Int, "the items of a loop")
+	}
+
+	t := Int
+	if !items {
+		// the uses of the variable report no more errors
+		t = Invalid
+		ok = false
+	}
+
+	unbind, declared := c.bind(loop.Expr, loop.Vars[0], t)
+	body := c.body(loop.Body)
+	unbind()
+
+	ok = ok && declared
+
+	if !ok || !body {
+		return Invalid
+	}
+
+	return Bool
+}
+
+// body checks the body of a loop, a boolean expression.
+func (c *Checker) body(node ast.Node) bool {
+	t := c.expr(node)
+	if t == Invalid {
+		return false
+	}
+
+	if !t.boolean() {
+		c.errorf(node, "the body of a loop must be a boolean expression, got %v", t)
+		return false
+	}
+
+	return true
+}
+
+// bind puts a local variable in scope and returns a func taking it out
+// of scope. A variable hiding another identifier is an error, it is put
+// in scope as Invalid so its uses report no more errors.
+func (c *Checker) bind(tok *lexer.Token, name string, t Type) (func(), bool) {
+	outer, shadowed := c.scope[name]
+	ok := true
+
+	if shadowed {
+		c.errorAt(tok, "duplicate identifier '%v', it is already defined in this scope", name)
+		ok = false
+	} else if c.rules[name] {
+		c.errorAt(tok, "duplicate identifier '%v', it is already defined as a rule", name)
+		ok = false
+	} else if _, defined := c.externals[name]; defined {
+		c.errorAt(tok, "duplicate identifier '%v', it is already defined as an external variable", name)
+		ok = false
+	}
+
+	if !ok {
+		t = Invalid
+	}
+
+	c.scope[name] = t
+
+	return func() {
+		if shadowed {
+			c.scope[name] = outer
+		} else {
+			delete(c.scope, name)
+		}
+	}, ok
+}
+
+func (c *Checker) with(with *ast.With) Type {
+	ok := true
+	var unbinds []func()
+
+	for _, binding := range with.Bindings {
+		t := c.expr(binding.Value)
+		if t == Invalid {
+			ok = false
+		} else if t != Int && t != Bool {
+			// the slots of the bindings only hold integers
+			c.errorAt(binding.Token, "%v bindings are not supported", t)
+			t = Invalid
+			ok = false
+		}
+
+		unbind, declared := c.bind(binding.Token, binding.Name, t)
+		unbinds = append(unbinds, unbind)
+		ok = ok && declared
+	}
+
+	t := c.expr(with.Body)
+
+	for i := len(unbinds) - 1; i >= 0; i-- {
+		unbinds[i]()
+	}
+
+	if !ok {
+		return Invalid
+	}
+
+	return t
+}
@@ -0,0 +1,127 @@
+package check
+
+import (
+	"testing"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/parser"
+)
+
+func checkRules(t *testing.T, input string) []string {
+	p, err := parser.New(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := New([]string{"pe"})
+	msgs := make([]string, 0)
+
+	for _, node := range p.Nodes {
+		if rule, ok := node.(*ast.Rule); ok {
+			for _, err := range checker.Rule(rule) {
+				msgs = append(msgs, err.Error())
+			}
+		}
+	}
+
+	return msgs
+}
+
+func TestCheckCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  string
+	}{
+		{"$a and #a > 1 and @a[1] >= 0", ""},
+		{"$a + 1 == 2", "operator '+' expects ints or floats, got bool and int"},
+		{`$a + "x"`, "operator '+' expects ints or floats, got bool and string"},
+		{"#a", ""},
+		{`$a and "foo"`, ""},
+		{`$a and not ""`, ""},
+		{`$a and for any i in (0..2) : ( "foo" )`, ""},
+		{"$a and /foo/", "operator 'and' expects boolean expressions, got bool and regex"},
+		{"$a and $b", "undefined string $b"},
+		{"$a and #b > 0", "undefined string $b"},
+		{"$a and $", "anonymous $ outside of a loop over strings"},
+		{"$a and for any of them : ( $ at 0 )", ""},
+		{"$a and $c*", "unexpected wildcard $c*, wildcards are only valid in a set"},
+		{"$a and any of ($c*)", "no strings match $c*"},
+		{"$a and filesize matches /foo/", "operator 'matches' expects a string and a regex, got int and regex"},
+		{"$a at \"x\"", "the offset of 'at' must be int, got string"},
+		{"$a in (0..$a)", "the end of a range must be int, got bool"},
+		{"$a and for any i in (0..2) : ( @a[i] == 0 )", ""},
+		{"$a and for any i in (0..2) : ( for any i in (0..1) : ( i == 0 ) )", "duplicate identifier 'i', it is already defined in this scope"},
+		{"$a and for 101% i in (0..2) : ( true )", "percentage must be an integer between 1 and 100"},
+		{"$a and with x = #a : ( x == 1 )", ""},
+		{`$a and with s = "abc" : ( s contains "b" )`, "error 8:21: string bindings are not supported"},
+		{"$a and with A = 1 : ( A == 1 )", "duplicate identifier 'A', it is already defined as a rule"},
+		{"$a and pe.number_of_sections > 1", "modules are not supported"},
+		{"$a and foo", "unknown identifier 'foo'"},
+		{"$a and 1 of (A, C)", "unknown rule 'C', rules can only refer to the rules before them"},
+	}
+
+	for _, test := range tests {
+		input := `
+rule A { condition: true }
+
+rule B {
+    strings:
+        $a = "foo"
+    condition:
+        ` + test.condition + `
+}`
+
+		msgs := checkRules(t, input)
+
+		if test.expected == "" {
+			if len(msgs) != 0 {
+				t.Fatalf("%v: unexpected errors %v", test.condition, msgs)
+			}
+
+			continue
+		}
+
+		if len(msgs) != 1 || msgs[0][len(msgs[0])-len(test.expected):] != test.expected {
+			t.Fatalf("%v: expecting '%v', got %v", test.condition, test.expected, msgs)
+		}
+	}
+}
+
+func TestCheckDeclarations(t *testing.T) {
+	input := `
+rule A {
+    strings:
+        $a = "foo"
+        $b = "bar"
+        $a = "baz"
+        $_c = "private"
+    condition:
+        $a
+}
+
+rule A {
+    strings:
+        $a = "foo"
+    condition:
+        $a and #b == 1 and $a + 1 == 2
+}`
+
+	expected := []string{
+		"error 6:9: duplicate string identifier $a",
+		"error 5:9: unreferenced string $b",
+		"error 12:6: duplicate rule name 'A'",
+		"error 16:16: undefined string $b",
+		"error 16:31: operator '+' expects ints or floats, got bool and int",
+	}
+
+	msgs := checkRules(t, input)
+	if len(msgs) != len(expected) {
+		t.Fatalf("expecting %v errors, got %v", len(expected), msgs)
+	}
+
+	for i, msg := range msgs {
+		if msg != expected[i] {
+			t.Fatalf("expecting '%v', got '%v'", expected[i], msg)
+		}
+	}
+}
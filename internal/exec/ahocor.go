@@ -10,21 +10,30 @@ type ACNode struct {
 	children    [256]*ACNode
 	fail        *ACNode
 	alternative *ACNode
-	match       int
 	// index in the current pattern, used for partial compares if
 	// access to the start of the pattern is needed.
 	matchOffset int
-	// signals that this particular node's match is a partial
-	// Match. The fullMatch value is the full value to match
-	// against, contains ?? bytes as well. fullMatch can contain more
-	// than 1 potential match case.
-	fullMatch [][]int
-	// contains the match index for this full match pattern.
-	matchIndex []int
-	// signal if the node contains a regex prefix match. If there is a
+	// every pattern completed by this node. More than one pattern can
+	// end on the same node, e.g. two hex strings sharing an atom.
+	outputs []*ACOutput
+}
+
+type ACOutput struct {
+	// index in the matches slice this output records into
+	matchIndex int
+	// signals that this output is a partial match. The fullMatch
+	// value is the full value to match against, contains ?? bytes
+	// as well.
+	fullMatch []int
+	// offset of the atom within fullMatch. The full match is
+	// verified backward and forward from the atom.
+	atomOffset int
+	// signal if the output is a regex prefix match. If there is a
 	// prefix match, check the input bytes starting at the prefix
 	// match.
 	re *regexp.Regexp
+	// length of the match when the atom is the complete pattern
+	length int
 }
 
 func ACBuild(patterns []*Pattern) []*ACNode {
@@ -37,7 +46,6 @@ func ACBuild(patterns []*Pattern) []*ACNode {
 		children:    [256]*ACNode{},
 		fail:        nil,
 		alternative: nil,
-		match:       -1,
 		matchOffset: 0,
 	}
 
@@ -49,24 +57,15 @@ func ACBuild(patterns []*Pattern) []*ACNode {
 	for _, pattern := range patterns {
 		cur = root
 
-		bs := pattern.Pattern
-		for j, b := range bs {
-
-			if node := cur.children[b]; node != nil {
-
-				if j == len(bs)-1 {
-					node.match = pattern.MatchIndex
-
-					if pattern.IsPartial {
-						node.fullMatch = append(node.fullMatch, pattern.FullMatch)
-						node.matchIndex = append(node.matchIndex, pattern.MatchIndex)
-					}
+		// patterns without an atom hang off the root and are
+		// verified at every offset of the input
+		if len(pattern.Pattern) == 0 && !pattern.IsPartial {
+			continue
+		}
 
-					if pattern.Re != nil {
-						node.re = pattern.Re
-					}
-				}
+		for j, b := range pattern.Pattern {
 
+			if node := cur.children[b]; node != nil {
 				cur = node
 				continue
 			}
@@ -76,32 +75,28 @@ func ACBuild(patterns []*Pattern) []*ACNode {
 				data:        b,
 				children:    [256]*ACNode{},
 				fail:        nil,
-				match:       -1,
 				matchOffset: j,
 			}
 
-			if j == len(bs)-1 {
-				node.match = pattern.MatchIndex
-
-				if pattern.IsPartial {
-					node.fullMatch = make([][]int, 0)
-					node.fullMatch = append(node.fullMatch, pattern.FullMatch)
-					node.matchIndex = make([]int, 0)
-					node.matchIndex = append(node.matchIndex, pattern.MatchIndex)
-				}
-
-				if pattern.Re != nil {
-					node.re = pattern.Re
-				}
-
-			}
-
 			nodes = append(nodes, node)
 			ids++
 
 			cur.children[b] = node
 			cur = node
 		}
+
+		output := &ACOutput{
+			matchIndex: pattern.MatchIndex,
+			atomOffset: pattern.AtomOffset,
+			re:         pattern.Re,
+			length:     len(pattern.Pattern),
+		}
+
+		if pattern.IsPartial {
+			output.fullMatch = pattern.FullMatch
+		}
+
+		cur.outputs = append(cur.outputs, output)
 	}
 
 	root.fail = root
@@ -159,7 +154,9 @@ func ACBuild(patterns []*Pattern) []*ACNode {
 			failQueue = append(failQueue, child)
 		}
 
-		if cur.fail != nil && cur.fail.match >= 0 {
+		// the root outputs are checked on every byte, they are never
+		// an alternative
+		if cur.fail != root && len(cur.fail.outputs) > 0 {
 			cur.alternative = cur.fail
 		} else {
 			cur.alternative = cur.fail.alternative
@@ -168,341 +165,3 @@ func ACBuild(patterns []*Pattern) []*ACNode {
 
 	return nodes
 }
-
-// ACNext will perform a single byte transition of the automata,
-// returning any indexes where a pattern is hit
-func ACNext(matches []*[]int, nodes []*ACNode, input []byte) {
-
-	node := nodes[0]
-
-	for i := 0; i < len(input); i++ {
-		b := input[i]
-		// check if there is a path
-		new := node.children[b]
-
-		// if there is a child node that matches the input
-		if new != nil {
-			// transition to the next node
-			node = new
-
-			// check if this node completes a match
-			if node.match >= 0 {
-
-				if node.fullMatch == nil && node.re == nil {
-					if lst := matches[node.match]; lst != nil {
-						*lst = append(*lst, i-node.matchOffset)
-					} else {
-						matches[node.match] = &[]int{i - node.matchOffset}
-					}
-
-				} else if node.fullMatch != nil {
-					for k, part := range node.fullMatch {
-
-						match := true
-
-						for j := 0; j < len(part); j++ {
-							if part[j]&0x1000 == 0x1000 {
-								continue
-							}
-
-							if j+i-node.matchOffset >= len(input) {
-								match = false
-								break
-							}
-
-							if byte(part[j]) != input[j+i-node.matchOffset] {
-								match = false
-								break
-							}
-						}
-
-						if match {
-							if lst := matches[node.matchIndex[k]]; lst != nil {
-								*lst = append(*lst, i-node.matchOffset)
-							} else {
-								matches[node.matchIndex[k]] = &[]int{i - node.matchOffset}
-							}
-
-							break
-						}
-					}
-
-				} else if node.re != nil {
-					indexes := node.re.FindAllIndex(input[i-node.matchOffset:], -1)
-
-					if len(matches) > 0 {
-						base := i - node.matchOffset
-						for _, i := range indexes {
-							if lst := matches[node.match]; lst != nil {
-								*lst = append(*lst, base+i[0])
-							} else {
-								matches[node.match] = &[]int{base + i[0]}
-							}
-						}
-					}
-
-				}
-			}
-
-			// jump to each alternative matching node if they exist
-			temp := node.alternative
-			for {
-				if temp == nil {
-					break
-				}
-
-				if node.match >= 0 {
-
-					if node.fullMatch == nil && node.re == nil {
-						if lst := matches[node.match]; lst != nil {
-							*lst = append(*lst, i-node.matchOffset)
-						} else {
-							matches[node.match] = &[]int{i - node.matchOffset}
-						}
-
-					} else if node.fullMatch != nil {
-						for k, part := range node.fullMatch {
-
-							match := true
-
-							for j := 0; j < len(part); j++ {
-								if part[j]&0x1000 == 0x1000 {
-									continue
-								}
-
-								if j+i-node.matchOffset >= len(input) {
-									match = false
-									break
-								}
-
-								if byte(part[j]) != input[j+i-node.matchOffset] {
-									match = false
-									break
-								}
-							}
-
-							if match {
-								if lst := matches[node.matchIndex[k]]; lst != nil {
-									*lst = append(*lst, i-node.matchOffset)
-								} else {
-									matches[node.matchIndex[k]] = &[]int{i - node.matchOffset}
-								}
-
-								break
-							}
-						}
-
-					} else if node.re != nil {
-						indexes := node.re.FindAllIndex(input[i-node.matchOffset:], -1)
-
-						if len(matches) > 0 {
-							base := i - node.matchOffset
-							for _, i := range indexes {
-								if lst := matches[node.match]; lst != nil {
-									*lst = append(*lst, base+i[0])
-								} else {
-									matches[node.match] = &[]int{base + i[0]}
-								}
-							}
-						}
-
-					}
-				}
-
-				temp = temp.alternative
-			}
-
-		} else {
-
-			// jump to each failure node until a next matching
-			// transition node is found, or back at the root.
-			for {
-				ok := node.children[b] != nil
-
-				if node.id == 0 {
-					break
-				}
-
-				if ok {
-					break
-				}
-
-				node = node.fail
-			}
-
-			// rerun this input char again as we moved nodes
-			if node.children[b] != nil {
-				i--
-			}
-		}
-	}
-}
-
-func ACNextNocase(matches []*[]int, nodes []*ACNode, input []byte) {
-
-	node := nodes[0]
-
-	for i := 0; i < len(input); i++ {
-		b := input[i]
-		if b >= 0x41 && b <= 0x5a {
-			b = b | 0x20
-		}
-		// check if there is a path
-		new := node.children[b]
-
-		// if there is a child node that matches the input
-		if new != nil {
-			// transition to the next node
-			node = new
-
-			if node.match >= 0 {
-
-				if node.fullMatch == nil && node.re == nil {
-					if lst := matches[node.match]; lst != nil {
-						*lst = append(*lst, i-node.matchOffset)
-					} else {
-						matches[node.match] = &[]int{i - node.matchOffset}
-					}
-
-				} else if node.fullMatch != nil {
-					for k, part := range node.fullMatch {
-
-						match := true
-
-						for j := 0; j < len(part); j++ {
-							if part[j]&0x1000 == 0x1000 {
-								continue
-							}
-
-							if j+i-node.matchOffset >= len(input) {
-								match = false
-								break
-							}
-
-							if byte(part[j]) != input[j+i-node.matchOffset] {
-								match = false
-								break
-							}
-						}
-
-						if match {
-							if lst := matches[node.matchIndex[k]]; lst != nil {
-								*lst = append(*lst, i-node.matchOffset)
-							} else {
-								matches[node.matchIndex[k]] = &[]int{i - node.matchOffset}
-							}
-
-							break
-						}
-					}
-
-				} else if node.re != nil {
-					indexes := node.re.FindAllIndex(input[i-node.matchOffset:], -1)
-
-					if len(matches) > 0 {
-						base := i - node.matchOffset
-						for _, i := range indexes {
-							if lst := matches[node.match]; lst != nil {
-								*lst = append(*lst, base+i[0])
-							} else {
-								matches[node.match] = &[]int{base + i[0]}
-							}
-						}
-					}
-
-				}
-			}
-
-			// jump to each alternative matching node if they exist
-			temp := node.alternative
-			for {
-				if temp == nil {
-					break
-				}
-
-				if node.match >= 0 {
-
-					if node.fullMatch == nil && node.re == nil {
-						if lst := matches[node.match]; lst != nil {
-							*lst = append(*lst, i-node.matchOffset)
-						} else {
-							matches[node.match] = &[]int{i - node.matchOffset}
-						}
-
-					} else if node.fullMatch != nil {
-						for k, part := range node.fullMatch {
-
-							match := true
-
-							for j := 0; j < len(part); j++ {
-								if part[j]&0x1000 == 0x1000 {
-									continue
-								}
-
-								if j+i-node.matchOffset >= len(input) {
-									match = false
-									break
-								}
-
-								if byte(part[j]) != input[j+i-node.matchOffset] {
-									match = false
-									break
-								}
-							}
-
-							if match {
-								if lst := matches[node.matchIndex[k]]; lst != nil {
-									*lst = append(*lst, i-node.matchOffset)
-								} else {
-									matches[node.matchIndex[k]] = &[]int{i - node.matchOffset}
-								}
-
-								break
-							}
-						}
-
-					} else if node.re != nil {
-						indexes := node.re.FindAllIndex(input[i-node.matchOffset:], -1)
-
-						if len(matches) > 0 {
-							base := i - node.matchOffset
-							for _, i := range indexes {
-								if lst := matches[node.match]; lst != nil {
-									*lst = append(*lst, base+i[0])
-								} else {
-									matches[node.match] = &[]int{base + i[0]}
-								}
-							}
-						}
-
-					}
-				}
-
-				temp = temp.alternative
-			}
-
-		} else {
-
-			// jump to each failure node until a next matching
-			// transition node is found, or back at the root.
-			for {
-				ok := node.children[b] != nil
-
-				if node.id == 0 {
-					break
-				}
-
-				if ok {
-					break
-				}
-
-				node = node.fail
-			}
-
-			// rerun this input char again as we moved nodes
-			if node.children[b] != nil {
-				i--
-			}
-		}
-	}
-}
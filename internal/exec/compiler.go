@@ -4,12 +4,15 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"os"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/check"
 	"github.com/kgwinnup/go-yara/internal/lexer"
 	"github.com/kgwinnup/go-yara/internal/parser"
 )
@@ -24,20 +27,47 @@ type Pattern struct {
 	// complete string with 0x10000 as place holders for bytes with ??
 	FullMatch []int
 	IsPartial bool
-	Re        *regexp.Regexp
+	// offset of Pattern within FullMatch, the atom is not always the
+	// leading bytes of the string
+	AtomOffset int
+	Re         *regexp.Regexp
 }
 
+var ErrTimeout = errors.New("exec: scan timed out")
+
 type CompiledRule struct {
 	instr []Op
-	tags  []string
-	name  string
+	// instr before optimizing
+	raw  []Op
+	tags []string
+	name string
+	meta map[string]interface{}
+	// the meta identifiers in the order they are declared
+	metaKeys []string
+	// string identifiers of the rule in the order they are declared,
+	// along with the index of their matches
+	strings []*ruleString
+	// match indexes of which at least one must have matched for the
+	// condition to be true, nil if the rule is always evaluated
+	required []int
+	// deepest the stack grows while running instr, not counting the
+	// slots of the loops
+	depth int
+	// number of slots used by the loops of the condition
+	slots int
 }
 
-type ScanOutput struct {
-	Name string
-	Tags []string
+type ruleString struct {
+	name  string
+	index int
+	// the data of the matches of a hex string is printed as hex
+	hex bool
 }
 
+// CompiledRules are the rules, automata and instructions built by
+// Compile. They are not modified after Compile returns, so they are safe
+// to share across goroutines, each scan keeps its own state in a
+// Scanner.
 type CompiledRules struct {
 	rules []*CompiledRule
 	// stores a Pattern object by its RuleName_Var key
@@ -49,18 +79,73 @@ type CompiledRules struct {
 	automataCount       int
 	automataNocaseCount int
 	patternCount        int
-	// this is to hold variable names to register value. Hacky, i
-	// know.
+	// number of input bytes a streaming scan keeps from one chunk to
+	// the next, enough to verify the longest pattern from its atom
+	lookBehind int
+	// scanners reused by Scan, ScanReader and friends
+	pool sync.Pool
+	// modules imported by the rules
+	imports []string
+	// deepest stack of all the rules, slots included
+	maxDepth int
+	// a condition reads the entry point, the input headers are only
+	// parsed if so
+	entryPoint bool
+	// only the first match of each string is recorded
+	fast bool
+	// sums the work of the scans, nil unless profiling
+	profiler *profiler
+}
+
+// compiler holds the state used while building the instructions of a
+// rule. Unlike the CompiledRules it builds, it is thrown away once the
+// rules are compiled.
+type compiler struct {
+	*CompiledRules
+	// the loop variables in scope, mapped to their slot
 	tempVars map[string]int64
-	tempVar  int64
+	// match index of the string the anonymous $, # and @ refer to in
+	// the body of a loop over strings
+	tempVar int64
+	// slots in use by the enclosing loops, and the most used at once
+	// by the current rule
+	slots    int
+	maxSlots int
+	// mapping names of the strings declared in each rule
+	ruleStrings map[string][]string
+	// index of each rule compiled so far, rules can only refer to the
+	// rules declared before them
+	ruleIndex map[string]int
+	// the patterns of the automata, nocase patterns have their own
+	patterns       []*Pattern
+	patternsNocase []*Pattern
+	// patterns by the hash of their string, identical strings share a
+	// pattern
+	dups map[string]*Pattern
+	// index where the next pattern will be in the match structure when
+	// evaluated
+	index int
+	// the warnings of all the rules
+	warnings *errorList
+	// the strings of the current rule by the hash of their bytes and
+	// modifiers
+	ruleHashes map[string]string
+	// the values of the external variables by name
+	externals map[string]interface{}
 }
 
 func (c *CompiledRules) Debug() {
 	fmt.Println("instructions stack")
 	for _, rule := range c.rules {
 		fmt.Printf("    rule %v\n", rule.name)
-		size := len(rule.instr)
-		for i := size - 1; i >= 0; i-- {
+
+		fmt.Println("      before optimizing")
+		for i := len(rule.raw) - 1; i >= 0; i-- {
+			fmt.Printf("        %v: %v\n", i, rule.raw[i])
+		}
+
+		fmt.Println("      after optimizing")
+		for i := len(rule.instr) - 1; i >= 0; i-- {
 			fmt.Printf("        %v: %v\n", i, rule.instr[i])
 		}
 	}
@@ -76,217 +161,427 @@ func (c *CompiledRules) Debug() {
 	}
 }
 
-func (c *CompiledRules) Scan(input []byte, s bool, timeout int) ([]*ScanOutput, error) {
+func scanDeadline(timeout int) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
 
-	output := make([]*ScanOutput, 0)
-	matches := make([]*[]int, c.patternCount)
+	return time.Now().Add(time.Duration(timeout) * time.Second)
+}
 
-	static := make([]int64, 0)
-	static = append(static, int64(len(input)))
+// Compiler compiles rules, keeping the warnings of the last compile.
+type Compiler struct {
+	// fail a compile with warnings, the warnings are returned as
+	// errors
+	WarningsAsErrors bool
+	// record only the first match of each string, like the fast
+	// matching mode of yara. Conditions counting the matches of a
+	// string, or reading their offsets, see at most one match.
+	FastScan bool
+	// count the work of each rule and string while scanning, see
+	// CompiledRules.Profile. Profiling slows scans down, the counts
+	// are for comparing rules, not for timing them in production.
+	Profile   bool
+	warnings  CompileErrors
+	externals map[string]interface{}
+}
 
-	var wg sync.WaitGroup
-	// get the next node in the automata and return a list of
-	// matches indexed the same as the patterns slice
-	if c.automataCount > 0 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			ACNext(matches, c.automata, input)
-		}()
+// NewCompiler creates a Compiler with the default options.
+func NewCompiler() *Compiler {
+	return &Compiler{}
+}
+
+// DefineVariable defines an external variable the conditions can refer
+// to by name, like the -d option of yara. The value is a bool, an
+// integer or a string, it is fixed once the rules are compiled.
+func (comp *Compiler) DefineVariable(name string, value interface{}) error {
+	switch v := value.(type) {
+	case bool, string, int64:
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	default:
+		return errors.New(fmt.Sprintf("exec: invalid value %v for variable '%v', expecting a bool, an integer or a string", value, name))
 	}
 
-	if c.automataNocaseCount > 0 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			ACNextNocase(matches, c.automataNocase, input)
-		}()
+	if comp.externals == nil {
+		comp.externals = make(map[string]interface{})
 	}
 
-	wg.Wait()
+	comp.externals[name] = value
+	return nil
+}
 
-	for _, rule := range c.rules {
-		out, err := Eval(rule, matches, static)
-		if err != nil {
-			return nil, err
-		}
+// Warnings returns the warnings of the last compile, e.g. slow strings
+// or strings the condition never uses, ordered by their position.
+func (comp *Compiler) Warnings() CompileErrors {
+	return comp.warnings
+}
 
-		if out > 0 {
-			output = append(output, &ScanOutput{
-				Name: rule.name,
-				Tags: rule.tags,
-			})
+// Compile an input Yara rule(s) and create both the pattern objects
+// that will be matched on, add the patterns to the aho-corasick
+// automatons, and create the instructions to evaluate each rule. Errors
+// are returned as CompileErrors, holding every error of the input.
+func Compile(input string) (*CompiledRules, error) {
+	return NewCompiler().Compile(input)
+}
 
-			// add this rule to the global state for other rules to
-			// reference
-			//static[rule.name] = int64(out)
-		}
+// CompileFile compiles the rules in the file at path with the default
+// options.
+func CompileFile(path string) (*CompiledRules, error) {
+	return NewCompiler().CompileFile(path)
+}
+
+// Compile compiles the rules of input, see Compile.
+func (comp *Compiler) Compile(input string) (*CompiledRules, error) {
+	return comp.compile("", input)
+}
+
+// CompileFile compiles the rules in the file at path, the errors and
+// warnings refer to the path.
+func (comp *Compiler) CompileFile(path string) (*CompiledRules, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	return output, nil
+	return comp.compile(path, string(bs))
 }
 
-// Compile an input Yara rule(s) and create both the pattern objects
-// that will be matched on, add the patterns to the aho-corasick
-// automatons, and create the instructions to evaluate each rule
-func Compile(input string) (*CompiledRules, error) {
+func (comp *Compiler) compile(file string, input string) (*CompiledRules, error) {
+	errs := &errorList{file: file, input: input}
+	warnings := &errorList{file: file, input: input}
+
+	// the rules that parsed are still compiled to report their errors
+	// along with the syntax errors
 	parser, err := parser.New(input)
 	if err != nil {
-		return nil, err
+		errs.addSyntax(err)
 	}
 
 	rules := make([]*ast.Rule, 0)
 
 	// get all the rule nodes
+	imports := make([]string, 0)
+
 	for _, node := range parser.Nodes {
 		if rule, ok := node.(*ast.Rule); ok {
 			rules = append(rules, rule)
 		}
+
+		if mod, ok := node.(*ast.Import); ok {
+			imports = append(imports, mod.Value)
+		}
 	}
 
 	compiled := &CompiledRules{
 		rules:    make([]*CompiledRule, 0),
 		mappings: make(map[string]*Pattern),
-		tempVars: make(map[string]int64),
+		imports:  imports,
+		fast:     comp.FastScan,
 	}
 
-	patterns := make([]*Pattern, 0)
-	patternsNocase := make([]*Pattern, 0)
-	dups := make(map[string]*Pattern)
+	compiled.pool.New = func() interface{} {
+		return compiled.NewScanner()
+	}
 
-	// index where each pattern will be in the match structure when
-	// evaluated
-	index := 0
+	c := &compiler{
+		CompiledRules:  compiled,
+		tempVars:       make(map[string]int64),
+		ruleStrings:    make(map[string][]string),
+		ruleIndex:      make(map[string]int),
+		patterns:       make([]*Pattern, 0),
+		patternsNocase: make([]*Pattern, 0),
+		dups:           make(map[string]*Pattern),
+		warnings:       warnings,
+		externals:      comp.externals,
+	}
+
+	checker := check.New(imports)
+
+	for name, value := range comp.externals {
+		switch value.(type) {
+		case bool:
+			checker.Define(name, check.Bool)
+		case int64:
+			checker.Define(name, check.Int)
+		case string:
+			checker.Define(name, check.String)
+		}
+	}
+
+	// the rules that did not parse are still known by name, the rules
+	// referring to them get no more errors
+	for _, e := range errs.errors {
+		if _, ok := c.ruleIndex[e.Rule]; e.Rule != "" && !ok {
+			c.rules = append(c.rules, &CompiledRule{name: e.Rule})
+			c.ruleIndex[e.Rule] = len(c.rules) - 1
+			checker.Declare(e.Rule)
+		}
+	}
 
 	for _, rule := range rules {
-		compiledRule := &CompiledRule{
-			instr: make([]Op, 0),
-			tags:  rule.Tags,
-			name:  rule.Name,
+		// a rule failing the checks is not compiled, its condition may
+		// not even make sense
+		if checkErrs := checker.Rule(rule); len(checkErrs) > 0 {
+			for _, err := range checkErrs {
+				errs.add(rule, err)
+			}
+
+			c.rules = append(c.rules, &CompiledRule{name: rule.Name})
+			c.ruleIndex[rule.Name] = len(c.rules) - 1
+			continue
 		}
 
-		// add string patterns to the ahocor pattern list
-		for _, node := range rule.Strings {
-			if assign, ok := node.(*ast.Assignment); ok {
+		if err := c.compileRule(rule); err != nil {
+			errs.add(rule, err)
+			c.ruleIndex[rule.Name] = len(c.rules) - 1
+		}
+	}
 
-				bytePattern, err := assign.BytePattern()
-				if err != nil {
-					return nil, err
-				}
+	comp.warnings = warnings.sorted()
 
-				hash := fmt.Sprintf("%x", sha256.Sum256([]byte(assign.Right.String())))
+	if comp.WarningsAsErrors {
+		errs.errors = append(errs.errors, comp.warnings...)
+	}
 
-				if _, ok := assign.Right.(*ast.String); ok {
-					if bytePattern.Nocase {
-						for i := 0; i < len(bytePattern.Patterns[0]); i++ {
-							bytePattern.Patterns[0][i] = ToLower(bytePattern.Patterns[0][i])
-						}
-					}
+	if len(errs.errors) > 0 {
+		return nil, errs.sorted()
+	}
 
-					temp := &Pattern{
-						Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
-						Pattern:    bytePattern.Patterns[0],
-						MatchIndex: index,
-					}
-					index++
-
-					// check if the pattern is identical to another existing pattern. If
-					// so add a pointer with this patterns name to point to the existing
-					// identical pattern. This prevents duplicate items being added to the
-					// automaton.
-					pattern, ok := dups[hash]
-					if ok {
-						compiled.mappings[temp.Name] = pattern
-					} else {
-						dups[hash] = temp
+	patterns, patternsNocase := c.patterns, c.patternsNocase
 
-						if bytePattern.Nocase {
-							patternsNocase = append(patternsNocase, temp)
-						} else {
-							patterns = append(patterns, temp)
-						}
+	// build the automta
+	if len(patterns) > 0 {
+		compiled.automata = ACBuild(patterns)
+		compiled.automataCount = len(patterns)
+	}
 
-						compiled.mappings[temp.Name] = temp
-					}
+	if len(patternsNocase) > 0 {
+		compiled.automataNocase = ACBuild(patternsNocase)
+		compiled.automataNocaseCount = len(patternsNocase)
+	}
+
+	compiled.patternCount = c.index
+
+	if comp.Profile {
+		compiled.profiler = &profiler{total: newCounters(compiled)}
+	}
+
+	for _, lst := range [][]*Pattern{patterns, patternsNocase} {
+		for _, pattern := range lst {
+			if n := pattern.AtomOffset + len(pattern.Pattern); n > compiled.lookBehind {
+				compiled.lookBehind = n
+			}
+		}
+	}
+
+	return compiled, nil
+}
 
-				} else if _, ok := assign.Right.(*ast.Bytes); ok {
+// compileRule adds the strings of a rule to the patterns and compiles
+// its condition.
+func (c *compiler) compileRule(rule *ast.Rule) error {
+	compiledRule := &CompiledRule{
+		instr: make([]Op, 0),
+		tags:  rule.Tags,
+		name:  rule.Name,
+	}
+
+	compiledRule.meta, compiledRule.metaKeys = ruleMeta(rule)
+
+	if compiledRule.tags == nil {
+		compiledRule.tags = make([]string, 0)
+	}
+
+	// a rule is added even if it fails to compile, the rules after it
+	// can still refer to it without more errors
+	c.rules = append(c.rules, compiledRule)
+	c.ruleHashes = make(map[string]string)
+
+	// add string patterns to the ahocor pattern list
+	for _, node := range rule.Strings {
+		if assign, ok := node.(*ast.Assignment); ok {
 
-					mainPattern := &Pattern{
-						Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
-						Pattern:    bytePattern.Patterns[0],
-						MatchIndex: index,
-						IsPartial:  len(bytePattern.Patterns[0]) != len(bytePattern.PartialPatterns[0]),
-						FullMatch:  bytePattern.PartialPatterns[0],
+			bytePattern, err := assign.BytePattern()
+			if err != nil {
+				return at(assign, err)
+			}
+
+			if _, ok := assign.Right.(*ast.String); ok {
+				if bytePattern.Nocase {
+					for i := 0; i < len(bytePattern.Patterns[0]); i++ {
+						bytePattern.Patterns[0][i] = ToLower(bytePattern.Patterns[0][i])
 					}
-					patterns = append(patterns, mainPattern)
-					compiled.mappings[mainPattern.Name] = mainPattern
-					index++
-
-					for i, pattern := range bytePattern.Patterns {
-						if i == 0 {
-							continue
-						}
-
-						temp := &Pattern{
-							Name:       fmt.Sprintf("%v_%v_%v", rule.Name, assign.Left, i),
-							Pattern:    pattern,
-							MatchIndex: mainPattern.MatchIndex,
-							IsPartial:  len(bytePattern.Patterns[i]) != len(bytePattern.PartialPatterns[i]),
-							FullMatch:  bytePattern.PartialPatterns[i],
-						}
-
-						patterns = append(patterns, temp)
+				}
+			}
+
+			// strings with the same bytes and modifiers, e.g. "foo" and
+			// "foo" ascii, are the same pattern
+			hash := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%T %v %x", assign.Right, bytePattern.Nocase, bytePattern.Patterns))))
+
+			c.warnString(rule, assign, bytePattern, hash)
+
+			if _, ok := assign.Right.(*ast.String); ok {
+
+				temp := &Pattern{
+					Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
+					Pattern:    bytePattern.Patterns[0],
+					MatchIndex: c.index,
+				}
+				c.index++
+
+				// check if the pattern is identical to another existing pattern. If
+				// so add a pointer with this patterns name to point to the existing
+				// identical pattern. This prevents duplicate items being added to the
+				// automaton.
+				pattern, ok := c.dups[hash]
+				if ok {
+					c.mappings[temp.Name] = pattern
+				} else {
+					c.dups[hash] = temp
+
+					if bytePattern.Nocase {
+						c.patternsNocase = append(c.patternsNocase, temp)
+					} else {
+						c.patterns = append(c.patterns, temp)
 					}
 
-				} else if r, ok := assign.Right.(*ast.Regex); ok {
-					re, err := regexp.Compile(r.Value)
-					if err != nil {
-						return nil, err
+					c.mappings[temp.Name] = temp
+				}
+
+			} else if _, ok := assign.Right.(*ast.Bytes); ok {
+
+				mainPattern := &Pattern{
+					Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
+					Pattern:    bytePattern.Patterns[0],
+					MatchIndex: c.index,
+					IsPartial:  len(bytePattern.Patterns[0]) != len(bytePattern.PartialPatterns[0]),
+					FullMatch:  bytePattern.PartialPatterns[0],
+					AtomOffset: bytePattern.Offsets[0],
+				}
+				c.patterns = append(c.patterns, mainPattern)
+				c.mappings[mainPattern.Name] = mainPattern
+				c.index++
+
+				for i, pattern := range bytePattern.Patterns {
+					if i == 0 {
+						continue
 					}
 
 					temp := &Pattern{
-						Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
-						Pattern:    bytePattern.Patterns[0],
-						MatchIndex: index,
-						Re:         re,
+						Name:       fmt.Sprintf("%v_%v_%v", rule.Name, assign.Left, i),
+						Pattern:    pattern,
+						MatchIndex: mainPattern.MatchIndex,
+						IsPartial:  len(bytePattern.Patterns[i]) != len(bytePattern.PartialPatterns[i]),
+						FullMatch:  bytePattern.PartialPatterns[i],
+						AtomOffset: bytePattern.Offsets[i],
 					}
-					index++
 
-					compiled.mappings[temp.Name] = temp
-					patterns = append(patterns, temp)
+					c.patterns = append(c.patterns, temp)
+				}
 
-				} else {
-					return nil, errors.New("compiler: invalid strings type")
+			} else if r, ok := assign.Right.(*ast.Regex); ok {
+				// the prefix is the atom, the regex confirms the match
+				// starting at the atom
+				re, err := regexp.Compile("^(?:" + r.Value + ")")
+				if err != nil {
+					return at(r, err)
 				}
+
+				temp := &Pattern{
+					Name:       fmt.Sprintf("%v_%v", rule.Name, assign.Left),
+					Pattern:    bytePattern.Patterns[0],
+					MatchIndex: c.index,
+					Re:         re,
+				}
+				c.index++
+
+				c.mappings[temp.Name] = temp
+				c.patterns = append(c.patterns, temp)
+
+			} else {
+				return at(assign, errors.New("compiler: invalid strings type"))
 			}
-		}
 
-		compiled.rules = append(compiled.rules, compiledRule)
+			name := fmt.Sprintf("%v_%v", rule.Name, assign.Left)
+			c.ruleStrings[rule.Name] = append(c.ruleStrings[rule.Name], name)
 
-		instr := make([]Op, 0)
-		err := compiled.compileNode(rule.Name, rule.Condition, &instr)
-		if err != nil {
-			return nil, err
+			_, hex := assign.Right.(*ast.Bytes)
+
+			compiledRule.strings = append(compiledRule.strings, &ruleString{
+				name:  assign.Left,
+				index: c.mappings[name].MatchIndex,
+				hex:   hex,
+			})
 		}
+	}
 
-		compiledRule.instr = instr
+	compiledRule.required = c.required(rule.Name, rule.Condition)
 
+	c.warnCondition(rule)
+
+	// nothing is in scope, even after an error in the previous rule
+	c.tempVars = make(map[string]int64)
+	c.slots = 0
+	c.maxSlots = 0
+
+	instr := make([]Op, 0)
+	err := c.compileNode(rule.Name, rule.Condition, &instr)
+	if err != nil {
+		return err
 	}
 
-	// build the automta
-	if len(patterns) > 0 {
-		compiled.automata = ACBuild(patterns)
-		compiled.automataCount = len(patterns)
+	// the instructions as compiled are kept for Debug
+	compiledRule.raw = instr
+	compiledRule.instr = optimize(instr)
+
+	// the stack of each scanner holds the deepest rule
+	compiledRule.depth, err = stackDepth(compiledRule.instr)
+	if err != nil {
+		return at(rule, err)
 	}
 
-	if len(patternsNocase) > 0 {
-		compiled.automataNocase = ACBuild(patternsNocase)
-		compiled.automataNocaseCount = len(patternsNocase)
+	compiledRule.slots = c.maxSlots
+
+	c.warnConstant(rule, compiledRule)
+
+	if compiledRule.slots+compiledRule.depth > c.maxDepth {
+		c.maxDepth = compiledRule.slots + compiledRule.depth
 	}
 
-	compiled.patternCount = index
+	c.ruleIndex[rule.Name] = len(c.rules) - 1
 
-	return compiled, nil
+	return nil
+}
+
+// normalizeMatches sorts the matches of each pattern by offset and
+// removes duplicates. Alternatives of a hex string can confirm the same
+// offset more than once, and matches are not found in the order of
+// their starting offsets when atoms are in the middle of a string or a
+// match waits on more input.
+func normalizeMatches(matches []*[]Match) {
+	for _, lst := range matches {
+		if lst == nil || len(*lst) < 2 {
+			continue
+		}
+
+		offsets := *lst
+		sort.SliceStable(offsets, func(i, j int) bool {
+			return offsets[i].Offset < offsets[j].Offset
+		})
+
+		n := 1
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i].Offset != offsets[n-1].Offset {
+				offsets[n] = offsets[i]
+				n++
+			}
+		}
+
+		*lst = offsets[:n]
+	}
 }
 
 func ToLower(b byte) byte {
@@ -297,26 +592,20 @@ func ToLower(b byte) byte {
 	return b
 }
 
-func (c *CompiledRules) patternsInRule(ruleName string) []string {
-	patterns := make([]string, 0)
-
-	for key := range c.mappings {
-		if strings.HasPrefix(key, ruleName) {
-			patterns = append(patterns, key)
-		}
-	}
-
-	return patterns
+// patternsInRule returns the mapping names of the strings declared in
+// a rule, in the order they are declared.
+func (c *compiler) patternsInRule(ruleName string) []string {
+	return c.ruleStrings[ruleName]
 }
 
-func (c *CompiledRules) setToStringSlice(ruleName string, set *ast.Set) []string {
+func (c *compiler) setToStringSlice(ruleName string, set *ast.Set) []string {
 
 	out := make([]string, 0)
 
 	for _, node := range set.Nodes {
 		if v, ok := node.(*ast.Variable); ok {
 			if strings.HasSuffix(v.Value, "*") {
-				temp := strings.TrimSuffix(v.Value, "*")
+				temp := fmt.Sprintf("%v_%v", ruleName, strings.TrimSuffix(v.Value, "*"))
 				for _, name := range c.patternsInRule(ruleName) {
 					if strings.HasPrefix(name, temp) {
 						out = append(out, name)
@@ -331,11 +620,154 @@ func (c *CompiledRules) setToStringSlice(ruleName string, set *ast.Set) []string
 	return out
 }
 
+// setLoads returns the instruction loading each item of the set of an
+// 'of' expression, the count of a string or the result of a rule.
+func (c *compiler) setLoads(ruleName string, set ast.Node) ([]Op, error) {
+
+	// a set of a single item, e.g. ($a*), parses as a group
+	if prefix, ok := set.(*ast.Prefix); ok && prefix.Token.Type == lexer.LPAREN {
+		set = prefix.Right
+	}
+
+	var nodes []ast.Node
+
+	switch right := set.(type) {
+	case *ast.Keyword:
+		if right.Token.Type != lexer.THEM {
+			return nil, errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown set '%v'", right))
+		}
+		nodes = []ast.Node{&ast.Variable{Value: "$*"}}
+	case *ast.Set:
+		nodes = right.Nodes
+	case *ast.Variable, *ast.Identity:
+		nodes = []ast.Node{right}
+	default:
+		return nil, errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown set '%v'", right))
+	}
+
+	loads := make([]Op, 0)
+
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *ast.Variable:
+			for _, name := range c.setToStringSlice(ruleName, &ast.Set{Nodes: []ast.Node{n}}) {
+				p, ok := c.mappings[name]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown variable"))
+				}
+
+				loads = append(loads, Op{OpCode: LOADCOUNT, IntParam: int64(p.MatchIndex)})
+			}
+
+		case *ast.Identity:
+			// rules in the set must be declared before this rule
+			prefix := strings.TrimSuffix(n.Value, "*")
+			found := false
+
+			for i, rule := range c.rules {
+				index, ok := c.ruleIndex[rule.name]
+				if !ok || index != i {
+					continue
+				}
+
+				if rule.name == n.Value || (prefix != n.Value && strings.HasPrefix(rule.name, prefix)) {
+					loads = append(loads, Op{OpCode: LOADSTATIC, IntParam: int64(i + staticRules)})
+					found = true
+				}
+			}
+
+			if !found {
+				return nil, errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown rule '%v'", n.Value))
+			}
+
+		default:
+			return nil, errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown set item '%v'", n))
+		}
+	}
+
+	return loads, nil
+}
+
+// compileOf builds the instructions of an 'of' expression. If where is
+// set, each string of the set must match in the range or at the offset
+// it gives, e.g. 'any of them in (0..100)' or 'all of them at 0'.
+func (c *compiler) compileOf(ruleName string, of *ast.Infix, where *ast.Infix, instructions *[]Op) error {
+
+	loads, err := c.setLoads(ruleName, of.Right)
+	if err != nil {
+		return err
+	}
+
+	for _, load := range loads {
+		if where == nil {
+			*instructions = append(*instructions, load)
+			continue
+		}
+
+		if load.OpCode != LOADCOUNT {
+			return errors.New(fmt.Sprintf("compiler: invalid OF operation, rules can not be used with '%v'", where.Token.Raw))
+		}
+
+		if err := c.compileNode(ruleName, where.Right, instructions); err != nil {
+			return err
+		}
+
+		if where.Token.Type == lexer.IN {
+			*instructions = append(*instructions, Op{OpCode: IN, IntParam: load.IntParam})
+		} else {
+			*instructions = append(*instructions, Op{OpCode: AT, IntParam: load.IntParam})
+		}
+	}
+
+	// the set size sits on top of the items
+	size := int64(len(loads))
+	*instructions = append(*instructions, Op{OpCode: PUSH, IntParam: size})
+
+	var n int64
+
+	switch left := of.Left.(type) {
+	case *ast.Integer:
+		n = left.Value
+	case *ast.Percentage:
+		percent, ok := left.Value.(*ast.Integer)
+		if !ok || percent.Value < 1 || percent.Value > 100 {
+			return errors.New(fmt.Sprintf("compiler: invalid OF operation, percentage must be an integer between 1 and 100"))
+		}
+
+		// the number of items needed, rounded up
+		n = (percent.Value*size + 99) / 100
+	case *ast.Keyword:
+		switch left.Token.Type {
+		case lexer.ALL:
+			n = size
+		case lexer.ANY:
+			n = 1
+		case lexer.NONE:
+			n = 0
+		default:
+			return errors.New(fmt.Sprintf("compiler: invalid OF operation, left value must be a integer, 'all', or 'any'"))
+		}
+	default:
+		return errors.New(fmt.Sprintf("compiler: invalid OF operation, left value must be a integer"))
+	}
+
+	*instructions = append(*instructions, Op{OpCode: OF, IntParam: n})
+
+	return nil
+}
+
 // compileNode is the function responsible for building the
 // instruction sequence for evaluation.
 // in general, I am unhappy with this function, super messy, but the
 // operation are simple and the code isn't that long so...
-func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions *[]Op) error {
+func (c *compiler) compileNode(ruleName string, node ast.Node, instructions *[]Op) (err error) {
+
+	// the innermost node with a position is the one reported
+	defer func() {
+		if err != nil {
+			err = at(node, err)
+		}
+	}()
 
 	push := func(op int) {
 		*instructions = append(*instructions, Op{OpCode: op})
@@ -349,12 +781,45 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 		// some infix operations do not require pushing the left value
 		// as a single instruction. Intercept here and process accordingly.
 		switch infix.Token.Type {
+		case lexer.AND, lexer.OR:
+			// short circuit, the right side is skipped if the left side
+			// decides the result
+			if err := c.compileNode(ruleName, infix.Left, instructions); err != nil {
+				return err
+			}
+
+			jump := len(*instructions)
+			if infix.Token.Type == lexer.AND {
+				push1(JFALSE, 0)
+			} else {
+				push1(JTRUE, 0)
+			}
+
+			if err := c.compileNode(ruleName, infix.Right, instructions); err != nil {
+				return err
+			}
+
+			push(BOOL)
+			(*instructions)[jump].IntParam = int64(len(*instructions))
+
+			return nil
+
 		case lexer.IN:
-			c.compileNode(ruleName, infix.Right, instructions)
+			// 'any of them in (0..100)'
+			if of, ok := infix.Left.(*ast.Infix); ok && of.Token.Type == lexer.OF {
+				return c.compileOf(ruleName, of, infix, instructions)
+			}
+
+			if err := c.compileNode(ruleName, infix.Right, instructions); err != nil {
+				return err
+			}
 			if variable, ok := infix.Left.(*ast.Variable); ok {
 				name := fmt.Sprintf("%v_%v", ruleName, variable.Value)
 
-				if p, ok := c.mappings[name]; ok {
+				if variable.Value == "$" {
+					// the string of the enclosing loop
+					push1(IN, c.tempVar)
+				} else if p, ok := c.mappings[name]; ok {
 					push1(IN, int64(p.MatchIndex))
 				} else {
 					return errors.New(fmt.Sprintf("compiler: invalid IN operation, unknown variable"))
@@ -366,44 +831,63 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 			return nil
 
 		case lexer.OF:
-			if keyword, ok := infix.Right.(*ast.Keyword); ok && keyword.Token.Type == lexer.THEM {
-				names := c.patternsInRule(ruleName)
-				for _, name := range names {
-					if p, ok := c.mappings[name]; ok {
-						push1(LOADCOUNT, int64(p.MatchIndex))
-					} else {
-						return errors.New(fmt.Sprintf("compiler: invalid OF operation, unknown variable"))
-					}
-				}
-			} else {
-				c.compileNode(ruleName, infix.Right, instructions)
+			return c.compileOf(ruleName, infix, nil, instructions)
+
+		case lexer.EQUAL, lexer.NOTEQUAL, lexer.LT, lexer.LTE, lexer.GT, lexer.GTE,
+			lexer.CONTAINS, lexer.ICONTAINS, lexer.STARTSWITH, lexer.ISTARTSWITH,
+			lexer.ENDSWITH, lexer.IENDSWITH, lexer.IEQUALS, lexer.MATCHES:
+			// the strings are literals or external variables, the
+			// comparison is known once compiled
+			result, ok, err := c.compareStrings(infix)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				push1(PUSH, boolInt(result))
+				return nil
 			}
 
-			if integer, ok := infix.Left.(*ast.Integer); ok {
-				push1(OF, integer.Value)
-			} else if keyword, ok := infix.Left.(*ast.Keyword); ok {
-				switch keyword.Token.Type {
-				case lexer.ALL:
-					push1(OF, int64(len(c.patternsInRule(ruleName))))
-				case lexer.ANY:
-					push1(OF, 1)
-				case lexer.NONE:
-					push1(OF, 0)
-				default:
-					return errors.New(fmt.Sprintf("compiler: invalid OF operation, left value must be a integer, 'all', or 'any'"))
+		case lexer.AT:
+			// 'all of them at 0'
+			if of, ok := infix.Left.(*ast.Infix); ok && of.Token.Type == lexer.OF {
+				return c.compileOf(ruleName, of, infix, instructions)
+			}
+
+			// only the offset is pushed, the variable is the parameter
+			if err := c.compileNode(ruleName, infix.Right, instructions); err != nil {
+				return err
+			}
+
+			if variable, ok := infix.Left.(*ast.Variable); ok {
+				name := fmt.Sprintf("%v_%v", ruleName, variable.Value)
+
+				if variable.Value == "$" {
+					// the string of the enclosing loop
+					push1(AT, c.tempVar)
+				} else if p, ok := c.mappings[name]; ok {
+					push1(AT, int64(p.MatchIndex))
+				} else {
+					return errors.New(fmt.Sprintf("compiler: invalid AT, unknown variable"))
 				}
 			} else {
-				return errors.New(fmt.Sprintf("compiler: invalid OF operation, left value must be a integer"))
+				return errors.New(fmt.Sprintf("compiler: invalid AT operation, left value must be a variable"))
 			}
 
 			return nil
 
 		case lexer.LBRACKET:
 			if v, ok := infix.Left.(*ast.Variable); ok {
-				c.compileNode(ruleName, infix.Right, instructions)
+				if err := c.compileNode(ruleName, infix.Right, instructions); err != nil {
+					return err
+				}
+
 				name := fmt.Sprintf("%v_%v", ruleName, strings.Replace(v.Value, "@", "$", 1))
 
-				if p, ok := c.mappings[name]; ok {
+				if v.Value == "@" {
+					// the string of the enclosing loop
+					push1(LOADOFFSET, c.tempVar)
+				} else if p, ok := c.mappings[name]; ok {
 					push1(LOADOFFSET, int64(p.MatchIndex))
 				} else {
 					return errors.New(fmt.Sprintf("compiler: invalid variable index, unknown variable"))
@@ -418,8 +902,13 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 		}
 
 		// recurse the left and right branches and push those instructions onto the sequence.
-		c.compileNode(ruleName, infix.Left, instructions)
-		c.compileNode(ruleName, infix.Right, instructions)
+		if err := c.compileNode(ruleName, infix.Left, instructions); err != nil {
+			return err
+		}
+
+		if err := c.compileNode(ruleName, infix.Right, instructions); err != nil {
+			return err
+		}
 
 		// handle the infix operation now that the left and right values are processed.
 		switch infix.Token.Type {
@@ -427,10 +916,22 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 			push(ADD)
 		case lexer.MINUS:
 			push(MINUS)
-		case lexer.AND:
-			push(AND)
-		case lexer.OR:
-			push(OR)
+		case lexer.ASTERISK:
+			push(MUL)
+		case lexer.DIVIDE:
+			push(DIV)
+		case lexer.MOD:
+			push(MOD)
+		case lexer.AMPERSAND:
+			push(BAND)
+		case lexer.PIPE:
+			push(BOR)
+		case lexer.CARET:
+			push(BXOR)
+		case lexer.SHIFTLEFT:
+			push(SHIFTLEFT)
+		case lexer.SHIFTRIGHT:
+			push(SHIFTRIGHT)
 		case lexer.GT:
 			push(GT)
 		case lexer.GTE:
@@ -445,22 +946,8 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 			push(NOTEQUAL)
 		case lexer.RANGE:
 			// NOP for now, the two values should be pushed on the stack
-		case lexer.AT:
-			if variable, ok := infix.Left.(*ast.Variable); ok {
-				name := fmt.Sprintf("%v_%v", ruleName, variable.Value)
-
-				if p, ok := c.mappings[name]; ok {
-					push1(AT, int64(p.MatchIndex))
-				} else {
-					return errors.New(fmt.Sprintf("compiler: invalid AT, unknown variable"))
-				}
-
-			} else {
-				return errors.New(fmt.Sprintf("compiler: invalid AT operation, left value must be a variable"))
-			}
-
 		default:
-			return errors.New(fmt.Sprintf("compiler: invalid or unsupported infix operation: %v", infix.Type()))
+			return errors.New(fmt.Sprintf("compiler: invalid or unsupported infix operation '%v'", infix.Token.Raw))
 		}
 
 		return nil
@@ -468,22 +955,33 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 
 	if set, ok := node.(*ast.Set); ok {
 		for _, node := range set.Nodes {
-			c.compileNode(ruleName, node, instructions)
+			if err := c.compileNode(ruleName, node, instructions); err != nil {
+				return err
+			}
 		}
 
 		// finally push the number of nodes pushed onto the stack
 		push1(PUSH, int64(len(set.Nodes)))
+		return nil
 	}
 
 	if prefix, ok := node.(*ast.Prefix); ok {
-		c.compileNode(ruleName, prefix.Right, instructions)
+		if err := c.compileNode(ruleName, prefix.Right, instructions); err != nil {
+			return err
+		}
 
 		switch prefix.Token.Type {
+		case lexer.LPAREN:
+			// grouping only, the inner expression is already pushed
 		case lexer.MINUS:
 			push(MINUSU)
+		case lexer.NOT:
+			push(NOT)
 		default:
-			return errors.New(fmt.Sprintf("compiler: invalid prefix operation: %v", prefix.Type()))
+			return errors.New(fmt.Sprintf("compiler: invalid prefix operation '%v'", prefix.Token.Raw))
 		}
+
+		return nil
 	}
 
 	if v, ok := node.(*ast.Variable); ok {
@@ -516,8 +1014,9 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 
 		} else if strings.HasPrefix(v.Value, "@") {
 			if len(v.Value) > 1 {
+				// @a is the offset of the first match, @a[1]
 				name := fmt.Sprintf("%v_%v", ruleName, strings.Replace(v.Value, "@", "$", 1))
-				push1(PUSH, 0)
+				push1(PUSH, 1)
 
 				if p, ok := c.mappings[name]; ok {
 					push1(LOADOFFSET, int64(p.MatchIndex))
@@ -525,7 +1024,7 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 					return errors.New(fmt.Sprintf("compiler: unknown variable"))
 				}
 			} else {
-				push1(PUSH, 0)
+				push1(PUSH, 1)
 				push1(LOADOFFSET, c.tempVar)
 			}
 		} else {
@@ -538,7 +1037,6 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 					return errors.New(fmt.Sprintf("compiler: unknown variable"))
 				}
 			} else {
-				push1(PUSH, 0)
 				push1(LOADCOUNT, c.tempVar)
 			}
 		}
@@ -549,119 +1047,164 @@ func (c *CompiledRules) compileNode(ruleName string, node ast.Node, instructions
 	if keyword, ok := node.(*ast.Keyword); ok {
 		switch keyword.Token.Type {
 		case lexer.FILESIZE:
-			push1(LOADSTATIC, 0)
+			push1(LOADSTATIC, staticFilesize)
+			return nil
+		case lexer.ENTRYPOINT:
+			c.entryPoint = true
+			push1(LOADSTATIC, staticEntryPoint)
+			return nil
+		case lexer.INT8, lexer.INT16, lexer.INT32, lexer.INT8BE, lexer.INT16BE, lexer.INT32BE,
+			lexer.UINT8, lexer.UINT16, lexer.UINT32, lexer.UINT8BE, lexer.UINT16BE, lexer.UINT32BE:
+			if keyword.Attribute == nil {
+				return errors.New(fmt.Sprintf("compiler: %v expects an offset", keyword.Value))
+			}
+
+			if err := c.compileNode(ruleName, keyword.Attribute, instructions); err != nil {
+				return err
+			}
+
+			push1(LOADINT, int64(keyword.Token.Type))
+			return nil
 		default:
 			return errors.New(fmt.Sprintf("compiler: invalid keyword: %v", keyword.Value))
 		}
 	}
 
+	if b, ok := node.(*ast.Bool); ok {
+		if b.Value {
+			push1(PUSH, 1)
+		} else {
+			push1(PUSH, 0)
+		}
+
+		return nil
+	}
+
 	if n, ok := node.(*ast.Integer); ok {
 		push1(PUSH, n.Value)
 		return nil
 	}
 
+	if str, ok := node.(*ast.String); ok {
+		push1(PUSH, boolInt(str.Value != ""))
+		return nil
+	}
+
 	if ident, ok := node.(*ast.Identity); ok {
 		if n, ok := c.tempVars[ident.Value]; ok {
 			push1(PUSHR, n)
+		} else if n, ok := c.ruleIndex[ident.Value]; ok {
+			// the result of a rule declared earlier
+			push1(LOADSTATIC, int64(n+staticRules))
+		} else if value, ok := c.externals[ident.Value]; ok {
+			switch v := value.(type) {
+			case bool:
+				push1(PUSH, boolInt(v))
+			case int64:
+				push1(PUSH, v)
+			case string:
+				// like yara, a string is true if it is not empty
+				push1(PUSH, boolInt(v != ""))
+			default:
+				return errors.New(fmt.Sprintf("compiler: unsupported type of variable '%v'", ident.Value))
+			}
 		} else {
-			return errors.New("compiler: invalid variable to create instruction")
+			return errors.New(fmt.Sprintf("compiler: unknown identifier '%v'", ident.Value))
 		}
+
+		return nil
 	}
 
 	if loop, ok := node.(*ast.For); ok {
-		push(CLEAR)
-
-		// for _ loop.Var in (X..Y) : _
-		if infix, ok := loop.StringSet.(*ast.Infix); ok && infix.Token.Type == lexer.RANGE && loop.Var != "" {
-			// set loop.Var
-			c.compileNode(ruleName, infix.Left, instructions)
-			push1(MOVR, REG1)
-
-			// save a total size for the ALL matching posibility
-			c.compileNode(ruleName, infix.Left, instructions)
-			push1(MOVR, REG3)
-			c.tempVars[loop.Var] = REG1
-
-			// get the accumulator counter, loop checks this register
-			c.compileNode(ruleName, infix.Right, instructions)
-			c.compileNode(ruleName, infix.Left, instructions)
-			push(MINUS)
-			push1(MOVR, RC)
-
-			startAddress := int64(len(*instructions))
-
-			// do body
-			c.compileNode(ruleName, loop.Body, instructions)
-
-			// handle the loop
-			push1(INCR, REG1)
-			push1(ADDR, REG2)
-			push1(LOOP, startAddress)
-			push1(PUSHR, REG2)
-
-		} else if set, ok := loop.StringSet.(*ast.Set); ok {
-			names := c.setToStringSlice(ruleName, set)
-
-			push1(PUSH, int64(len(names)))
-			push1(MOVR, REG3)
-
-			for _, name := range names {
-				if p, ok := c.mappings[name]; ok {
-					c.tempVar = int64(p.MatchIndex)
-				} else {
-					return errors.New(fmt.Sprintf("compiler: unknown variable in loop"))
-				}
-
-				c.compileNode(ruleName, loop.Body, instructions)
-				push1(ADDR, REG2)
-
-			}
-
-			push1(PUSHR, REG2)
+		return c.compileFor(ruleName, loop, instructions)
+	}
 
-		} else if keyword, ok := loop.StringSet.(*ast.Keyword); ok && keyword.Token.Type == lexer.THEM {
+	if with, ok := node.(*ast.With); ok {
+		return c.compileWith(ruleName, with, instructions)
+	}
 
-			push1(PUSH, int64(len(c.patternsInRule(ruleName))))
-			push1(MOVR, REG3)
+	return errors.New(fmt.Sprintf("compiler: unable to compile: '%v'", node))
+}
 
-			for _, name := range c.patternsInRule(ruleName) {
+// constString returns the value of a string literal or of a string
+// external variable.
+func (c *compiler) constString(node ast.Node) (string, bool) {
+	switch n := node.(type) {
+	case *ast.String:
+		return n.Value, true
+	case *ast.Identity:
+		if _, ok := c.tempVars[n.Value]; ok {
+			return "", false
+		}
 
-				if p, ok := c.mappings[name]; ok {
-					c.tempVar = int64(p.MatchIndex)
-				} else {
-					return errors.New(fmt.Sprintf("compiler: unknown variable in loop"))
-				}
+		v, ok := c.externals[n.Value].(string)
+		return v, ok
+	case *ast.Prefix:
+		if n.Token.Type == lexer.LPAREN {
+			return c.constString(n.Right)
+		}
+	}
 
-				c.compileNode(ruleName, loop.Body, instructions)
-				push1(ADDR, REG2)
-			}
+	return "", false
+}
 
-			push1(PUSHR, REG2)
+// compareStrings returns the result of comparing two strings, the
+// second return value is false if the operands are not strings. Every
+// string of a condition is a literal or an external variable, so the
+// result is known once compiled.
+func (c *compiler) compareStrings(infix *ast.Infix) (bool, bool, error) {
+	left, ok := c.constString(infix.Left)
+	if !ok {
+		return false, false, nil
+	}
 
-		} else {
-			return errors.New("compiler: loop structure not implemented")
+	if infix.Token.Type == lexer.MATCHES {
+		r, ok := infix.Right.(*ast.Regex)
+		if !ok {
+			return false, false, nil
 		}
 
-		// now wrap up and finish the condition
-		if loop.Expr.Type == lexer.INTEGER {
-			if n, err := strconv.ParseInt(loop.Expr.Raw, 10, 64); err == nil {
-				push1(PUSH, n)
-				push(EQUAL)
-			} else {
-				return err
-			}
-		} else if loop.Expr.Type == lexer.ALL {
-			push1(PUSHR, REG3)
-			push(EQUAL)
-		} else if loop.Expr.Type == lexer.ANY {
-			push1(PUSH, 1)
-			push(GTE)
-		} else {
-			return errors.New(fmt.Sprintf("compiler: invalid loop expression: '%v'", loop.Expr))
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return false, false, at(r, err)
 		}
 
-		return nil
+		return re.MatchString(left), true, nil
 	}
 
-	return errors.New(fmt.Sprintf("compiler: unable to compile: '%v'", node))
+	right, ok := c.constString(infix.Right)
+	if !ok {
+		return false, false, nil
+	}
+
+	switch infix.Token.Type {
+	case lexer.EQUAL:
+		return left == right, true, nil
+	case lexer.NOTEQUAL:
+		return left != right, true, nil
+	case lexer.LT:
+		return left < right, true, nil
+	case lexer.LTE:
+		return left <= right, true, nil
+	case lexer.GT:
+		return left > right, true, nil
+	case lexer.GTE:
+		return left >= right, true, nil
+	case lexer.CONTAINS:
+		return strings.Contains(left, right), true, nil
+	case lexer.ICONTAINS:
+		return strings.Contains(strings.ToLower(left), strings.ToLower(right)), true, nil
+	case lexer.STARTSWITH:
+		return strings.HasPrefix(left, right), true, nil
+	case lexer.ISTARTSWITH:
+		return strings.HasPrefix(strings.ToLower(left), strings.ToLower(right)), true, nil
+	case lexer.ENDSWITH:
+		return strings.HasSuffix(left, right), true, nil
+	case lexer.IENDSWITH:
+		return strings.HasSuffix(strings.ToLower(left), strings.ToLower(right)), true, nil
+	case lexer.IEQUALS:
+		return strings.EqualFold(left, right), true, nil
+	}
+
+	return false, false, nil
 }
@@ -0,0 +1,188 @@
+package exec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// The static values every condition can read, the result of each rule
+// follows them in the order the rules are declared.
+const (
+	staticFilesize = iota
+	staticEntryPoint
+	staticRules
+)
+
+// entryPoint returns the file offset of the entry point of a PE or ELF
+// input, the same offset libyara computes for the 'entrypoint'
+// keyword. It is undefined for any other input, or if the headers are
+// truncated or the entry point is not backed by the file.
+func entryPoint(data io.ReaderAt, filesize int64) value {
+	if data == nil {
+		return undefined
+	}
+
+	var magic [4]byte
+	if _, err := data.ReadAt(magic[:], 0); err != nil {
+		return undefined
+	}
+
+	var offset int64
+	var ok bool
+
+	switch {
+	case magic[0] == 'M' && magic[1] == 'Z':
+		offset, ok = peEntryPoint(data)
+	case magic == [4]byte{0x7f, 'E', 'L', 'F'}:
+		offset, ok = elfEntryPoint(data)
+	}
+
+	if !ok || offset < 0 || offset >= filesize {
+		return undefined
+	}
+
+	return value{n: offset}
+}
+
+// header reads fixed sized fields at an offset of the input.
+type header struct {
+	data  io.ReaderAt
+	order binary.ByteOrder
+	buf   [8]byte
+	err   error
+}
+
+func (h *header) read(offset int64, size int) uint64 {
+	if h.err != nil {
+		return 0
+	}
+
+	if _, h.err = h.data.ReadAt(h.buf[:size], offset); h.err != nil {
+		return 0
+	}
+
+	switch size {
+	case 2:
+		return uint64(h.order.Uint16(h.buf[:]))
+	case 4:
+		return uint64(h.order.Uint32(h.buf[:]))
+	default:
+		return h.order.Uint64(h.buf[:])
+	}
+}
+
+func peEntryPoint(data io.ReaderAt) (int64, bool) {
+	h := &header{data: data, order: binary.LittleEndian}
+
+	nt := int64(h.read(0x3c, 4))
+	if h.read(nt, 4) != 0x00004550 {
+		return 0, false
+	}
+
+	sections := int(h.read(nt+6, 2))
+	optionalSize := int64(h.read(nt+20, 2))
+	rva := h.read(nt+40, 4)
+	table := nt + 24 + optionalSize
+
+	if h.err != nil {
+		return 0, false
+	}
+
+	// an entry point within the headers is not mapped by a section
+	lowest := uint64(1<<64 - 1)
+
+	for i := 0; i < sections && i < 96; i++ {
+		section := table + int64(i)*40
+		virtualSize := h.read(section+8, 4)
+		virtualAddress := h.read(section+12, 4)
+		rawSize := h.read(section+16, 4)
+		rawOffset := h.read(section+20, 4)
+
+		if h.err != nil {
+			return 0, false
+		}
+
+		if virtualAddress < lowest {
+			lowest = virtualAddress
+		}
+
+		size := virtualSize
+		if size == 0 || rawSize < size {
+			size = rawSize
+		}
+
+		if rva >= virtualAddress && rva < virtualAddress+size {
+			return int64(rawOffset + rva - virtualAddress), true
+		}
+	}
+
+	if rva < lowest {
+		return int64(rva), true
+	}
+
+	return 0, false
+}
+
+func elfEntryPoint(data io.ReaderAt) (int64, bool) {
+	var ident [6]byte
+	if _, err := data.ReadAt(ident[:], 0); err != nil {
+		return 0, false
+	}
+
+	h := &header{data: data, order: binary.LittleEndian}
+	if ident[5] == 2 {
+		h.order = binary.BigEndian
+	}
+
+	// the offsets of the fields differ between 32 and 64 bit files
+	var entry, phoff, phentsize, phnum uint64
+
+	switch ident[4] {
+	case 1:
+		entry = h.read(0x18, 4)
+		phoff = h.read(0x1c, 4)
+		phentsize = h.read(0x2a, 2)
+		phnum = h.read(0x2c, 2)
+	case 2:
+		entry = h.read(0x18, 8)
+		phoff = h.read(0x20, 8)
+		phentsize = h.read(0x36, 2)
+		phnum = h.read(0x38, 2)
+	default:
+		return 0, false
+	}
+
+	if h.err != nil {
+		return 0, false
+	}
+
+	// the segment loaded at the entry point maps it to the file
+	for i := uint64(0); i < phnum; i++ {
+		ph := int64(phoff + i*phentsize)
+
+		var kind, offset, vaddr, filesz uint64
+
+		if ident[4] == 1 {
+			kind = h.read(ph, 4)
+			offset = h.read(ph+4, 4)
+			vaddr = h.read(ph+8, 4)
+			filesz = h.read(ph+16, 4)
+		} else {
+			kind = h.read(ph, 4)
+			offset = h.read(ph+8, 8)
+			vaddr = h.read(ph+16, 8)
+			filesz = h.read(ph+32, 8)
+		}
+
+		if h.err != nil {
+			return 0, false
+		}
+
+		// PT_LOAD
+		if kind == 1 && entry >= vaddr && entry < vaddr+filesz {
+			return int64(offset + entry - vaddr), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,188 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+	"github.com/kgwinnup/go-yara/internal/parser"
+)
+
+// CompileError is an error in the rules, a syntax error or a rule that
+// does not compile.
+type CompileError struct {
+	// the path of the rules, empty when compiled from a string
+	File string
+	// the position of the error, rows and columns start at 1
+	Row int
+	Col int
+	// the rule the error is in, empty outside of a rule
+	Rule    string
+	Message string
+	// the line of the error followed by a caret under its column
+	Snippet string
+}
+
+func (e *CompileError) Error() string {
+	var builder strings.Builder
+
+	if e.File != "" {
+		builder.WriteString(e.File)
+		builder.WriteRune(':')
+	}
+
+	fmt.Fprintf(&builder, "%v:%v: ", e.Row, e.Col)
+
+	if e.Rule != "" {
+		fmt.Fprintf(&builder, "rule %v: ", e.Rule)
+	}
+
+	builder.WriteString(e.Message)
+
+	return builder.String()
+}
+
+// CompileErrors holds every error found compiling the rules, ordered by
+// their position.
+type CompileErrors []*CompileError
+
+func (e CompileErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// As lets errors.As find the first error of the list matching target,
+// e.g. a *CompileError. It is used rather than an Unwrap returning the
+// errors, which errors.As only follows from go 1.20.
+func (e CompileErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Is lets errors.Is find any error of the list.
+func (e CompileErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// at gives err the position of node, unless it already has one. The
+// position is the one of the innermost node an error goes through.
+func at(node ast.Node, err error) error {
+	var lerr *lexer.Error
+	if errors.As(err, &lerr) {
+		return err
+	}
+
+	tok := ast.TokenOf(node)
+	if tok == nil {
+		return err
+	}
+
+	return &lexer.Error{Row: tok.Row, Col: tok.Col, Message: strings.TrimPrefix(err.Error(), "compiler: ")}
+}
+
+// errorList collects the errors of an input.
+type errorList struct {
+	file   string
+	input  string
+	lines  []string
+	errors CompileErrors
+}
+
+func (l *errorList) addSyntax(err error) {
+	var errs parser.Errors
+	if !errors.As(err, &errs) {
+		l.errors = append(l.errors, &CompileError{File: l.file, Message: err.Error()})
+		return
+	}
+
+	for _, e := range errs {
+		l.errors = append(l.errors, l.newError(e.Row, e.Col, e.Rule, e.Message))
+	}
+}
+
+// add records the error of a rule, at the start of the rule if the
+// error has no position.
+func (l *errorList) add(rule *ast.Rule, err error) {
+	var lerr *lexer.Error
+	if errors.As(err, &lerr) {
+		l.errors = append(l.errors, l.newError(lerr.Row, lerr.Col, rule.Name, lerr.Message))
+		return
+	}
+
+	row, col := 0, 0
+	if rule.Token != nil {
+		row, col = rule.Token.Row, rule.Token.Col
+	}
+
+	l.errors = append(l.errors, l.newError(row, col, rule.Name, strings.TrimPrefix(err.Error(), "compiler: ")))
+}
+
+func (l *errorList) newError(row, col int, rule string, msg string) *CompileError {
+	return &CompileError{
+		File:    l.file,
+		Row:     row,
+		Col:     col,
+		Rule:    rule,
+		Message: msg,
+		Snippet: l.snippet(row, col),
+	}
+}
+
+// snippet returns the line at row and a caret under col. Tabs before
+// the column are kept so the caret lines up with the line.
+func (l *errorList) snippet(row, col int) string {
+	if l.lines == nil {
+		l.lines = strings.Split(l.input, "\n")
+	}
+
+	if row < 1 || row > len(l.lines) {
+		return ""
+	}
+
+	line := strings.TrimRight(l.lines[row-1], "\r")
+	runes := []rune(line)
+
+	var caret strings.Builder
+	for i := 0; i < col-1 && i < len(runes); i++ {
+		if runes[i] == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+
+	return line + "\n" + caret.String()
+}
+
+// sorted returns the errors by position, syntax errors are found before
+// the compile errors of the rules that did parse.
+func (l *errorList) sorted() CompileErrors {
+	sort.SliceStable(l.errors, func(i, j int) bool {
+		if l.errors[i].Row != l.errors[j].Row {
+			return l.errors[i].Row < l.errors[j].Row
+		}
+
+		return l.errors[i].Col < l.errors[j].Col
+	})
+
+	return l.errors
+}
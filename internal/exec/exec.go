@@ -1,8 +1,13 @@
 package exec
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"time"
+
+	"github.com/kgwinnup/go-yara/internal/lexer"
 )
 
 const (
@@ -32,15 +37,27 @@ const (
 	MOVR
 	ADDR
 	INCR
-	DECR
 	PUSHR
-	LOOP
-	CLEAR
+	JMP
+	JZ
+	LOADINT
+	JFALSE
+	JTRUE
+	BOOL
+	MUL
+	COUNTGT
+	LOADOFFSETI
+	NOT
+	DIV
+	MOD
 )
 
 type Op struct {
 	OpCode   int
 	IntParam int64
+	// second parameter of the fused instructions built by the
+	// optimizer
+	IntParam2 int64
 }
 
 func (o Op) String() string {
@@ -97,318 +114,500 @@ func (o Op) String() string {
 		return fmt.Sprintf("ADDR %v", o.IntParam)
 	case INCR:
 		return fmt.Sprintf("INCR %v", o.IntParam)
-	case DECR:
-		return fmt.Sprintf("DECR %v", o.IntParam)
 	case PUSHR:
 		return fmt.Sprintf("PUSHR %v", o.IntParam)
-	case LOOP:
-		return fmt.Sprintf("LOOP %v", o.IntParam)
-	case CLEAR:
-		return fmt.Sprintf("CLEAR")
+	case JMP:
+		return fmt.Sprintf("JMP %v", o.IntParam)
+	case JZ:
+		return fmt.Sprintf("JZ %v", o.IntParam)
+	case LOADINT:
+		return fmt.Sprintf("LOADINT %v", intReads[int(o.IntParam)].name)
+	case JFALSE:
+		return fmt.Sprintf("JFALSE %v", o.IntParam)
+	case JTRUE:
+		return fmt.Sprintf("JTRUE %v", o.IntParam)
+	case BOOL:
+		return "BOOL"
+	case MUL:
+		return "MUL"
+	case COUNTGT:
+		return fmt.Sprintf("COUNTGT %v %v", o.IntParam, o.IntParam2)
+	case LOADOFFSETI:
+		return fmt.Sprintf("LOADOFFSETI %v %v", o.IntParam, o.IntParam2)
+	case NOT:
+		return "NOT"
+	case DIV:
+		return "DIV"
+	case MOD:
+		return "MOD"
 	default:
 		return "WAT"
 	}
 }
 
-const (
-	RC = iota
-	REG1
-	REG2
-	REG3
-)
-
-func Eval(rule *CompiledRule, matches []*[]int, static []int64) (int64, error) {
+// intRead describes how the integer functions, e.g. uint32be(0), read
+// from the input. The LOADINT parameter is the token type of the
+// function.
+type intRead struct {
+	name      string
+	size      int
+	signed    bool
+	bigEndian bool
+}
 
-	index := 0
-	var ret int64
-	stack := make([]int64, 0)
-	var right int64
-	var left int64
+var intReads = map[int]intRead{
+	lexer.INT8:     {"int8", 1, true, false},
+	lexer.INT16:    {"int16", 2, true, false},
+	lexer.INT32:    {"int32", 4, true, false},
+	lexer.INT8BE:   {"int8be", 1, true, true},
+	lexer.INT16BE:  {"int16be", 2, true, true},
+	lexer.INT32BE:  {"int32be", 4, true, true},
+	lexer.UINT8:    {"uint8", 1, false, false},
+	lexer.UINT16:   {"uint16", 2, false, false},
+	lexer.UINT32:   {"uint32", 4, false, false},
+	lexer.UINT8BE:  {"uint8be", 1, false, true},
+	lexer.UINT16BE: {"uint16be", 2, false, true},
+	lexer.UINT32BE: {"uint32be", 4, false, true},
+}
 
-	pop := func() int64 {
-		ret, stack = stack[0], stack[1:]
-		return ret
+// readInt reads an integer from the input at offset. The second return
+// value is false if the input could not be read.
+func readInt(data io.ReaderAt, offset int64, kind intRead) (int64, bool) {
+	if data == nil || offset < 0 {
+		return 0, false
 	}
 
-	push := func(i int64) {
-		stack = append([]int64{i}, stack...)
+	var buf [4]byte
+	if _, err := data.ReadAt(buf[:kind.size], offset); err != nil {
+		return 0, false
 	}
 
-	regs := []int64{0, 0, 0, 0}
-
-	for {
+	var order binary.ByteOrder = binary.LittleEndian
+	if kind.bigEndian {
+		order = binary.BigEndian
+	}
 
-		if index >= len(rule.instr) {
-			break
+	switch kind.size {
+	case 1:
+		if kind.signed {
+			return int64(int8(buf[0])), true
 		}
+		return int64(buf[0]), true
+	case 2:
+		n := order.Uint16(buf[:2])
+		if kind.signed {
+			return int64(int16(n)), true
+		}
+		return int64(n), true
+	default:
+		n := order.Uint32(buf[:4])
+		if kind.signed {
+			return int64(int32(n)), true
+		}
+		return int64(n), true
+	}
+}
 
-		cur := rule.instr[index]
-
-		switch cur.OpCode {
-		case MOVR:
-			left = pop()
-			regs[cur.IntParam] = left
-
-		case ADDR:
-			left = pop()
-			regs[cur.IntParam] += left
-
-		case INCR:
-			regs[cur.IntParam]++
-
-		case DECR:
-			regs[cur.IntParam]--
+// boolInt converts a comparison to the 0 or 1 pushed on the stack.
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
 
-		case PUSHR:
-			push(regs[cur.IntParam])
+	return 0
+}
 
-		case LOOP:
-			if regs[RC] > 0 {
-				index = int(cur.IntParam) - 1
-				regs[RC]--
+// stackDepth returns the deepest the stack grows while running the
+// instructions. Each instruction has a fixed effect on the stack, except
+// OF which pops the set size pushed right before it. Loops and jumps do
+// not change the depth: a loop body leaves the stack as it found it, so
+// the stack is the same at the top of the loop and where it exits, and
+// a short circuit jump lands where the skipped instructions would have
+// left a single value.
+func stackDepth(instr []Op) (int, error) {
+
+	depth := 0
+	max := 0
+
+	for i, op := range instr {
+		pop, push := 0, 0
+
+		switch op.OpCode {
+		case LOADCOUNT, LOADSTATIC, PUSH, PUSHR, COUNTGT, LOADOFFSETI:
+			push = 1
+		case LOADOFFSET, LOADINT, AT, MINUSU, BOOL, NOT:
+			pop, push = 1, 1
+		case MOVR, ADDR, JFALSE, JTRUE, JZ:
+			pop = 1
+		case IN:
+			pop, push = 2, 1
+		case OF:
+			if i == 0 || instr[i-1].OpCode != PUSH {
+				return 0, errors.New("compiler: OF is not preceded by its set size")
 			}
+			pop, push = int(instr[i-1].IntParam)+1, 1
+		case INCR, JMP:
+		default:
+			// the remaining operators are binary
+			pop, push = 2, 1
+		}
 
-		case CLEAR:
-			regs[0] = 0
-			regs[1] = 0
-			regs[2] = 0
-			regs[3] = 0
+		if depth < pop {
+			return 0, errors.New(fmt.Sprintf("compiler: stack underflow at instruction %v: %v", i, op))
+		}
 
-		case LOADCOUNT:
-			if lst := matches[cur.IntParam]; lst != nil {
-				push(int64(len(*lst)))
-			} else {
-				push(0)
-			}
+		depth += push - pop
+		if depth > max {
+			max = depth
+		}
+	}
 
-		case LOADOFFSET:
-			index := pop()
+	if depth != 1 {
+		return 0, errors.New(fmt.Sprintf("compiler: condition leaves %v values on the stack", depth))
+	}
 
-			if lst := matches[cur.IntParam]; lst != nil {
-				if int(index) < len(*lst) {
-					push(int64((*lst)[index]))
-				} else {
-					push(0)
-				}
-			} else {
-				push(0)
-			}
+	return max, nil
+}
 
-		case LOADSTATIC:
-			if int(cur.IntParam) < len(static) {
-				push(static[int(cur.IntParam)])
-			} else {
-				push(0)
-			}
+// value is an entry of the stack. Like in YARA, a value can be
+// undefined, e.g. the offset of a match that does not exist, a read past
+// the end of the input or a division by zero. Undefined propagates
+// through arithmetic, comparisons and 'not', and is false as a boolean.
+// 'and' and 'or' always give a defined result.
+type value struct {
+	n         int64
+	undefined bool
+}
 
-		case PUSH:
-			push(cur.IntParam)
+var undefined = value{undefined: true}
 
-		case BAND:
-			right = pop()
-			left = pop()
+// truthy returns whether v is true as a boolean, like in YARA any
+// defined value other than zero, negative values included.
+func truthy(v value) bool {
+	return !v.undefined && v.n != 0
+}
 
-			ret := right & left
-			push(ret)
+// Eval runs the instructions of a rule. Integer functions like
+// uint32(0) read from data, which can be nil if the input is not
+// available for random access. An undefined result is false. static
+// holds the filesize and the entry point followed by the result of each
+// rule evaluated so far, in the order the rules are declared.
+//
+// The stack is preallocated by the caller and must hold at least
+// rule.slots+rule.depth values, it is allocated here otherwise. The
+// first rule.slots values are the frame holding the loop variables and
+// counters, the values above them are the operands. The operands grow
+// from index rule.slots, sp is the index of the next free slot.
+func Eval(rule *CompiledRule, stack []value, matches []*[]Match, static []value, data io.ReaderAt) (int64, error) {
+	out, _, err := eval(rule, stack, matches, static, data, time.Time{})
+	return out, err
+}
 
-		case BOR:
-			right = pop()
-			left = pop()
+// deadlineCheck is the number of loop iterations between two checks of
+// the scan deadline.
+const deadlineCheck = 1 << 16
 
-			ret := right | left
-			push(ret)
+// eval is Eval also returning the number of instructions run, for the
+// profiler. A loop still running past the deadline, unless it is zero,
+// stops with ErrTimeout.
+func eval(rule *CompiledRule, stack []value, matches []*[]Match, static []value, data io.ReaderAt, deadline time.Time) (int64, int64, error) {
 
-		case BXOR:
-			right = pop()
-			left = pop()
+	if len(stack) < rule.slots+rule.depth {
+		stack = make([]value, rule.slots+rule.depth)
+	}
 
-			ret := right ^ left
-			push(ret)
+	sp := rule.slots
+	instr := rule.instr
+	executed := int64(0)
+	jumps := 0
 
-		case AND:
-			right = pop()
-			left = pop()
+	for index := 0; index < len(instr); index++ {
 
-			if left > 0 && right > 0 {
-				push(1)
-			} else {
-				push(0)
-			}
+		cur := &instr[index]
+		executed++
 
-		case OR:
-			right = pop()
-			left = pop()
+		switch cur.OpCode {
+		case MOVR:
+			sp--
+			stack[cur.IntParam] = stack[sp]
 
-			if left > 0 || right > 0 {
-				push(1)
-			} else {
-				push(0)
+		case ADDR:
+			// the loops count the iterations where the body is true
+			sp--
+			if truthy(stack[sp]) {
+				stack[cur.IntParam].n++
 			}
 
-		case EQUAL:
-			right = pop()
-			left = pop()
+		case INCR:
+			stack[cur.IntParam].n++
 
-			if left == right {
-				push(1)
-			} else {
-				push(0)
+		case PUSHR:
+			stack[sp] = stack[cur.IntParam]
+			sp++
+
+		case JMP:
+			// the only backward jump, the end of a loop iteration. A
+			// range can run for up to 2^63 iterations, check the
+			// deadline every so often
+			jumps++
+			if jumps%deadlineCheck == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+				return 0, executed, ErrTimeout
 			}
 
-		case NOTEQUAL:
-			right = pop()
-			left = pop()
+			index = int(cur.IntParam) - 1
 
-			if left != right {
-				push(1)
-			} else {
-				push(0)
+		case JZ:
+			sp--
+			if !truthy(stack[sp]) {
+				index = int(cur.IntParam) - 1
 			}
 
-		case ADD:
-			right = pop()
-			left = pop()
-
-			ret := left + right
-			push(ret)
-
-		case MINUS:
-			right = pop()
-			left = pop()
-
-			ret := left - right
-			push(ret)
+		case LOADCOUNT:
+			stack[sp] = value{n: matchCount(matches, cur.IntParam)}
+			sp++
 
-		case MINUSU:
-			right = pop()
+		case LOADOFFSET:
+			stack[sp-1] = matchOffset(matches, cur.IntParam, stack[sp-1])
 
-			ret := -right
-			push(ret)
+		case LOADOFFSETI:
+			stack[sp] = matchOffset(matches, cur.IntParam, value{n: cur.IntParam2})
+			sp++
 
-		case GT:
-			right = pop()
-			left = pop()
+		case COUNTGT:
+			stack[sp] = value{n: boolInt(matchCount(matches, cur.IntParam) > cur.IntParam2)}
+			sp++
 
-			if left > right {
-				push(1)
+		case LOADSTATIC:
+			if int(cur.IntParam) < len(static) {
+				stack[sp] = static[int(cur.IntParam)]
 			} else {
-				push(0)
+				stack[sp] = undefined
 			}
+			sp++
 
-		case GTE:
-			right = pop()
-			left = pop()
+		case PUSH:
+			stack[sp] = value{n: cur.IntParam}
+			sp++
 
-			if left >= right {
-				push(1)
+		case JFALSE:
+			// short circuit AND, a false left side is the result
+			if !truthy(stack[sp-1]) {
+				stack[sp-1] = value{}
+				index = int(cur.IntParam) - 1
 			} else {
-				push(0)
+				sp--
 			}
 
-		case LT:
-			right = pop()
-			left = pop()
-
-			if left < right {
-				push(1)
+		case JTRUE:
+			// short circuit OR, a true left side is the result
+			if truthy(stack[sp-1]) {
+				stack[sp-1] = value{n: 1}
+				index = int(cur.IntParam) - 1
 			} else {
-				push(0)
+				sp--
 			}
 
-		case LTE:
-			right = pop()
-			left = pop()
+		case BOOL:
+			stack[sp-1] = value{n: boolInt(truthy(stack[sp-1]))}
 
-			if left <= right {
-				push(1)
-			} else {
-				push(0)
+		case NOT:
+			// not undefined is still undefined, so false
+			if !stack[sp-1].undefined {
+				stack[sp-1].n = boolInt(stack[sp-1].n == 0)
 			}
 
-		case SHIFTLEFT:
-			right = pop()
-			left = pop()
-
-			ret := left << right
-			push(ret)
+		case LOADINT:
+			v := stack[sp-1]
+			if v.undefined {
+				break
+			}
 
-		case SHIFTRIGHT:
-			right = pop()
-			left = pop()
+			if n, ok := readInt(data, v.n, intReads[int(cur.IntParam)]); ok {
+				stack[sp-1] = value{n: n}
+			} else {
+				stack[sp-1] = undefined
+			}
 
-			ret := left >> right
-			push(ret)
+		case MINUSU:
+			stack[sp-1].n = -stack[sp-1].n
 
 		case AT:
-			right = pop()
+			v := stack[sp-1]
+			if v.undefined {
+				break
+			}
+
+			result := int64(0)
 
 			if lst := matches[cur.IntParam]; lst != nil {
-				result := 0
-				for _, index := range *lst {
-					if index == int(right) {
+				for _, match := range *lst {
+					if match.Offset == int(v.n) {
 						result = 1
+						break
 					}
 				}
+			}
 
-				push(int64(result))
+			stack[sp-1] = value{n: result}
 
-			} else {
-				push(0)
+		case IN:
+			// low and high value of the range
+			low, high := stack[sp-2], stack[sp-1]
+			sp--
+
+			if low.undefined || high.undefined {
+				stack[sp-1] = undefined
+				break
 			}
 
-		case IN:
-			// high value in range
-			right = pop()
-			// low value in range
-			left = pop()
+			result := int64(0)
 
 			if lst := matches[cur.IntParam]; lst != nil {
-				result := 0
-				for _, index := range *lst {
-					if index > int(left) && index < int(right) {
+				for _, match := range *lst {
+					if match.Offset >= int(low.n) && match.Offset <= int(high.n) {
 						result++
 					}
 				}
-
-				push(int64(result))
-
-			} else {
-				push(0)
 			}
 
-		case OF:
-			set := make([]int64, 0)
-			setSize := pop()
+			stack[sp-1] = value{n: result}
 
-			for i := 0; i < int(setSize); i++ {
-				set = append(set, pop())
-			}
+		case OF:
+			// the set size is on top of the values in the set
+			size := int(stack[sp-1].n)
+			set := stack[sp-1-size : sp-1]
+			sp -= size
 
 			count := 0
-			for _, n := range set {
-				if n > 0 {
+			for _, v := range set {
+				if truthy(v) {
 					count++
 				}
 
-				if count >= int(cur.IntParam) {
+				if cur.IntParam > 0 && count >= int(cur.IntParam) {
 					break
 				}
 			}
 
 			if cur.IntParam > 0 && count >= int(cur.IntParam) {
-				push(1)
+				stack[sp-1] = value{n: 1}
 			} else if cur.IntParam == 0 && count == 0 { // none of ($*)
-				push(1)
+				stack[sp-1] = value{n: 1}
 			} else {
-				push(0)
+				stack[sp-1] = value{}
 			}
 
+		case AND:
+			sp--
+			stack[sp-1] = value{n: boolInt(truthy(stack[sp-1]) && truthy(stack[sp]))}
+
+		case OR:
+			sp--
+			stack[sp-1] = value{n: boolInt(truthy(stack[sp-1]) || truthy(stack[sp]))}
+
 		default:
-			return -1, errors.New(fmt.Sprintf("exec: invalid instruction '%v'\n", cur.OpCode))
+			// binary operators, the result replaces the left value
+			sp--
+			left, right := stack[sp-1], stack[sp]
+
+			n, ok, err := arith(cur.OpCode, left.n, right.n)
+			if err != nil {
+				return -1, executed, err
+			}
+
+			switch {
+			case left.undefined || right.undefined, !ok:
+				stack[sp-1] = undefined
+			default:
+				stack[sp-1] = value{n: n}
+			}
+		}
+	}
+
+	if sp == rule.slots || stack[sp-1].undefined {
+		return 0, executed, nil
+	}
+
+	return stack[sp-1].n, executed, nil
+}
+
+func matchCount(matches []*[]Match, index int64) int64 {
+	if lst := matches[index]; lst != nil {
+		return int64(len(*lst))
+	}
+
+	return 0
+}
+
+// matchOffset returns the offset of the i'th match, undefined if there
+// is no such match. Like yara the first match is @a[1], @a[0] is
+// undefined.
+func matchOffset(matches []*[]Match, index int64, i value) value {
+	lst := matches[index]
+
+	if i.undefined || lst == nil || i.n < 1 || i.n > int64(len(*lst)) {
+		return undefined
+	}
+
+	return value{n: int64((*lst)[i.n-1].Offset)}
+}
+
+// arith computes a binary operator over defined values. The second
+// return value is false if the result is undefined, e.g. a division by
+// zero.
+func arith(op int, left, right int64) (int64, bool, error) {
+	switch op {
+	case ADD:
+		return left + right, true, nil
+	case MINUS:
+		return left - right, true, nil
+	case MUL:
+		return left * right, true, nil
+	case DIV:
+		if right == 0 {
+			return 0, false, nil
+		}
+		return left / right, true, nil
+	case MOD:
+		if right == 0 {
+			return 0, false, nil
+		}
+		return left % right, true, nil
+	case BAND:
+		return left & right, true, nil
+	case BOR:
+		return left | right, true, nil
+	case BXOR:
+		return left ^ right, true, nil
+	case SHIFTLEFT, SHIFTRIGHT:
+		// a negative count is undefined, a count of 64 or more shifts
+		// every bit out, like libyara
+		if right < 0 {
+			return 0, false, nil
+		}
+
+		if right >= 64 {
+			return 0, true, nil
 		}
 
-		index++
+		if op == SHIFTLEFT {
+			return left << right, true, nil
+		}
+
+		return left >> right, true, nil
+	case EQUAL:
+		return boolInt(left == right), true, nil
+	case NOTEQUAL:
+		return boolInt(left != right), true, nil
+	case GT:
+		return boolInt(left > right), true, nil
+	case GTE:
+		return boolInt(left >= right), true, nil
+	case LT:
+		return boolInt(left < right), true, nil
+	case LTE:
+		return boolInt(left <= right), true, nil
 	}
 
-	return stack[0], nil
+	return 0, false, errors.New(fmt.Sprintf("exec: invalid instruction '%v'\n", op))
 }
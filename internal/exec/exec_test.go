@@ -1,7 +1,20 @@
 package exec
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	_ "embed"
 )
@@ -212,7 +225,7 @@ func TestForRange(t *testing.T) {
         $b = "dummy2"
 
     condition:
-        for any i in (0..3) : ( @a[i] + 10 == @b[i] )
+        for any i in (1..3) : ( @a[i] + 10 == @b[i] )
 }`
 
 	input := "dummy1    dummy2"
@@ -341,3 +354,1946 @@ func TestRegex(t *testing.T) {
 		t.Fatal("failed to match regex")
 	}
 }
+
+func TestRuleBytesLeadingWildcard(t *testing.T) {
+
+	rule := `rule Foobar {
+    strings:
+        $s1 = { ?? ?? 8B 45 F8 }
+    condition:
+        #s1 == 1 and $s1 at 1
+}
+`
+	out, _ := testCompile(rule, "\x00\x01\x02\x8b\x45\xf8")
+	if len(out) == 0 {
+		t.Fatal("leading wildcard pattern failed to match")
+	}
+
+	out, _ = testCompile(rule, "\x8b\x45\xf8")
+	if len(out) != 0 {
+		t.Fatal("pattern must not match before the start of the input")
+	}
+}
+
+func TestRuleBytesMiddleAtom(t *testing.T) {
+
+	rule := `rule Foobar {
+    strings:
+        $s1 = { 00 00 ?? 41 42 43 44 ?? 45 }
+    condition:
+        #s1 == 1 and $s1 at 2
+}
+`
+	out, _ := testCompile(rule, "\x00\x00\x00\x00\xffABCD\x01E\x00\x00")
+	if len(out) == 0 {
+		t.Fatal("pattern failed to match")
+	}
+
+	out, _ = testCompile(rule, "\x00\x01\x00\x00\xffABCD\x01F")
+	if len(out) != 0 {
+		t.Fatal("pattern must verify bytes on both sides of the atom")
+	}
+}
+
+// the automaton holds the best atom of a hex string, not the first one
+func TestAtomChoice(t *testing.T) {
+	tests := []struct {
+		pattern string
+		offset  int
+		atom    []byte
+	}{
+		{"{ 00 00 00 00 41 42 43 44 }", 4, []byte("ABCD")},
+		{"{ 41 42 ?? 00 00 00 00 43 44 45 46 }", 7, []byte("CDEF")},
+		{"{ 8B 45 F8 ?? ?? CC CC CC CC }", 0, []byte{0x8b, 0x45, 0xf8}},
+	}
+
+	for _, test := range tests {
+		compiled, err := Compile(`rule A { strings: $a = ` + test.pattern + ` condition: $a }`)
+		if err != nil {
+			t.Fatalf("%v: %v", test.pattern, err)
+		}
+
+		outputs := make([]*ACOutput, 0)
+		for _, node := range compiled.automata {
+			outputs = append(outputs, node.outputs...)
+		}
+
+		if len(outputs) != 1 {
+			t.Fatalf("%v: expecting one output, got %v", test.pattern, len(outputs))
+		}
+
+		output := outputs[0]
+		atom := make([]byte, 0)
+		for _, b := range output.fullMatch[output.atomOffset : output.atomOffset+output.length] {
+			atom = append(atom, byte(b))
+		}
+
+		if output.atomOffset != test.offset || !reflect.DeepEqual(atom, test.atom) {
+			t.Fatalf("%v: expecting atom %x at %v, got %x at %v", test.pattern, test.atom, test.offset, atom, output.atomOffset)
+		}
+	}
+}
+
+func TestRuleBytesNoAtom(t *testing.T) {
+
+	rule := `rule Foobar {
+    strings:
+        $s1 = { ?? ?? }
+    condition:
+        #s1 == 3
+}
+`
+	out, _ := testCompile(rule, "abcd")
+	if len(out) == 0 {
+		t.Fatal("wildcard only pattern failed to match")
+	}
+}
+
+func TestRuleBytesAlternativesOnce(t *testing.T) {
+
+	rule := `rule Foobar {
+    strings:
+        $s1 = { 41 41 41 [1-2] 42 }
+    condition:
+        #s1 == 1
+}
+`
+	out, _ := testCompile(rule, "AAABBB")
+	if len(out) == 0 {
+		t.Fatal("expecting a single match for overlapping alternatives")
+	}
+}
+
+func TestIntegerFunctions(t *testing.T) {
+	rule := `rule Foobar {
+    condition:
+        uint16(0) == 0x5a4d and uint32be(2) == 0x01020304 and int8(6) == -1
+}`
+
+	out, err := testCompile(rule, "MZ\x01\x02\x03\x04\xff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) == 0 {
+		t.Fatal("integer functions failed to match")
+	}
+}
+
+func TestScanReaderChunks(t *testing.T) {
+	rule := `
+rule Strings {
+    strings:
+        $a = "foobar"
+        $b = "FooBaz" nocase
+    condition:
+        #a == 3 and #b == 2
+}
+
+rule Bytes {
+    strings:
+        $a = { 00 00 ?? 41 42 43 44 ?? 45 }
+        $b = { 41 41 41 [1-5] ( 42 | 43 ) }
+    condition:
+        $a and $b
+}
+
+rule Regex {
+    strings:
+        $a = /(foobar|foobaz)[0-9]{1,4}/
+    condition:
+        $a
+}
+
+rule Integers {
+    condition:
+        uint32be(0) == 0x66303066
+}
+`
+
+	input := "f00foobar1234 xx foobaz\x00\x00\x00ABCD\x01E AAADDB foobar FOOBAZ foobar"
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := compiled.Scan([]byte(input), true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expected) != 4 {
+		t.Fatalf("expecting 4 rules to match, got %v", len(expected))
+	}
+
+	for _, size := range []int{1, 2, 3, 7, 16, 1024} {
+		data := strings.NewReader(input)
+		out, err := compiled.scanReader(io.MultiReader(strings.NewReader(input)), data, size, true, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expected, out) {
+			t.Fatalf("chunk size %v does not match the in-memory scan", size)
+		}
+	}
+}
+
+// a Scanner does not hold on to the input once a scan returns, and
+// keeps the buffer of a streaming scan for the next one, whatever the
+// chunk size
+func TestScannerBuffers(t *testing.T) {
+	compiled, err := Compile(`rule A { strings: $a = "foobar" condition: $a }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := compiled.NewScanner()
+
+	if _, err := scanner.Scan([]byte("xxfoobarxx"), false, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if scanner.stream.window != nil {
+		t.Fatal("expecting the window to be released")
+	}
+
+	for _, size := range []int{16, ChunkSize, 4 * ChunkSize} {
+		if err := scanner.scanReader(strings.NewReader("xxfoobarxx"), nil, size, false, 3, collect(new([]*ScanOutput))); err != nil {
+			t.Fatal(err)
+		}
+
+		if scanner.stream.window != nil || cap(scanner.stream.buf) < size {
+			t.Fatalf("chunk size %v: expecting the buffer to be kept, got a capacity of %v", size, cap(scanner.stream.buf))
+		}
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	rule := `rule Foobar {
+    strings:
+        $a = "foobar"
+    condition:
+        $a at 4 and uint8(0) == 0x41
+}`
+
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, []byte("AAAAfoobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := compiled.ScanFile(path, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) == 0 {
+		t.Fatal("failed to match file")
+	}
+}
+
+func TestScanOutputJSON(t *testing.T) {
+	rule := `rule Foobar : tag1 {
+    meta:
+        author = "me"
+        score = -2
+        active = true
+    strings:
+        $a = { 41 41 }
+        $b = "foobar"
+    condition:
+        $a and $b
+}
+
+rule Untagged { condition: filesize > 100 }`
+
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, []byte("AAAAfoobar\x01"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := compiled.ScanFile(path, true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 1 {
+		t.Fatalf("expecting 1 match, got %v", len(out))
+	}
+
+	data, err := json.Marshal(out[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"path":"` + path + `","rule":"Foobar","namespace":"default","tags":["tag1"],` +
+		`"meta":{"active":true,"author":"me","score":-2},"strings":[` +
+		`{"identifier":"$a","offset":0,"length":2,"data":"41 41"},` +
+		`{"identifier":"$a","offset":1,"length":2,"data":"41 41"},` +
+		`{"identifier":"$a","offset":2,"length":2,"data":"41 41"},` +
+		`{"identifier":"$b","offset":4,"length":6,"data":"foobar"}],"errors":[]}`
+
+	if string(data) != expected {
+		t.Fatalf("expecting\n%v\ngot\n%v", expected, string(data))
+	}
+
+	data, err = json.Marshal(&ScanOutput{Path: path, Errors: []string{"failed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"path":"` + path + `","rule":"","namespace":"","tags":[],"meta":{},"strings":[],"errors":["failed"]}`
+	if string(data) != expected {
+		t.Fatalf("expecting\n%v\ngot\n%v", expected, string(data))
+	}
+
+	match := StringMatch{Data: []byte("a\x00\\\"")}
+	if match.DataString() != `a\x00\\\"` {
+		t.Fatalf("unexpected data %v", match.DataString())
+	}
+}
+
+func TestConcurrentScan(t *testing.T) {
+	rule := `
+rule Foobar {
+    strings:
+        $a = "foobar"
+        $b = { 00 00 ?? 41 42 43 44 }
+    condition:
+        #a == 2 and $b
+}
+
+rule Foobaz {
+    strings:
+        $a = "foobaz" nocase
+    condition:
+        $a
+}
+`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []string{
+		"foobar \x00\x00\x00ABCD foobar",
+		"FOOBAZ",
+		"nothing to see here",
+	}
+
+	expected := make([][]*ScanOutput, len(inputs))
+	for i, input := range inputs {
+		expected[i], err = compiled.Scan([]byte(input), true, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			// half the goroutines use their own scanner, the rest
+			// share the pool of the compiled rules
+			scanner := compiled.NewScanner()
+
+			for i := 0; i < 200; i++ {
+				k := (i + n) % len(inputs)
+
+				var out []*ScanOutput
+				var err error
+
+				if n%2 == 0 {
+					out, err = scanner.Scan([]byte(inputs[k]), true, 3)
+				} else {
+					out, err = compiled.Scan([]byte(inputs[k]), true, 3)
+				}
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !reflect.DeepEqual(expected[k], out) {
+					errs <- fmt.Errorf("unexpected output for input %v", k)
+					return
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestScanWithCallback(t *testing.T) {
+	rule := `
+import "pe"
+
+rule First {
+    strings:
+        $a = "foobar"
+    condition:
+        $a
+}
+
+rule Second {
+    strings:
+        $a = "foobaz"
+    condition:
+        $a
+}
+
+rule Third {
+    strings:
+        $a = "foobar"
+    condition:
+        $a
+}
+`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]string, 0)
+	err = compiled.ScanWithCallback([]byte("foobar"), false, 3, func(event Event) Action {
+		switch event.Type {
+		case ModuleImported:
+			events = append(events, event.Type.String()+" "+event.Module)
+		case ScanFinished:
+			events = append(events, event.Type.String())
+		default:
+			events = append(events, event.Type.String()+" "+event.Rule.Name)
+		}
+
+		return Continue
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"ModuleImported pe",
+		"RuleMatching First",
+		"RuleNotMatching Second",
+		"RuleMatching Third",
+		"ScanFinished",
+	}
+
+	if !reflect.DeepEqual(expected, events) {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// abort on the first match
+	events = events[:0]
+	err = compiled.ScanWithCallback([]byte("foobar"), false, 3, func(event Event) Action {
+		events = append(events, event.Type.String())
+
+		if event.Type == RuleMatching {
+			return Abort
+		}
+
+		return Continue
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[1] != "RuleMatching" {
+		t.Fatalf("expecting the scan to stop at the first match, got %v", events)
+	}
+}
+
+// testRule returns a rule with the condition and the strings of decls
+// the condition refers to, by name, by a wildcard or by them. An
+// unreferenced string is an error, the strings shared by the conditions
+// of a table are only declared for the conditions using them.
+func testRule(name string, condition string, decls ...string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "rule %v {\n", name)
+
+	declared := false
+	for _, decl := range decls {
+		if !refersTo(condition, strings.Fields(decl)[0][1:]) {
+			continue
+		}
+
+		if !declared {
+			b.WriteString("    strings:\n")
+			declared = true
+		}
+
+		fmt.Fprintf(&b, "        %v\n", decl)
+	}
+
+	fmt.Fprintf(&b, "    condition:\n        %v\n}", condition)
+	return b.String()
+}
+
+var stringRefs = regexp.MustCompile(`[$#@!](\w*)(\*?)`)
+
+// refersTo reports whether the condition refers to the string with the
+// identifier id, without its $.
+func refersTo(condition string, id string) bool {
+	if strings.Contains(condition, "them") {
+		return true
+	}
+
+	for _, ref := range stringRefs.FindAllStringSubmatch(condition, -1) {
+		if ref[1] == id || (ref[2] == "*" && strings.HasPrefix(id, ref[1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestShortCircuit(t *testing.T) {
+	rule := `
+rule And {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        $a and #b
+}
+
+rule Or {
+    strings:
+        $a = "foo"
+        $b = "baz"
+    condition:
+        $b or #a
+}
+
+rule Bool {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        ($a and #b) == true and ($b or $a) != false
+}
+
+rule Skipped {
+    strings:
+        $a = "baz"
+        $b = "bar"
+    condition:
+        $a and #b
+}
+`
+
+	out, err := testCompile(rule, "foo bar bar foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, o := range out {
+		names = append(names, o.Name)
+	}
+
+	if !reflect.DeepEqual([]string{"And", "Or", "Bool"}, names) {
+		t.Fatalf("unexpected matching rules %v", names)
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	rule := `
+rule Single {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        $a and #b > 1
+}
+
+rule Either {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        $a or $b at 0
+}
+
+rule Any {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        any of them
+}
+
+rule Always {
+    strings:
+        $a = "foo"
+    condition:
+        $a or filesize > 0
+}
+
+rule None {
+    strings:
+        $a = "foo"
+    condition:
+        #a == 0
+}
+`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"Single": 1,
+		"Either": 2,
+		"Any":    2,
+		"Always": 0,
+		"None":   0,
+	}
+
+	for _, r := range compiled.rules {
+		if len(r.required) != expected[r.name] {
+			t.Fatalf("rule %v requires %v strings, expecting %v", r.name, r.required, expected[r.name])
+		}
+	}
+
+	out, err := compiled.Scan([]byte("nothing to see"), false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 2 || out[0].Name != "Always" || out[1].Name != "None" {
+		t.Fatalf("unexpected matching rules %v", out)
+	}
+}
+
+// manyRules builds count rules with distinct strings, only the first
+// rule matches the benchmark input.
+func manyRules(count int) string {
+	var builder strings.Builder
+
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&builder, `
+rule Rule%v {
+    strings:
+        $a = "str%05d"
+        $b = { 62 %02x ?? 6e }
+    condition:
+        $a and #b > 1 and uint32(0) != 0
+}
+`, i, i, i%256)
+	}
+
+	return builder.String()
+}
+
+func BenchmarkPrefilter(b *testing.B) {
+	compiled, err := Compile(manyRules(10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := []byte(strings.Repeat("some input str00000 b\x00xn b\x00yn ", 100))
+
+	scanner := compiled.NewScanner()
+	if _, err := scanner.Scan(input, false, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	matches := scanner.stream.matches
+	data := strings.NewReader(string(input))
+
+	b.Run("prefilter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, rule := range compiled.rules {
+				if rule.prefiltered(matches) {
+					continue
+				}
+
+				if _, err := Eval(rule, scanner.stack, matches, scanner.static, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("eval", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, rule := range compiled.rules {
+				if _, err := Eval(rule, scanner.stack, matches, scanner.static, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkShortCircuit(b *testing.B) {
+	compiled, err := Compile(`
+rule Foobar {
+    strings:
+        $a = "foobar"
+    condition:
+        filesize > 100 and ($a or uint32(0) == 1 or uint32(4) == 2 or uint32(8) == 3 or uint32(12) == 4)
+}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := []byte("not quite 100 bytes")
+	data := strings.NewReader(string(input))
+	matches := make([]*[]Match, compiled.patternCount)
+	static := []value{{n: int64(len(input))}, undefined}
+	stack := make([]value, compiled.maxDepth)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Eval(compiled.rules[0], stack, matches, static, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOfThem(t *testing.T) {
+	rule := `
+rule Them {
+    strings:
+        $a1 = "dummy1"
+        $a2 = "dummy2"
+        $b = "foobar"
+    condition:
+        2 of them and all of ($a*) and 1 of ($a1, $b) and 1 of ($b)
+}
+`
+
+	out, err := testCompile(rule, "dummy1 dummy2 foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) == 0 {
+		t.Fatal("OF them failed to match")
+	}
+
+	out, err = testCompile(rule, "dummy1 dummy2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 0 {
+		t.Fatal("OF them matched without $b")
+	}
+}
+
+func TestStackDepth(t *testing.T) {
+	compiled, err := Compile(`
+rule Depth {
+    strings:
+        $a = "foo"
+        $b = "bar"
+        $c = "baz"
+    condition:
+        (filesize > 3) == (any of ($a, $b, $c)) and $b at 0
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the set of three counts and its size are on top of the comparison
+	if compiled.rules[0].depth != 5 {
+		t.Fatalf("expecting a depth of 5, got %v", compiled.rules[0].depth)
+	}
+
+	if _, err := stackDepth([]Op{{OpCode: PUSH, IntParam: 1}, {OpCode: AND}}); err == nil {
+		t.Fatal("expecting a stack underflow")
+	}
+
+	if _, err := stackDepth([]Op{{OpCode: PUSH, IntParam: 1}, {OpCode: PUSH, IntParam: 1}}); err == nil {
+		t.Fatal("expecting an unbalanced stack")
+	}
+}
+
+func BenchmarkEvalForLoop(b *testing.B) {
+	compiled, err := Compile(`
+rule Loop {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        for all i in (1..1000) : ( @a[i] + 3 == @b[i] )
+}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := []byte(strings.Repeat("foobar", 1000))
+	scanner := compiled.NewScanner()
+
+	out, err := scanner.Scan(input, false, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if len(out) != 1 {
+		b.Fatal("loop rule failed to match")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Eval(compiled.rules[0], scanner.stack, scanner.stream.matches, scanner.static, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvalOf(b *testing.B) {
+	var builder strings.Builder
+
+	builder.WriteString("rule Sets {\n    strings:\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&builder, "        $s%v = \"str%03d\"\n", i, i)
+	}
+
+	// every set checks its own strings, none short circuit
+	builder.WriteString("    condition:\n        ")
+	for i := 0; i < 100; i += 4 {
+		if i > 0 {
+			builder.WriteString(" and ")
+		}
+		fmt.Fprintf(&builder, "2 of ($s%v, $s%v, $s%v, $s%v)", i, i+1, i+2, i+3)
+	}
+	builder.WriteString(" and all of them\n}")
+
+	compiled, err := Compile(builder.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "str%03d ", i)
+	}
+
+	scanner := compiled.NewScanner()
+
+	out, err := scanner.Scan([]byte(input.String()), false, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if len(out) != 1 {
+		b.Fatal("of rule failed to match")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Eval(compiled.rules[0], scanner.stack, scanner.stream.matches, scanner.static, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// conformance of undefined values with YARA, the input has a single
+// match of $a at 0 and of $b at 3
+func TestUndefined(t *testing.T) {
+	tests := []struct {
+		condition string
+		matches   bool
+	}{
+		// out of bounds match offsets, the first match is @a[1] and
+		// @a is the same as @a[1]
+		{"@a[1] == 0", true},
+		{"@a == 0 and @b == 3", true},
+		{"@a[0] == 0", false},
+		{"not (@a[0] == 0)", false},
+		{"@b[2] == 3", false},
+		{"@a[5] == 0", false},
+		{"@a[5] != 0", false},
+		{"not (@a[5] == 0)", false},
+		{"not @a[5]", false},
+		{"@a[5]", false},
+		{"@a[-1] < 100", false},
+
+		// propagation through arithmetic
+		{"@a[5] + 1 > 0", false},
+		{"@a[5] - @a[5] == 0", false},
+		{"-@a[5] < 0", false},
+		{"@a[5] * 0 == 0", false},
+
+		// and and or are always defined
+		{"@a[5] == 0 or $a", true},
+		{"$a or @a[5] == 0", true},
+		{"@a[5] == 0 and $a", false},
+		{"not (@a[5] == 0 and $a)", true},
+		{"not (@a[5] == 0 or false)", true},
+		{"(@a[5] == 0 or @a[6] == 0) == false", true},
+
+		// division by zero
+		{"10 \\ 0 == 0", false},
+		{"not (10 \\ 0 == 0)", false},
+		{"10 % 0 != 1", false},
+		{"#a \\ 0 >= 0", false},
+		{"10 \\ 3 == 3 and 10 % 3 == 1", true},
+
+		// shifts by a negative count, or by 64 bits or more
+		{"filesize << (0 - 1) == 0", false},
+		{"not (filesize << (0 - 1) == 0)", false},
+		{"filesize >> (0 - 2) == 0", false},
+		{"filesize << 64 == 0", true},
+		{"filesize >> 64 == 0", true},
+		{"filesize << 62 < 0 and filesize >> 1 == 3", true},
+
+		// reads past the end of the input
+		{"uint32(0) == 0x626f6f66", true},
+		{"uint32(100) == 0", false},
+		{"not (uint32(100) == 0)", false},
+		{"uint8(@a[5]) == 0", false},
+		{"uint8(5) == 0x72", true},
+
+		// string operators with an undefined offset or range
+		{"$b at @b[1]", true},
+		{"$a at @a[5]", false},
+		{"not ($a at @a[5])", false},
+		{"$b in (@a[5]..10)", false},
+
+		// loops count only the defined and true iterations
+		{"for any i in (1..2) : ( @a[i] == 0 )", true},
+		{"for all i in (1..2) : ( @a[i] == 0 )", false},
+
+		// any value other than zero is true, negative values included
+		{"0 - 5", true},
+		{"-1 and $a", true},
+		{"not (0 - 1)", false},
+		{"int8(0) - 0x66", false},
+		{"int8(0) - 0x67", true},
+		{"#a - 2 and not (#b - 1)", true},
+
+		// strings are true if they are not empty
+		{`"foo" and $a`, true},
+		{`"" or $b and not ""`, true},
+		{`"" or $a at 1`, false},
+
+		{"not false", true},
+		{"not #a == 2", true},
+		{"filesize > 0 and #a == 1", true},
+	}
+
+	for _, test := range tests {
+		rule := testRule("Undefined", test.condition, `$a = "foo"`, `$b = "bar"`)
+
+		out, err := testCompile(rule, "foobar")
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v: expecting %v", test.condition, test.matches)
+		}
+	}
+}
+
+func TestOfForms(t *testing.T) {
+	tests := []struct {
+		condition string
+		matches   bool
+	}{
+		{"50% of them", true},
+		{"75% of them", true},
+		{"100% of them", false},
+		{"50% of ($a, $d)", true},
+		{"10 % 3 == 1", true},
+		{"any of them in (0..2)", true},
+		{"all of ($a, $b) in (0..3)", true},
+		{"all of ($a, $b) in (0..2)", false},
+		{"all of ($a*) in (0..filesize)", true},
+		{"$b in (0..3)", true},
+		{"$a in (1..6)", false},
+		{"$a in (7..7)", true},
+		{"all of ($a, $c) at 0", false},
+		{"any of ($a, $c) at 15", true},
+		{"2 of them at 0", false},
+		{"none of ($d)", true},
+		{"none of them", false},
+		{"none of ($d, $a) in (1..6)", true},
+	}
+
+	for _, test := range tests {
+		rule := testRule("Of", test.condition, `$a = "foo"`, `$b = "bar"`, `$c = "baz"`, `$d = "nope"`)
+
+		out, err := testCompile(rule, "foobar foo bar baz")
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v: expecting %v", test.condition, test.matches)
+		}
+	}
+}
+
+func TestOfRules(t *testing.T) {
+	rule := `
+rule First {
+    strings:
+        $a = "foo"
+    condition:
+        $a
+}
+
+rule Second {
+    strings:
+        $a = "nope"
+    condition:
+        $a
+}
+
+rule FirstAgain {
+    condition:
+        First and not Second
+}
+
+rule AnyRule {
+    condition:
+        any of (First, Second)
+}
+
+rule AllRule {
+    condition:
+        all of (First*, Second)
+}
+
+rule Wildcard {
+    condition:
+        2 of (First*)
+}
+`
+
+	out, err := testCompile(rule, "foobar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, o := range out {
+		names = append(names, o.Name)
+	}
+
+	if !reflect.DeepEqual([]string{"First", "FirstAgain", "AnyRule", "Wildcard"}, names) {
+		t.Fatalf("unexpected matching rules %v", names)
+	}
+
+	// rules can only refer to the rules declared before them
+	_, err = Compile(`
+rule First {
+    condition:
+        Second
+}
+
+rule Second {
+    condition:
+        true
+}`)
+	if err == nil {
+		t.Fatal("expecting an unknown identifier error")
+	}
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []struct {
+		condition string
+		matches   bool
+	}{
+		// enumerations
+		{"for any i in (1, 5, 9) : ( i == 5 )", true},
+		{"for all i in (1, 5, 9) : ( i > 0 )", true},
+		{"for all i in (1, 5, 9) : ( i > 1 )", false},
+		{"for 2 i in (1, 5, 9) : ( i > 1 )", true},
+		{"for any i in (#a, #b) : ( i == 3 )", true},
+		{"for any i in (3) : ( @b[1] == i )", true},
+
+		// ranges are inclusive
+		{"for all i in (1..3) : ( @a[i] >= 0 )", true},
+		{"for all i in (1..4) : ( @a[i] >= 0 )", false},
+		{"for all i in (0..3) : ( @a[i] >= 0 )", false},
+		{"for any i in (3..1) : ( true )", false},
+
+		// none and percentages
+		{"for none i in (1..3) : ( @a[i] == 1 )", true},
+		{"for none i in (1, 2) : ( i == 2 )", false},
+		{"for none i in (@a[9]..2) : ( false )", false},
+		{"for 50% i in (1, 2, 3, 4) : ( i > 2 )", true},
+		{"for 75% i in (1, 2, 3, 4) : ( i > 2 )", false},
+		{"for 50% of them : ( # > 1 )", true},
+
+		// nested loops have their own variables
+		{"for any i in (1..3) : ( for any j in (1..2) : ( @a[i] + 3 == @b[j] ) )", true},
+		{"for all i in (1..2) : ( for all j in (1..2) : ( @a[i] < @a[j] + 20 ) )", true},
+		{"for any i in (1..3) : ( for all j in (1..3) : ( @a[i] > @b[j] ) )", false},
+
+		// loops over strings
+		{"for all of ($a, $b) : ( # >= 2 )", true},
+		{"for any of them : ( $ at 7 )", true},
+		{"for all of ($a*) : ( @[2] == 7 and @ == 0 )", true},
+		{"for any of ($a, $b) : ( for all of ($b) : ( # == 2 ) and # == 3 )", true},
+		{"for none of them : ( $ at 1 )", true},
+		{`for all i in (1..2) : ( "x" ) and not for any i in (1..2) : ( "" )`, true},
+	}
+
+	for _, test := range tests {
+		rule := testRule("Loops", test.condition, `$a = "foo"`, `$b = "bar"`)
+
+		// $a at 0, 7 and 14, $b at 3 and 10
+		out, err := testCompile(rule, "foobar foobar foo")
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v: expecting %v", test.condition, test.matches)
+		}
+	}
+
+	// loops over module arrays and dictionaries wait on modules, they
+	// are errors until then
+	for _, test := range []struct {
+		condition string
+		expected  string
+	}{
+		{"for any section in pe.sections : ( section.size > 0 )", "3:37: rule Module: unknown iterable 'pe . sections', modules are not supported"},
+		{"for any k, v in pe.version_info : ( k == 1 )", "3:20: rule Module: unknown iterable 'pe . version_info', only module dictionaries take two loop variables and modules are not supported"},
+		{"for any k, v in (1, 2) : ( k == 1 )", "3:20: rule Module: unknown iterable '(1,2)', only module dictionaries take two loop variables and modules are not supported"},
+		{"for any s in pe : ( true )", "3:29: rule Module: unknown identifier 'pe', modules are not supported"},
+	} {
+		_, err := Compile(`import "pe"
+rule Module {
+    condition: ` + test.condition + `
+}`)
+
+		var errs CompileErrors
+		if !errors.As(err, &errs) || errs[0].Error() != test.expected {
+			t.Fatalf("%v: expecting '%v', got %v", test.condition, test.expected, err)
+		}
+	}
+}
+
+// a loop over a range too large to finish is stopped at the deadline
+func TestLoopTimeout(t *testing.T) {
+	compiled, err := Compile(`rule Loop { condition: for any i in (0..filesize * 1000000000000) : ( i < 0 ) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	if _, err := compiled.Scan([]byte("foobar"), false, 1); err != ErrTimeout {
+		t.Fatalf("expecting a timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expecting the loop to stop after a second, took %v", elapsed)
+	}
+}
+
+func TestWith(t *testing.T) {
+	tests := []struct {
+		condition string
+		matches   bool
+	}{
+		{"with x = @a[2] : ( x == 7 )", true},
+		{"with x = @a[2], y = x + 3 : ( y == @b[2] )", true},
+		{"with x = #a, y = #b : ( x > y and x * 2 == 6 )", true},
+		{"with x = uint8(@a[3]) : ( x == 0x66 )", true},
+		{"with x = @a[9] : ( x == 0 )", false},
+		{"with x = 3 : ( for any i in (1..3) : ( @a[i] + x == @b[1] ) )", true},
+		{"for any i in (1..2) : ( with x = @a[i] + 3 : ( x == @b[i] ) )", true},
+		{"with x = 1 : ( x == 1 ) and with x = 2 : ( x == 2 )", true},
+	}
+
+	for _, test := range tests {
+		rule := testRule("With", test.condition, `$a = "foo"`, `$b = "bar"`)
+
+		// $a at 0, 7 and 14, $b at 3 and 10
+		out, err := testCompile(rule, "foobar foobar foo")
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v: expecting %v", test.condition, test.matches)
+		}
+	}
+
+	// the slots of loop variables and bindings only hold integers
+	for _, test := range []struct {
+		condition string
+		expected  string
+	}{
+		{`for any s in ("a", "b") : ( s == "a" )`, "1:38: rule With: the items of a loop must be int, got string\n1:43: rule With: the items of a loop must be int, got string"},
+		{`for any s in ("a") : ( s == "a" )`, "1:38: rule With: the items of a loop must be int, got string"},
+		{`with s = "abc" : ( s contains "b" )`, "1:29: rule With: string bindings are not supported"},
+		{"with r = /a/ : ( true )", "1:29: rule With: regex bindings are not supported"},
+	} {
+		_, err := Compile(`rule With { condition: ` + test.condition + ` }`)
+
+		if err == nil || err.Error() != test.expected {
+			t.Fatalf("%v: expecting '%v', got %v", test.condition, test.expected, err)
+		}
+	}
+
+	invalid := []string{
+		"with x = 1, x = 2 : ( x == 2 )",
+		"for any i in (0..1) : ( with i = 2 : ( i == 2 ) )",
+		"with Other = 1 : ( Other == 1 )",
+		"with x = 1 : ( x == 1 ) and x == 1",
+		"with x = y, y = 1 : ( x == 1 )",
+	}
+
+	for _, condition := range invalid {
+		rule := `
+rule Other {
+    condition:
+        true
+}
+
+rule With {
+    condition:
+        ` + condition + `
+}`
+
+		if _, err := testCompile(rule, "foo"); err == nil {
+			t.Fatalf("%v: expecting a compile error", condition)
+		}
+	}
+}
+
+// testPE builds a PE whose entry point is in a section at file offset
+// 0x210.
+func testPE() []byte {
+	pe := make([]byte, 0x400)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(pe[0x46:], 1)
+	binary.LittleEndian.PutUint16(pe[0x54:], 0xe0)
+	binary.LittleEndian.PutUint32(pe[0x68:], 0x1010)
+
+	section := pe[0x138:]
+	binary.LittleEndian.PutUint32(section[8:], 0x100)
+	binary.LittleEndian.PutUint32(section[12:], 0x1000)
+	binary.LittleEndian.PutUint32(section[16:], 0x200)
+	binary.LittleEndian.PutUint32(section[20:], 0x200)
+
+	copy(pe[0x210:], "start")
+	return pe
+}
+
+// testELF builds a 64 bit ELF whose entry point is at file offset 0x80.
+func testELF() []byte {
+	elf := make([]byte, 0x100)
+	copy(elf, "\x7fELF\x02\x01")
+	binary.LittleEndian.PutUint64(elf[0x18:], 0x400080)
+	binary.LittleEndian.PutUint64(elf[0x20:], 0x40)
+	binary.LittleEndian.PutUint16(elf[0x36:], 56)
+	binary.LittleEndian.PutUint16(elf[0x38:], 1)
+
+	ph := elf[0x40:]
+	binary.LittleEndian.PutUint32(ph, 1)
+	binary.LittleEndian.PutUint64(ph[16:], 0x400000)
+	binary.LittleEndian.PutUint64(ph[32:], 0x100)
+
+	copy(elf[0x80:], "start")
+	return elf
+}
+
+func TestEntryPoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		condition string
+		matches   bool
+	}{
+		{"pe", testPE(), "$a at entrypoint", true},
+		{"pe", testPE(), "entrypoint == 0x210", true},
+		{"elf", testELF(), "$a at entrypoint", true},
+		{"elf", testELF(), "entrypoint == 0x80 and entrypoint < filesize", true},
+		{"text", []byte("foo start"), "$a at entrypoint", false},
+		{"text", []byte("foo start"), "entrypoint == 0 or entrypoint != 0", false},
+		{"truncated", testPE()[:0x60], "entrypoint >= 0", false},
+	}
+
+	for _, test := range tests {
+		compiled, err := Compile(testRule("EntryPoint", test.condition, `$a = "start"`))
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		out, err := compiled.Scan(test.input, false, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v, %v: expecting %v", test.name, test.condition, test.matches)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	rules := `rule A {
+    condition:
+        $a and
+}
+
+rule B {
+    strings:
+        $b = "x"
+    condition:
+        $b and foo
+}
+
+rule C {
+    condition:
+        A or B
+}
+
+rule D {
+    condition:
+        for any i in (1, 2) : ( j == 1 )
+}`
+
+	_, err := Compile(rules)
+
+	var errs CompileErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expecting compile errors, got %v", err)
+	}
+
+	expected := []struct {
+		row  int
+		col  int
+		rule string
+	}{
+		{4, 1, "A"},
+		{10, 16, "B"},
+		{20, 33, "D"},
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("expecting %v errors, got %v", len(expected), errs)
+	}
+
+	for i, e := range expected {
+		if errs[i].Row != e.row || errs[i].Col != e.col || errs[i].Rule != e.rule {
+			t.Fatalf("expecting an error at %v:%v in rule %v, got %v", e.row, e.col, e.rule, errs[i])
+		}
+	}
+
+	if errs[1].Snippet != "        $b and foo\n               ^" {
+		t.Fatalf("invalid snippet:\n%v", errs[1].Snippet)
+	}
+
+	// the first error is found with errors.As
+	var first *CompileError
+	if !errors.As(err, &first) || first.Rule != "A" {
+		t.Fatalf("expecting the error of rule A, got %v", first)
+	}
+
+	// and each error with errors.Is
+	for _, e := range errs {
+		if !errors.Is(err, e) {
+			t.Fatalf("expecting errors.Is to find %v", e)
+		}
+	}
+
+	if errors.Is(err, &CompileError{Rule: "A"}) {
+		t.Fatal("expecting errors.Is to compare the errors, not their fields")
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.yar")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CompileFile(path)
+	if !errors.As(err, &first) || first.File != path || !strings.HasPrefix(err.Error(), path+":4:1: rule A: ") {
+		t.Fatalf("expecting errors in %v, got %v", path, err)
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	rules := `rule A {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        $a + "x" == 1
+}
+
+rule A {
+    condition:
+        for all i in (1, 2) : ( for any i in (3, 4) : ( i == 4 ) )
+}`
+
+	expected := []string{
+		"4:9: rule A: unreferenced string $b",
+		"6:12: rule A: operator '+' expects ints or floats, got bool and string",
+		"9:6: rule A: duplicate rule name 'A'",
+		"11:37: rule A: duplicate identifier 'i', it is already defined in this scope",
+	}
+
+	_, err := Compile(rules)
+
+	var errs CompileErrors
+	if !errors.As(err, &errs) || len(errs) != len(expected) {
+		t.Fatalf("expecting %v errors, got %v", len(expected), err)
+	}
+
+	for i, e := range errs {
+		if e.Error() != expected[i] {
+			t.Fatalf("expecting '%v', got '%v'", expected[i], e)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	rules := `rule A {
+    strings:
+        $a = "foobar"
+        $b = "foobar" ascii
+        $c = "x"
+        $_e = "unused but private"
+        $f = "MZ" nocase wide
+        $g = /ab+c/
+    condition:
+        $a or $b or $c or $f at 0 or $g
+}
+
+rule B {
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        any of them and 1 + 1 == 2
+}
+
+rule C {
+    strings:
+        $a1 = "foo"
+        $a2 = "bar"
+    condition:
+        1 + 1 == 3 and any of ($a*)
+}
+
+rule D {
+    condition:
+        false
+}
+
+rule E {
+    condition:
+        1 - 2 * 1
+}`
+
+	expected := []string{
+		"4:9: rule A: duplicate string $b, same as $a",
+		"5:9: rule A: slow string $c, atoms are too common",
+		"8:14: rule A: slow regex $g, regex prefix should be at least 6 bytes, 'ab'",
+		"10:30: rule A: slow condition, '$f at 0' scans the whole input for a nocase wide string, compare the first bytes instead",
+		"26:20: rule C: condition is always false",
+		"36:11: rule E: condition is always true",
+	}
+
+	compiler := NewCompiler()
+	if _, err := compiler.Compile(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := compiler.Warnings()
+	if len(warnings) != len(expected) {
+		t.Fatalf("expecting %v warnings, got %v", len(expected), warnings)
+	}
+
+	for i, warning := range warnings {
+		if warning.Error() != expected[i] {
+			t.Fatalf("expecting '%v', got '%v'", expected[i], warning)
+		}
+	}
+
+	// the warnings fail the compile as errors
+	compiler.WarningsAsErrors = true
+
+	_, err := compiler.Compile(rules)
+
+	var errs CompileErrors
+	if !errors.As(err, &errs) || len(errs) != len(expected) {
+		t.Fatalf("expecting the warnings as errors, got %v", err)
+	}
+}
+
+func TestIdenticalStringsModifiers(t *testing.T) {
+	rule := `
+rule A {
+    strings:
+        $a = "foo"
+    condition:
+        $a
+}
+
+rule B {
+    strings:
+        $a = "foo" nocase
+    condition:
+        $a
+}`
+
+	// the same text with other modifiers is not the same pattern
+	out, err := testCompile(rule, "FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 1 || out[0].Name != "B" {
+		t.Fatalf("expecting rule B to match, got %v", out)
+	}
+}
+
+func TestExternalVariables(t *testing.T) {
+	tests := []struct {
+		condition string
+		matches   bool
+	}{
+		{"debug", true},
+		{"not debug or level > 3", false},
+		{"level == 3 and level * 2 == 6", true},
+		{`env == "prod"`, true},
+		{`env != "prod"`, false},
+		{`env < "zzz" and env >= "prod"`, true},
+		{`env contains "ro" and env startswith "pr" and env endswith "od"`, true},
+		{`env icontains "RO" and env istartswith "PR" and env iendswith "OD"`, true},
+		{`env iequals "PROD" and ("prod" == env)`, true},
+		{`env matches /^p.o/ and not (env matches /dev/)`, true},
+		{`with env2 = level : ( env2 == 3 )`, true},
+		{"env and not empty", true},
+		{"empty or level < 3", false},
+	}
+
+	for _, test := range tests {
+		compiler := NewCompiler()
+
+		for name, value := range map[string]interface{}{"debug": true, "level": 3, "env": "prod", "empty": ""} {
+			if err := compiler.DefineVariable(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		compiled, err := compiler.Compile(`rule External { condition: ` + test.condition + ` }`)
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if len(compiler.Warnings()) != 0 {
+			t.Fatalf("%v: unexpected warnings %v", test.condition, compiler.Warnings())
+		}
+
+		out, err := compiled.Scan([]byte("foo"), false, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (len(out) == 1) != test.matches {
+			t.Fatalf("%v: expecting %v", test.condition, test.matches)
+		}
+	}
+
+	compiler := NewCompiler()
+	if err := compiler.DefineVariable("ratio", 1.5); err == nil {
+		t.Fatal("expecting an error for a float variable")
+	}
+
+	compiler.DefineVariable("env", "prod")
+
+	for condition, expected := range map[string]string{
+		"env + 1 == 2":                            "operator '+' expects ints or floats, got string and int",
+		"for any env in (1..2) : ( env == 1 )":    "duplicate identifier 'env', it is already defined as an external variable",
+		"undefined_variable":                      "unknown identifier 'undefined_variable'",
+		`env == "prod" } rule env { condition: 1`: "duplicate rule name 'env', it is already defined as an external variable",
+	} {
+		_, err := compiler.Compile(`rule External { condition: ` + condition + ` }`)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%v: expecting '%v', got %v", condition, expected, err)
+		}
+	}
+}
+
+func TestFastScan(t *testing.T) {
+	rule := `rule Fast {
+    strings:
+        $a = "foo"
+        $b = /ba[rz]/
+    condition:
+        #a == 1 and #b == 1
+}`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := compiled.Scan([]byte("foo bar foo baz"), true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 0 {
+		t.Fatal("expecting every match without fast mode")
+	}
+
+	compiled, err = (&Compiler{FastScan: true}).Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = compiled.Scan([]byte("foo bar foo baz"), true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 1 || len(out[0].Strings) != 2 || out[0].Strings[0].Offset != 0 || out[0].Strings[1].Offset != 4 {
+		t.Fatalf("expecting the first match of each string, got %v", out)
+	}
+}
+
+func TestMetaKeys(t *testing.T) {
+	out, err := testCompile(`rule Meta {
+    meta:
+        zeta = 1
+        alpha = "a"
+        zeta = 2
+        mid = true
+    condition:
+        true
+}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out[0].MetaKeys(), []string{"zeta", "alpha", "mid"}) || out[0].Meta["zeta"] != int64(2) {
+		t.Fatalf("unexpected meta %v %v", out[0].MetaKeys(), out[0].Meta)
+	}
+}
+
+// the tags and the meta of an output belong to the caller, changing them
+// does not change the rule
+func TestOutputCopies(t *testing.T) {
+	compiled, err := Compile(`rule Tagged : red {
+    meta:
+        author = "me"
+    condition:
+        true
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := compiled.Scan([]byte("foo"), false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out[0].Tags[0] = "blue"
+	out[0].Tags = append(out[0].Tags, "green")
+	out[0].Meta["author"] = "you"
+	out[0].MetaKeys()[0] = "editor"
+
+	out, err = compiled.Scan([]byte("foo"), false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out[0].Tags, []string{"red"}) || out[0].Meta["author"] != "me" || out[0].MetaKeys()[0] != "author" {
+		t.Fatalf("expecting the rule unchanged, got %v %v %v", out[0].Tags, out[0].Meta, out[0].MetaKeys())
+	}
+}
+
+func TestScanFileWithCallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := Compile(`
+rule Match { condition: filesize == 3 }
+rule NoMatch { condition: filesize == 4 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]string, 0)
+
+	err = compiled.ScanFileWithCallback(path, false, 3, func(event Event) Action {
+		if event.Rule != nil {
+			events = append(events, fmt.Sprintf("%v %v %v", event.Type, event.Rule.Name, event.Rule.Path == path))
+		}
+
+		return Continue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(events, []string{"RuleMatching Match true", "RuleNotMatching NoMatch true"}) {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	input := "first\r\nsecond line\r\n\tthird é $x\nfourth\n"
+	ix := NewLineIndex(strings.NewReader(input), int64(len(input)))
+
+	tests := []struct {
+		offset int
+		line   int
+		column int
+	}{
+		{0, 1, 1},
+		{4, 1, 5},
+		{7, 2, 1},
+		{14, 2, 8},
+		{20, 3, 1},
+		// é is two bytes and one column
+		{30, 3, 10},
+		{len(input) - 1, 4, 7},
+	}
+
+	for _, test := range tests {
+		line, column, err := ix.Position(int64(test.offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if line != test.line || column != test.column {
+			t.Fatalf("offset %v: expecting %v:%v, got %v:%v", test.offset, test.line, test.column, line, column)
+		}
+	}
+
+	context, err := ix.Context(14, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ContextLine{{1, "first"}, {2, "second line"}, {3, "\tthird é $x"}}
+	if !reflect.DeepEqual(context, expected) {
+		t.Fatalf("expecting %v, got %v", expected, context)
+	}
+
+	// no empty line after the last line ending
+	if context, _ := ix.Context(int64(len(input)-2), 2); len(context) != 3 || context[2].Text != "fourth" {
+		t.Fatalf("unexpected context %v", context)
+	}
+
+	long := strings.Repeat("a", 2000) + "needle" + strings.Repeat("b", 2000)
+	ix = NewLineIndex(strings.NewReader(long), int64(len(long)))
+
+	context, err = ix.Context(2000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(context) != 1 || len(context[0].Text) != MaxLineText || !strings.Contains(context[0].Text, "needle") {
+		t.Fatalf("expecting the line cut around the match, got %v", context)
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r    io.ReaderAt
+	read int
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
+
+func TestLineIndexColumns(t *testing.T) {
+	// a carriage return not followed by a line feed is a character
+	input := "a\rbc\r\nd\n"
+	ix := NewLineIndex(strings.NewReader(input), int64(len(input)))
+
+	if line, column, _ := ix.Position(2); line != 1 || column != 3 {
+		t.Fatalf("expecting 1:3 after a bare carriage return, got %v:%v", line, column)
+	}
+
+	if context, _ := ix.Context(0, 0); len(context) != 1 || context[0].Text != "a\rbc" {
+		t.Fatalf("expecting only the carriage return of the line ending removed, got %q", context)
+	}
+
+	// a single line longer than the read buffer, with characters cut by
+	// the buffer ends, looked up in order and out of order
+	line := strings.Repeat("aé€😀", 2000)
+	reader := &countingReader{r: strings.NewReader(line)}
+	ix = NewLineIndex(reader, int64(len(line)))
+
+	offsets := make([]int, 0)
+	for i := range line {
+		offsets = append(offsets, i)
+	}
+
+	if _, _, err := ix.Position(0); err != nil {
+		t.Fatal(err)
+	}
+
+	reader.read = 0
+
+	for _, offset := range offsets {
+		_, column, err := ix.Position(int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := len([]rune(line[:offset])) + 1; column != expected {
+			t.Fatalf("offset %v: expecting column %v, got %v", offset, expected, column)
+		}
+	}
+
+	// the line is read once, with the bytes of a character cut by each
+	// offset looked up
+	if reader.read > len(line)+utf8.UTFMax*len(offsets) {
+		t.Fatalf("expecting the line to be read once, read %v bytes of %v", reader.read, len(line))
+	}
+
+	for _, offset := range []int{len(line) - 4, 6, 0, 4096, 4093} {
+		if _, column, _ := ix.Position(int64(offset)); column != len([]rune(line[:offset]))+1 {
+			t.Fatalf("offset %v: unexpected column %v", offset, column)
+		}
+	}
+}
+
+func TestAddLines(t *testing.T) {
+	input := "line one\nline two has foo\nline three\n"
+
+	compiled, err := Compile(`rule Foo { strings: $a = "foo" condition: $a }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := compiled.Scan([]byte(input), true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddLines(out, NewLineIndex(strings.NewReader(input), int64(len(input))), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(out[0].Strings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"identifier":"$a","offset":22,"length":3,"line":2,"column":14,` +
+		`"context":[{"line":1,"text":"line one"},{"line":2,"text":"line two has foo"},{"line":3,"text":"line three"}],"data":"foo"}`
+
+	if string(data) != expected {
+		t.Fatalf("expecting\n%v\ngot\n%v", expected, string(data))
+	}
+}
+
+func TestProfile(t *testing.T) {
+	rule := `rule A {
+    strings:
+        $a = "foo"
+        $b = /ba[rz]/
+    condition:
+        $a and #b == 2
+}
+
+rule B {
+    strings:
+        $c = "qux"
+    condition:
+        $c
+}`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if compiled.Profile() != nil {
+		t.Fatal("expecting no profile without Compiler.Profile")
+	}
+
+	compiled, err = (&Compiler{Profile: true}).Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := compiled.Scan([]byte("foo bar foo baz"), false, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	profile := compiled.Profile()
+	if profile.Scans != 2 || len(profile.Rules) != 2 || len(profile.Strings) != 3 {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+
+	rules := make(map[string]RuleProfile)
+	for _, r := range profile.Rules {
+		rules[r.Name] = r
+	}
+
+	// B is false without running its instructions, $c never matched
+	if a := rules["A"]; a.Evaluations != 2 || a.Instructions == 0 {
+		t.Fatalf("unexpected profile of A %+v", a)
+	}
+
+	if b := rules["B"]; b.Evaluations != 0 || b.Instructions != 0 {
+		t.Fatalf("unexpected profile of B %+v", b)
+	}
+
+	// the regex is verified at each 'ba' and sorts first
+	if b := profile.Strings[0]; b.Name != "$b" || b.Verifications < 4 || b.Hits < b.Verifications || b.Matches != 4 {
+		t.Fatalf("unexpected profile of $b %+v", b)
+	}
+
+	for _, str := range profile.Strings[1:] {
+		expected := int64(4)
+		if str.Name == "$c" {
+			expected = 0
+		}
+
+		if str.Matches != expected {
+			t.Fatalf("expecting %v matches of %v, got %+v", expected, str.Name, str)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package exec
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// MaxLineText is the most bytes of a line kept in a ContextLine, the
+// text of a longer line is cut around the match.
+const MaxLineText = 512
+
+// ContextLine is a line of the input around a match, numbered from 1.
+// The line ending, LF or CRLF, is not part of the text.
+type ContextLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// LineIndex maps the offsets of an input to lines and columns. The
+// index is built the first time it is used, reading the whole input
+// once, so scans without a match never pay for it. Like a Scanner, it
+// is not safe for concurrent use.
+type LineIndex struct {
+	data io.ReaderAt
+	size int64
+	// the offset each line starts at, built lazily
+	starts []int64
+	err    error
+	// the last column counted, the next offset on the same line counts
+	// from there
+	cursor cursor
+	buf    []byte
+}
+
+// cursor is a character boundary of a line and the number of
+// characters before it on the line.
+type cursor struct {
+	line   int
+	offset int64
+	chars  int
+}
+
+// NewLineIndex creates an index of the size bytes of data.
+func NewLineIndex(data io.ReaderAt, size int64) *LineIndex {
+	return &LineIndex{data: data, size: size}
+}
+
+func (ix *LineIndex) build() error {
+	if ix.starts != nil || ix.err != nil {
+		return ix.err
+	}
+
+	ix.starts = []int64{0}
+	buf := make([]byte, ChunkSize)
+
+	for offset := int64(0); offset < ix.size; {
+		n, err := ix.data.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			if err != io.EOF {
+				ix.err = err
+			}
+			break
+		}
+
+		for i := 0; i < n; {
+			j := bytes.IndexByte(buf[i:n], '\n')
+			if j < 0 {
+				break
+			}
+
+			ix.starts = append(ix.starts, offset+int64(i+j+1))
+			i += j + 1
+		}
+
+		offset += int64(n)
+	}
+
+	return ix.err
+}
+
+// line returns the index of the line holding offset.
+func (ix *LineIndex) line(offset int64) int {
+	lo, hi := 0, len(ix.starts)-1
+
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if ix.starts[mid] <= offset {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return lo
+}
+
+// bounds returns the offsets of the start and the end of a line, the
+// end excludes the line ending.
+func (ix *LineIndex) bounds(line int) (int64, int64) {
+	start, end := ix.starts[line], ix.size
+	if line+1 < len(ix.starts) {
+		end = ix.starts[line+1] - 1
+	}
+
+	return start, end
+}
+
+// read returns the bytes of the input from start to end.
+func (ix *LineIndex) read(start, end int64) []byte {
+	buf := make([]byte, end-start)
+	n, _ := ix.data.ReadAt(buf, start)
+
+	return buf[:n]
+}
+
+// Position returns the line and the column of offset, both starting at
+// 1. The column counts UTF-8 characters, a carriage return not followed
+// by a line feed is a character. Looking up the offsets of a line in
+// increasing order reads the line once.
+func (ix *LineIndex) Position(offset int64) (int, int, error) {
+	if err := ix.build(); err != nil {
+		return 0, 0, err
+	}
+
+	line := ix.line(offset)
+
+	return line + 1, ix.column(line, offset), nil
+}
+
+// column counts the characters of line before offset, from the cursor
+// if it is on the line before offset and from the start of the line
+// otherwise. A character cut by offset is counted.
+func (ix *LineIndex) column(line int, offset int64) int {
+	c := &ix.cursor
+
+	if c.line != line || c.offset > offset {
+		start, _ := ix.bounds(line)
+		*c = cursor{line: line, offset: start}
+	}
+
+	if ix.buf == nil {
+		ix.buf = make([]byte, 4096)
+	}
+
+	buf := ix.buf
+
+	for c.offset < offset {
+		size := offset - c.offset + utf8.UTFMax
+		if size > int64(len(buf)) {
+			size = int64(len(buf))
+		}
+
+		n, _ := ix.data.ReadAt(buf[:size], c.offset)
+		if n == 0 {
+			break
+		}
+
+		i := 0
+		for i < n && c.offset+int64(i) < offset {
+			// a character cut by the end of the buffer is read again
+			if !utf8.FullRune(buf[i:n]) && n == int(size) && i > 0 {
+				break
+			}
+
+			_, width := utf8.DecodeRune(buf[i:n])
+			i += width
+			c.chars++
+		}
+
+		c.offset += int64(i)
+	}
+
+	return c.chars + 1
+}
+
+// Context returns the line holding offset with up to around lines
+// before and after it, like grep -C. The text of a line longer than
+// MaxLineText is cut, the line holding offset around offset.
+func (ix *LineIndex) Context(offset int64, around int) ([]ContextLine, error) {
+	if err := ix.build(); err != nil {
+		return nil, err
+	}
+
+	line := ix.line(offset)
+	lines := make([]ContextLine, 0, 2*around+1)
+
+	for i := line - around; i <= line+around; i++ {
+		if i < 0 || i >= len(ix.starts) {
+			continue
+		}
+
+		start, end := ix.bounds(i)
+
+		// the last line is empty if the input ends with a line ending
+		if start == ix.size && i > 0 {
+			continue
+		}
+
+		// the carriage return of a CRLF ending is not part of the text
+		crlf := i+1 < len(ix.starts)
+
+		if end-start > MaxLineText {
+			if i == line && offset-start > MaxLineText/2 {
+				start = offset - MaxLineText/2
+			}
+
+			if end-start > MaxLineText {
+				end = start + MaxLineText
+				crlf = false
+			}
+		}
+
+		text := ix.read(start, end)
+		if crlf {
+			text = bytes.TrimSuffix(text, []byte("\r"))
+		}
+
+		lines = append(lines, ContextLine{Line: i + 1, Text: string(text)})
+	}
+
+	return lines, nil
+}
+
+// AddLines sets the line and the column of each string match of the
+// outputs, and the lines around it if context is not negative, from the
+// index of the input they were scanned from. The matches are looked up
+// by increasing offset, a long line is read once for all its matches.
+func AddLines(output []*ScanOutput, ix *LineIndex, context int) error {
+	matches := make([]*StringMatch, 0)
+	for _, out := range output {
+		matches = append(matches, out.Strings...)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Offset < matches[j].Offset
+	})
+
+	for _, match := range matches {
+		line, column, err := ix.Position(int64(match.Offset))
+		if err != nil {
+			return err
+		}
+
+		match.Line, match.Column = line, column
+
+		if context < 0 {
+			continue
+		}
+
+		if match.Context, err = ix.Context(int64(match.Offset), context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
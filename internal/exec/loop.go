@@ -0,0 +1,337 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+)
+
+// Loops keep their variables and counters in slots, the values at the
+// bottom of the stack below the operands. Slots are allocated when a
+// loop is entered and freed when it is done, so nested loops each get
+// their own slots and sibling loops share them.
+//
+// A loop over a range compiles to:
+//
+//	<low>; MOVR i
+//	<high>; MOVR end
+//	PUSHR end; PUSHR i; MINUS; PUSH 1; ADD; MOVR total
+//	PUSH 0; MOVR count
+//	top:
+//	PUSHR i; PUSHR end; LTE; JZ exit
+//	<body>; ADDR count
+//	INCR i; JMP top
+//	exit:
+//	<quantifier over count and total>
+//
+// Enumerations and string sets are unrolled, the body is compiled once
+// for each item.
+//
+// Loops over the arrays and dictionaries of modules, e.g. pe.sections
+// or 'for any k, v in pe.version_info', are not supported as there are
+// no modules yet. They fail to compile with an unknown iterable error.
+//
+// The bindings of a with statement take a slot each for the duration
+// of its body.
+
+// allocSlots reserves n slots and returns the first one.
+func (c *compiler) allocSlots(n int) int64 {
+	first := c.slots
+	c.slots += n
+
+	if c.slots > c.maxSlots {
+		c.maxSlots = c.slots
+	}
+
+	return int64(first)
+}
+
+func (c *compiler) freeSlots(n int) {
+	c.slots -= n
+}
+
+// bind makes name refer to a slot in the body of a loop and returns a
+// function restoring the variable it shadows, if any.
+func (c *compiler) bind(name string, slot int64) func() {
+	prev, shadowed := c.tempVars[name]
+	c.tempVars[name] = slot
+
+	return func() {
+		if shadowed {
+			c.tempVars[name] = prev
+		} else {
+			delete(c.tempVars, name)
+		}
+	}
+}
+
+// compileWith evaluates each binding of a with statement once into its
+// own slot, the body and the bindings after it read the slot.
+func (c *compiler) compileWith(ruleName string, with *ast.With, instructions *[]Op) error {
+
+	var unbinds []func()
+
+	defer func() {
+		for i := len(unbinds) - 1; i >= 0; i-- {
+			unbinds[i]()
+		}
+	}()
+
+	for _, binding := range with.Bindings {
+		if _, ok := c.tempVars[binding.Name]; ok {
+			return errors.New(fmt.Sprintf("compiler: identifier '%v' is already defined in this scope", binding.Name))
+		}
+
+		if _, ok := c.ruleIndex[binding.Name]; ok {
+			return errors.New(fmt.Sprintf("compiler: identifier '%v' is already defined as a rule", binding.Name))
+		}
+
+		if err := c.compileNode(ruleName, binding.Value, instructions); err != nil {
+			return err
+		}
+
+		slot := c.allocSlots(1)
+		*instructions = append(*instructions, Op{OpCode: MOVR, IntParam: slot})
+		unbinds = append(unbinds, c.bind(binding.Name, slot))
+	}
+
+	err := c.compileNode(ruleName, with.Body, instructions)
+	c.freeSlots(len(with.Bindings))
+
+	return err
+}
+
+func (c *compiler) compileFor(ruleName string, loop *ast.For, instructions *[]Op) error {
+
+	push1 := func(op int, param int64) {
+		*instructions = append(*instructions, Op{OpCode: op, IntParam: param})
+	}
+
+	// for any of ($a, $b) : ( # > 2 )
+	if len(loop.Vars) == 0 {
+		return c.compileForStrings(ruleName, loop, instructions)
+	}
+
+	if len(loop.Vars) > 1 {
+		return errors.New(fmt.Sprintf("compiler: unknown iterable '%v', only module dictionaries take two loop variables and modules are not supported", loop.Iterable))
+	}
+
+	switch iterable := loop.Iterable.(type) {
+	case *ast.Infix:
+		if iterable.Token.Type == lexer.DOT {
+			return errors.New(fmt.Sprintf("compiler: unknown iterable '%v', modules are not supported", iterable))
+		}
+
+		if iterable.Token.Type == lexer.RANGE {
+			return c.compileForRange(ruleName, loop, iterable, instructions)
+		}
+
+	case *ast.Identity:
+		// a module iterable without a field is still a module
+		if _, ok := c.tempVars[iterable.Value]; !ok {
+			return errors.New(fmt.Sprintf("compiler: unknown iterable '%v', modules are not supported", iterable))
+		}
+	}
+
+	// for any i in (1, 5, 9), a single value is an enumeration of one
+	items := []ast.Node{loop.Iterable}
+	if set, ok := loop.Iterable.(*ast.Set); ok {
+		items = set.Nodes
+	}
+
+	slot := c.allocSlots(2)
+	variable, count := slot, slot+1
+
+	push1(PUSH, 0)
+	push1(MOVR, count)
+
+	for _, item := range items {
+		// the items are evaluated outside of the scope of the loop
+		// variable
+		if err := c.compileNode(ruleName, item, instructions); err != nil {
+			return err
+		}
+
+		push1(MOVR, variable)
+
+		unbind := c.bind(loop.Vars[0], variable)
+		err := c.compileNode(ruleName, loop.Body, instructions)
+		unbind()
+
+		if err != nil {
+			return err
+		}
+
+		push1(ADDR, count)
+	}
+
+	err := c.quantify(loop, count, Op{OpCode: PUSH, IntParam: int64(len(items))}, instructions)
+	c.freeSlots(2)
+
+	return err
+}
+
+func (c *compiler) compileForRange(ruleName string, loop *ast.For, rng *ast.Infix, instructions *[]Op) error {
+
+	push := func(op int) {
+		*instructions = append(*instructions, Op{OpCode: op})
+	}
+
+	push1 := func(op int, param int64) {
+		*instructions = append(*instructions, Op{OpCode: op, IntParam: param})
+	}
+
+	slot := c.allocSlots(4)
+	variable, end, count, total := slot, slot+1, slot+2, slot+3
+
+	if err := c.compileNode(ruleName, rng.Left, instructions); err != nil {
+		return err
+	}
+	push1(MOVR, variable)
+
+	if err := c.compileNode(ruleName, rng.Right, instructions); err != nil {
+		return err
+	}
+	push1(MOVR, end)
+
+	// the range is inclusive, total is undefined if a bound is
+	push1(PUSHR, end)
+	push1(PUSHR, variable)
+	push(MINUS)
+	push1(PUSH, 1)
+	push(ADD)
+	push1(MOVR, total)
+
+	push1(PUSH, 0)
+	push1(MOVR, count)
+
+	top := int64(len(*instructions))
+
+	// an undefined bound ends the loop before the first iteration
+	push1(PUSHR, variable)
+	push1(PUSHR, end)
+	push(LTE)
+
+	exit := len(*instructions)
+	push1(JZ, 0)
+
+	unbind := c.bind(loop.Vars[0], variable)
+	err := c.compileNode(ruleName, loop.Body, instructions)
+	unbind()
+
+	if err != nil {
+		return err
+	}
+
+	push1(ADDR, count)
+	push1(INCR, variable)
+	push1(JMP, top)
+
+	(*instructions)[exit].IntParam = int64(len(*instructions))
+
+	err = c.quantify(loop, count, Op{OpCode: PUSHR, IntParam: total}, instructions)
+	c.freeSlots(4)
+
+	return err
+}
+
+// compileForStrings unrolls a loop over a set of strings, the anonymous
+// $, # and @ in the body refer to the string of each iteration.
+func (c *compiler) compileForStrings(ruleName string, loop *ast.For, instructions *[]Op) error {
+
+	loads, err := c.setLoads(ruleName, loop.Iterable)
+	if err != nil {
+		return err
+	}
+
+	count := c.allocSlots(1)
+	*instructions = append(*instructions, Op{OpCode: PUSH, IntParam: 0}, Op{OpCode: MOVR, IntParam: count})
+
+	// restore the string of an enclosing loop once done
+	outer := c.tempVar
+
+	for _, load := range loads {
+		if load.OpCode != LOADCOUNT {
+			return errors.New(fmt.Sprintf("compiler: invalid loop, '%v' is not a set of strings", loop.Iterable))
+		}
+
+		c.tempVar = load.IntParam
+
+		if err := c.compileNode(ruleName, loop.Body, instructions); err != nil {
+			return err
+		}
+
+		*instructions = append(*instructions, Op{OpCode: ADDR, IntParam: count})
+	}
+
+	c.tempVar = outer
+
+	err = c.quantify(loop, count, Op{OpCode: PUSH, IntParam: int64(len(loads))}, instructions)
+	c.freeSlots(1)
+
+	return err
+}
+
+// quantify pushes the result of a loop, comparing the number of
+// iterations where the body was true against the quantifier. total
+// pushes the number of iterations.
+func (c *compiler) quantify(loop *ast.For, count int64, total Op, instructions *[]Op) error {
+
+	push := func(op int) {
+		*instructions = append(*instructions, Op{OpCode: op})
+	}
+
+	push1 := func(op int, param int64) {
+		*instructions = append(*instructions, Op{OpCode: op, IntParam: param})
+	}
+
+	push1(PUSHR, count)
+
+	switch loop.Expr.Type {
+	case lexer.INTEGER:
+		n, err := strconv.ParseInt(loop.Expr.Raw, 0, 64)
+		if err != nil {
+			return err
+		}
+
+		if loop.Percent {
+			if n < 1 || n > 100 {
+				return errors.New(fmt.Sprintf("compiler: invalid loop, percentage must be an integer between 1 and 100"))
+			}
+
+			// count * 100 >= n * total
+			push1(PUSH, 100)
+			push(MUL)
+			*instructions = append(*instructions, total)
+			push1(PUSH, n)
+			push(MUL)
+			push(GTE)
+		} else {
+			push1(PUSH, n)
+			push(GTE)
+		}
+
+	case lexer.ANY:
+		push1(PUSH, 1)
+		push(GTE)
+
+	case lexer.ALL:
+		*instructions = append(*instructions, total)
+		push(EQUAL)
+
+	case lexer.NONE:
+		// count == total - total, undefined like the total when a
+		// bound of the range is
+		*instructions = append(*instructions, total, total)
+		push(MINUS)
+		push(EQUAL)
+
+	default:
+		return errors.New(fmt.Sprintf("compiler: invalid loop expression: '%v'", loop.Expr))
+	}
+
+	return nil
+}
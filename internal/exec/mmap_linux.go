@@ -0,0 +1,38 @@
+//go:build linux
+
+package exec
+
+import (
+	"os"
+	"syscall"
+)
+
+// scanFile scans the file at path. Regular files are mapped into memory
+// rather than read into the heap, anything else, e.g. an empty file, a
+// pipe or a device, is streamed through the automata. The file must not
+// be truncated while it is being scanned.
+func (sc *Scanner) scanFile(path string, s bool, timeout int, fn Callback) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if !info.Mode().IsRegular() || size == 0 || int64(int(size)) != size {
+		return sc.scanReader(f, f, ChunkSize, s, timeout, fn)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return sc.scanReader(f, f, ChunkSize, s, timeout, fn)
+	}
+	defer syscall.Munmap(data)
+
+	return sc.ScanWithCallback(data, s, timeout, fn)
+}
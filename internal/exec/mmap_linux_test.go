@@ -0,0 +1,65 @@
+//go:build linux
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanFileFallback(t *testing.T) {
+	rule := `rule Empty {
+    condition:
+        filesize == 0
+}`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty file cannot be mapped
+	out, err := compiled.ScanFile(path, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) == 0 {
+		t.Fatal("failed to match empty file")
+	}
+
+	// neither can a device
+	out, err = compiled.ScanFile("/dev/null", false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) == 0 {
+		t.Fatal("failed to match device")
+	}
+}
+
+func TestScanFileTimeout(t *testing.T) {
+	rule := `rule Foobar {
+    strings:
+        $a = "foobar"
+    condition:
+        $a
+}`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// /dev/zero never ends, the scan only ends with the timeout
+	if _, err := compiled.ScanFile("/dev/zero", false, 1); err != ErrTimeout {
+		t.Fatalf("expecting a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package exec
+
+import (
+	"os"
+)
+
+// scanFile scans the file at path, streaming it through the automata.
+func (sc *Scanner) scanFile(path string, s bool, timeout int, fn Callback) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return sc.scanReader(f, f, ChunkSize, s, timeout, fn)
+}
@@ -0,0 +1,280 @@
+package exec
+
+// The optimizer rewrites the instructions built by compileNode. Each
+// pass looks at a short window of instructions and replaces it with a
+// cheaper sequence leaving the same value on the stack. Passes run until
+// none of them changes the instructions.
+//
+// Jumps hold the absolute index of their target, so every rewrite keeps
+// a mapping of old to new indexes and the targets are fixed up once the
+// pass is done. A window never spans a jump target, other than at its
+// first instruction, as the stack at the target depends on where the
+// jump came from.
+
+// rewrite replaces the n instructions at the start of a window. A nil
+// rewrite leaves the window alone.
+type rewrite struct {
+	n    int
+	with []Op
+}
+
+// peephole looks at the instructions starting at index i and returns
+// the rewrite to apply, if any.
+type peephole func(instr []Op, i int, targets map[int]bool) *rewrite
+
+var peepholes = []peephole{
+	foldConstants,
+	simplifyIdentity,
+	removeDeadBranch,
+	removeBool,
+	fuseCountGreater,
+	fuseOffset,
+}
+
+// optimize returns the optimized copy of instr.
+func optimize(instr []Op) []Op {
+
+	out := make([]Op, len(instr))
+	copy(out, instr)
+
+	for {
+		next, changed := optimizePass(out)
+		if !changed {
+			return out
+		}
+
+		out = next
+	}
+}
+
+func optimizePass(instr []Op) ([]Op, bool) {
+
+	targets := jumpTargets(instr)
+
+	out := make([]Op, 0, len(instr))
+	// index in out of each instruction in instr, including the end of
+	// the instructions
+	mapping := make([]int, len(instr)+1)
+	changed := false
+
+	for i := 0; i < len(instr); {
+		var rw *rewrite
+
+		for _, fn := range peepholes {
+			if rw = fn(instr, i, targets); rw != nil {
+				break
+			}
+		}
+
+		if rw == nil {
+			mapping[i] = len(out)
+			out = append(out, instr[i])
+			i++
+			continue
+		}
+
+		for j := i; j < i+rw.n; j++ {
+			mapping[j] = len(out)
+		}
+
+		out = append(out, rw.with...)
+		i += rw.n
+		changed = true
+	}
+
+	mapping[len(instr)] = len(out)
+
+	for i := range out {
+		if isJump(out[i].OpCode) {
+			out[i].IntParam = int64(mapping[out[i].IntParam])
+		}
+	}
+
+	return out, changed
+}
+
+func isJump(op int) bool {
+	return op == JFALSE || op == JTRUE || op == JMP || op == JZ
+}
+
+func jumpTargets(instr []Op) map[int]bool {
+	targets := make(map[int]bool)
+
+	for _, op := range instr {
+		if isJump(op.OpCode) {
+			targets[int(op.IntParam)] = true
+		}
+	}
+
+	return targets
+}
+
+// window returns true if the n instructions starting at i exist and
+// only the first one can be jumped to.
+func window(instr []Op, i int, n int, targets map[int]bool) bool {
+	if i+n > len(instr) {
+		return false
+	}
+
+	for j := i + 1; j < i+n; j++ {
+		if targets[j] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fold computes a binary operator over two constants. The second return
+// value is false if the operator is not foldable, or its result is
+// undefined.
+func fold(op int, left, right int64) (int64, bool) {
+	switch op {
+	case AND:
+		return boolInt(left != 0 && right != 0), true
+	case OR:
+		return boolInt(left != 0 || right != 0), true
+	}
+
+	n, ok, err := arith(op, left, right)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, ok
+}
+
+// foldConstants computes operators over constants at compile time:
+//
+//	PUSH a; PUSH b; ADD  =>  PUSH a+b
+//	PUSH a; MINUSU       =>  PUSH -a
+//	PUSH a; BOOL         =>  PUSH 0 or 1
+func foldConstants(instr []Op, i int, targets map[int]bool) *rewrite {
+	if instr[i].OpCode != PUSH {
+		return nil
+	}
+
+	if window(instr, i, 3, targets) && instr[i+1].OpCode == PUSH {
+		if n, ok := fold(instr[i+2].OpCode, instr[i].IntParam, instr[i+1].IntParam); ok {
+			return &rewrite{n: 3, with: []Op{{OpCode: PUSH, IntParam: n}}}
+		}
+	}
+
+	if window(instr, i, 2, targets) {
+		switch instr[i+1].OpCode {
+		case MINUSU:
+			return &rewrite{n: 2, with: []Op{{OpCode: PUSH, IntParam: -instr[i].IntParam}}}
+		case BOOL:
+			return &rewrite{n: 2, with: []Op{{OpCode: PUSH, IntParam: boolInt(instr[i].IntParam != 0)}}}
+		}
+	}
+
+	return nil
+}
+
+// simplifyIdentity drops operators that leave their left value as is,
+// e.g. 'x + 0' or 'x * 1'.
+func simplifyIdentity(instr []Op, i int, targets map[int]bool) *rewrite {
+	if !window(instr, i, 2, targets) || instr[i].OpCode != PUSH {
+		return nil
+	}
+
+	n := instr[i].IntParam
+
+	switch instr[i+1].OpCode {
+	case ADD, MINUS, BOR, BXOR, SHIFTLEFT, SHIFTRIGHT:
+		if n == 0 {
+			return &rewrite{n: 2}
+		}
+	case MUL, DIV:
+		if n == 1 {
+			return &rewrite{n: 2}
+		}
+	}
+
+	return nil
+}
+
+// removeDeadBranch drops the side of an 'and' or 'or' that can never
+// run, or the jump that is never taken, when the left side is a
+// constant.
+func removeDeadBranch(instr []Op, i int, targets map[int]bool) *rewrite {
+	if !window(instr, i, 2, targets) || instr[i].OpCode != PUSH {
+		return nil
+	}
+
+	jump := instr[i+1]
+	if jump.OpCode != JFALSE && jump.OpCode != JTRUE {
+		return nil
+	}
+
+	truthy := instr[i].IntParam != 0
+
+	// the jump is never taken, the right side decides the result
+	if (jump.OpCode == JFALSE && truthy) || (jump.OpCode == JTRUE && !truthy) {
+		return &rewrite{n: 2}
+	}
+
+	// the jump is always taken, everything up to the target is dead
+	return &rewrite{
+		n:    int(jump.IntParam) - i,
+		with: []Op{{OpCode: PUSH, IntParam: boolInt(truthy)}},
+	}
+}
+
+// removeBool drops a BOOL following an instruction that always pushes
+// 0 or 1, never undefined.
+func removeBool(instr []Op, i int, targets map[int]bool) *rewrite {
+	if !window(instr, i, 2, targets) || instr[i+1].OpCode != BOOL {
+		return nil
+	}
+
+	switch instr[i].OpCode {
+	case AND, OR, OF, BOOL, COUNTGT:
+		return &rewrite{n: 2, with: []Op{instr[i]}}
+	}
+
+	return nil
+}
+
+// fuseCountGreater merges the common '#a > n' into a single
+// instruction:
+//
+//	LOADCOUNT a; PUSH n; GT  =>  COUNTGT a n
+func fuseCountGreater(instr []Op, i int, targets map[int]bool) *rewrite {
+	if !window(instr, i, 3, targets) {
+		return nil
+	}
+
+	if instr[i].OpCode != LOADCOUNT || instr[i+1].OpCode != PUSH || instr[i+2].OpCode != GT {
+		return nil
+	}
+
+	return &rewrite{
+		n: 3,
+		with: []Op{{
+			OpCode:    COUNTGT,
+			IntParam:  instr[i].IntParam,
+			IntParam2: instr[i+1].IntParam,
+		}},
+	}
+}
+
+// fuseOffset merges loading the offset of a match at a constant index,
+// e.g. '@a' or '@a[2]', into a single instruction:
+//
+//	PUSH i; LOADOFFSET a  =>  LOADOFFSETI a i
+func fuseOffset(instr []Op, i int, targets map[int]bool) *rewrite {
+	if !window(instr, i, 2, targets) || instr[i].OpCode != PUSH || instr[i+1].OpCode != LOADOFFSET {
+		return nil
+	}
+
+	return &rewrite{
+		n: 2,
+		with: []Op{{
+			OpCode:    LOADOFFSETI,
+			IntParam:  instr[i+1].IntParam,
+			IntParam2: instr[i].IntParam,
+		}},
+	}
+}
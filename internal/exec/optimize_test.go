@@ -0,0 +1,126 @@
+package exec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  []Op
+	}{
+		{"1 + 2 * 3 == 7 or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		{"1MB == 1048576 and 2KB == 2048 or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		{"-(4 >> 1) + (1 << 3 | 1) == 7 or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		{"1 << 64 == 0 and 1 >> 70 == 0 or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		// a negative shift is undefined, it is left for the scan
+		{"1 << (0 - 1) == 0 or $a", []Op{
+			{OpCode: PUSH, IntParam: 1},
+			{OpCode: PUSH, IntParam: -1},
+			{OpCode: SHIFTLEFT},
+			{OpCode: PUSH, IntParam: 0},
+			{OpCode: EQUAL},
+			{OpCode: JTRUE, IntParam: 8},
+			{OpCode: LOADCOUNT, IntParam: 0},
+			{OpCode: BOOL},
+		}},
+		{"false and $a", []Op{{OpCode: PUSH, IntParam: 0}}},
+		{"true or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		{"true and $a", []Op{{OpCode: LOADCOUNT, IntParam: 0}, {OpCode: BOOL}}},
+		// any value other than zero is true, negative values included
+		{"(0 - 1) and $a", []Op{{OpCode: LOADCOUNT, IntParam: 0}, {OpCode: BOOL}}},
+		{"-2 or $a", []Op{{OpCode: PUSH, IntParam: 1}}},
+		{"#a > 2", []Op{{OpCode: COUNTGT, IntParam: 0, IntParam2: 2}}},
+		{"#a + 0 > 1 + 1", []Op{{OpCode: COUNTGT, IntParam: 0, IntParam2: 2}}},
+		{"@a[1] == 0", []Op{
+			{OpCode: LOADOFFSETI, IntParam: 0, IntParam2: 1},
+			{OpCode: PUSH, IntParam: 0},
+			{OpCode: EQUAL},
+		}},
+		{"$a and #a > 1", []Op{
+			{OpCode: LOADCOUNT, IntParam: 0},
+			{OpCode: JFALSE, IntParam: 3},
+			{OpCode: COUNTGT, IntParam: 0, IntParam2: 1},
+		}},
+	}
+
+	for _, test := range tests {
+		compiled, err := Compile(`
+rule Optimize {
+    strings:
+        $a = "foobar"
+    condition:
+        ` + test.condition + `
+}`)
+		if err != nil {
+			t.Fatalf("%v: %v", test.condition, err)
+		}
+
+		if instr := compiled.rules[0].instr; !reflect.DeepEqual(test.expected, instr) {
+			t.Fatalf("%v: expecting %v, got %v", test.condition, test.expected, instr)
+		}
+	}
+}
+
+// the optimized instructions must give the same result as the compiled
+// instructions
+func TestOptimizeEquivalent(t *testing.T) {
+	conditions := []string{
+		"$a and (true or $b)",
+		"($a or false) and 1 * 1 == 1",
+		"#a > 1 or #b > 0 + 0",
+		"(#a > 1 and true) != (false or #b > 1)",
+		"@a[1] + 3 == @b[1]",
+		"for any i in (1..3) : ( @a[i] + 3 == @b[i] and true )",
+		"for all of them : ( # > 1 - 1 )",
+		"2 of ($a, $b) and filesize > 1KB * 0",
+		"($a and @a[5] == 0) == false",
+		"not (10 \\ 0 == 0) or $b and true",
+		"#a << (0 - 1) == 0 or (1 << 64 == 0 and $b)",
+		"(#a - 2 and $b) or not (0 - #b)",
+	}
+
+	inputs := []string{"", "foo", "foobar", "foobar foobar", "foobarfoo bar"}
+
+	for _, condition := range conditions {
+		compiled, err := Compile(testRule("Optimize", condition, `$a = "foo"`, `$b = "bar"`))
+		if err != nil {
+			t.Fatalf("%v: %v", condition, err)
+		}
+
+		r := compiled.rules[0]
+
+		depth, err := stackDepth(r.raw)
+		if err != nil {
+			t.Fatalf("%v: %v", condition, err)
+		}
+
+		raw := &CompiledRule{instr: r.raw, depth: depth, slots: r.slots}
+
+		for _, input := range inputs {
+			scanner := compiled.NewScanner()
+			if _, err := scanner.Scan([]byte(input), false, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			data := strings.NewReader(input)
+			static := []value{{n: int64(len(input))}, undefined}
+
+			expected, err := Eval(raw, nil, scanner.stream.matches, static, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := Eval(r, nil, scanner.stream.matches, static, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected != out {
+				t.Fatalf("%v on %q: expecting %v, got %v", condition, input, expected, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+)
+
+// DefaultNamespace is the namespace of every rule, like the rules yara
+// compiles without a namespace.
+const DefaultNamespace = "default"
+
+// MaxMatchData is the most bytes of a match kept in its Data, the same
+// limit libyara uses.
+const MaxMatchData = 512
+
+// ScanOutput is a rule matching an input. It marshals to JSON with the
+// field names of the struct tags, the slices and the meta are never
+// null.
+type ScanOutput struct {
+	// the file scanned, empty for an input held in memory
+	Path string `json:"path"`
+	// the decoded view of the input the rule matched, e.g. base64@0x1f,
+	// empty for the input itself. The offsets of the strings are in the
+	// input, the data is decoded.
+	View      string                 `json:"view,omitempty"`
+	Name      string                 `json:"rule"`
+	Namespace string                 `json:"namespace"`
+	Tags      []string               `json:"tags"`
+	Meta      map[string]interface{} `json:"meta"`
+	// the string matches, only set if asked for
+	Strings []*StringMatch `json:"strings"`
+	// the errors scanning the input, set by callers reporting an input
+	// that could not be scanned in place of its rules
+	Errors []string `json:"errors"`
+	// the meta identifiers in the order they are declared
+	metaKeys []string
+}
+
+func (o ScanOutput) MarshalJSON() ([]byte, error) {
+	// a type without the method, json.Marshal would recurse otherwise
+	type plain ScanOutput
+	out := plain(o)
+
+	if out.Tags == nil {
+		out.Tags = []string{}
+	}
+
+	if out.Meta == nil {
+		out.Meta = map[string]interface{}{}
+	}
+
+	if out.Strings == nil {
+		out.Strings = []*StringMatch{}
+	}
+
+	if out.Errors == nil {
+		out.Errors = []string{}
+	}
+
+	return json.Marshal(out)
+}
+
+// MetaKeys returns the identifiers of the meta in the order the rule
+// declares them.
+func (o *ScanOutput) MetaKeys() []string {
+	return o.metaKeys
+}
+
+type StringMatch struct {
+	Name   string `json:"identifier"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	// the line and the column of the match, and the lines around it,
+	// only set by AddLines
+	Line    int           `json:"line,omitempty"`
+	Column  int           `json:"column,omitempty"`
+	Context []ContextLine `json:"context,omitempty"`
+	// the first MaxMatchData bytes of the match, nil if the input can
+	// not be read back, e.g. a stream
+	Data []byte `json:"-"`
+	// the string is a hex string
+	hex bool
+}
+
+func (s StringMatch) String() string {
+	return fmt.Sprintf("0x%x:%v", s.Offset, s.Name)
+}
+
+// DataString returns the data the way yara prints it, the bytes of a hex
+// string in hex, e.g. '4D 5A', and the others as text with the
+// unprintable bytes escaped, e.g. 'MZ\x90'.
+func (s StringMatch) DataString() string {
+	if s.hex {
+		parts := make([]string, len(s.Data))
+		for i, b := range s.Data {
+			parts[i] = fmt.Sprintf("%02X", b)
+		}
+
+		return strings.Join(parts, " ")
+	}
+
+	var builder strings.Builder
+
+	for _, b := range s.Data {
+		switch {
+		case b == '\\' || b == '"':
+			builder.WriteByte('\\')
+			builder.WriteByte(b)
+		case b >= 0x20 && b < 0x7f:
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "\\x%02X", b)
+		}
+	}
+
+	return builder.String()
+}
+
+func (s StringMatch) MarshalJSON() ([]byte, error) {
+	type plain StringMatch
+
+	return json.Marshal(struct {
+		plain
+		Data string `json:"data"`
+	}{plain(s), s.DataString()})
+}
+
+// stringMatches returns the matches of the strings of the rule, reading
+// their data from the input if it is not nil.
+func (r *CompiledRule) stringMatches(matches []*[]Match, data io.ReaderAt) []*StringMatch {
+	out := make([]*StringMatch, 0)
+
+	for _, str := range r.strings {
+		if lst := matches[str.index]; lst != nil {
+			for _, match := range *lst {
+				out = append(out, &StringMatch{
+					Name:   str.name,
+					Offset: match.Offset,
+					Length: match.Length,
+					Data:   matchData(data, match),
+					hex:    str.hex,
+				})
+			}
+		}
+	}
+
+	return out
+}
+
+func matchData(data io.ReaderAt, match Match) []byte {
+	if data == nil {
+		return nil
+	}
+
+	size := match.Length
+	if size > MaxMatchData {
+		size = MaxMatchData
+	}
+
+	buf := make([]byte, size)
+
+	n, err := data.ReadAt(buf, int64(match.Offset))
+	if err != nil && err != io.EOF {
+		return nil
+	}
+
+	return buf[:n]
+}
+
+// output returns the output of the rule for a scan. The tags and the
+// meta are copies, a caller changing them does not change the rule or
+// the outputs of other scans.
+func (r *CompiledRule) output() *ScanOutput {
+	meta := make(map[string]interface{}, len(r.meta))
+	for key, value := range r.meta {
+		meta[key] = value
+	}
+
+	return &ScanOutput{
+		Name:      r.name,
+		Namespace: DefaultNamespace,
+		Tags:      append(make([]string, 0, len(r.tags)), r.tags...),
+		Meta:      meta,
+		metaKeys:  append(make([]string, 0, len(r.metaKeys)), r.metaKeys...),
+	}
+}
+
+// ruleMeta returns the meta of a rule by identifier and the identifiers
+// in the order they are declared, the values are strings, integers or
+// bools. The last value of a repeated identifier wins.
+func ruleMeta(rule *ast.Rule) (map[string]interface{}, []string) {
+	meta := make(map[string]interface{})
+	keys := make([]string, 0)
+
+	for _, node := range rule.Meta {
+		assign, ok := node.(*ast.Assignment)
+		if !ok {
+			continue
+		}
+
+		if _, ok := meta[assign.Left]; !ok {
+			keys = append(keys, assign.Left)
+		}
+
+		switch v := assign.Right.(type) {
+		case *ast.String:
+			meta[assign.Left] = v.Value
+		case *ast.Integer:
+			meta[assign.Left] = v.Value
+		case *ast.Bool:
+			meta[assign.Left] = v.Value
+		case *ast.Prefix:
+			if i, ok := v.Right.(*ast.Integer); ok && v.Token.Type == lexer.MINUS {
+				meta[assign.Left] = -i.Value
+			}
+		}
+	}
+
+	return meta, keys
+}
@@ -0,0 +1,187 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+)
+
+// required returns the match indexes of the strings a condition needs,
+// at least one of them must have matched for the condition to be true.
+// A nil result means the condition can be true without any string
+// matching, e.g. 'filesize < 10' or 'not $a', and the rule is always
+// evaluated.
+//
+// This must run before compileNode, which rewrites the variables of the
+// condition.
+func (c *compiler) required(ruleName string, node ast.Node) []int {
+
+	switch n := node.(type) {
+	case *ast.Variable:
+		if strings.HasPrefix(n.Value, "$") {
+			return c.stringIndex(ruleName, n.Value)
+		}
+
+	case *ast.Prefix:
+		if n.Token.Type == lexer.LPAREN {
+			return c.required(ruleName, n.Right)
+		}
+
+	case *ast.With:
+		return c.required(ruleName, n.Body)
+
+	case *ast.Infix:
+		switch n.Token.Type {
+		case lexer.AND:
+			left := c.required(ruleName, n.Left)
+			right := c.required(ruleName, n.Right)
+
+			// either side is enough, keep the one with the fewest
+			// strings to check
+			if left == nil || (right != nil && len(right) < len(left)) {
+				return right
+			}
+
+			return left
+
+		case lexer.OR:
+			left := c.required(ruleName, n.Left)
+			right := c.required(ruleName, n.Right)
+
+			if left == nil || right == nil {
+				return nil
+			}
+
+			return append(left, right...)
+
+		case lexer.AT, lexer.IN:
+			if v, ok := n.Left.(*ast.Variable); ok {
+				return c.stringIndex(ruleName, v.Value)
+			}
+
+			// 'any of them in (0..100)' needs what 'any of them' needs
+			if of, ok := n.Left.(*ast.Infix); ok && of.Token.Type == lexer.OF {
+				return c.requiredOf(ruleName, of)
+			}
+
+		case lexer.GT, lexer.GTE, lexer.EQUAL:
+			v, ok := n.Left.(*ast.Variable)
+			if !ok || !strings.HasPrefix(v.Value, "#") {
+				return nil
+			}
+
+			integer, ok := n.Right.(*ast.Integer)
+			if !ok {
+				return nil
+			}
+
+			// '#a > 0' and '#a >= 1' need a match, '#a >= 0' does not
+			if integer.Value >= 1 || (n.Token.Type == lexer.GT && integer.Value >= 0) {
+				return c.stringIndex(ruleName, v.Value)
+			}
+
+		case lexer.OF:
+			return c.requiredOf(ruleName, n)
+		}
+	}
+
+	return nil
+}
+
+// requiredOf returns the match indexes needed by 'n of (...)'.
+func (c *compiler) requiredOf(ruleName string, infix *ast.Infix) []int {
+
+	switch left := infix.Left.(type) {
+	case *ast.Integer:
+		if left.Value < 1 {
+			return nil
+		}
+	case *ast.Percentage:
+	case *ast.Keyword:
+		if left.Token.Type != lexer.ANY && left.Token.Type != lexer.ALL {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var names []string
+
+	set := infix.Right
+	if prefix, ok := set.(*ast.Prefix); ok && prefix.Token.Type == lexer.LPAREN {
+		set = prefix.Right
+	}
+
+	switch right := set.(type) {
+	case *ast.Keyword:
+		if right.Token.Type != lexer.THEM {
+			return nil
+		}
+		names = c.patternsInRule(ruleName)
+
+	case *ast.Set:
+		for _, node := range right.Nodes {
+			if _, ok := node.(*ast.Variable); !ok {
+				return nil
+			}
+		}
+		names = c.setToStringSlice(ruleName, right)
+
+	case *ast.Variable:
+		names = c.setToStringSlice(ruleName, &ast.Set{Nodes: []ast.Node{right}})
+
+	default:
+		return nil
+	}
+
+	// 'all of them' in a rule without strings is always true
+	if len(names) == 0 {
+		return nil
+	}
+
+	out := make([]int, 0, len(names))
+	for _, name := range names {
+		p, ok := c.mappings[name]
+		if !ok {
+			return nil
+		}
+
+		out = append(out, p.MatchIndex)
+	}
+
+	return out
+}
+
+// stringIndex returns the match index of a single string, referenced as
+// $a, #a or @a.
+func (c *compiler) stringIndex(ruleName string, value string) []int {
+	if len(value) < 2 || strings.HasSuffix(value, "*") {
+		return nil
+	}
+
+	name := fmt.Sprintf("%v_$%v", ruleName, value[1:])
+
+	if p, ok := c.mappings[name]; ok {
+		return []int{p.MatchIndex}
+	}
+
+	return nil
+}
+
+// prefiltered reports whether a rule can be skipped, none of the strings
+// its condition requires matched.
+func (r *CompiledRule) prefiltered(matches []*[]Match) bool {
+	if r.required == nil {
+		return false
+	}
+
+	for _, index := range r.required {
+		if lst := matches[index]; lst != nil && len(*lst) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
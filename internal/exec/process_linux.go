@@ -0,0 +1,98 @@
+//go:build linux
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// region is a mapped range of a process's virtual memory.
+type region struct {
+	start int64
+	end   int64
+}
+
+// processRegions returns the readable memory regions of a process
+// listed in /proc/<pid>/maps.
+func processRegions(pid int) ([]region, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%v/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	regions := make([]region, 0)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 55d0c7a00000-55d0c7a21000 r-xp 00000000 08:01 1234 /usr/bin/foo
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "r") {
+			continue
+		}
+
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+
+		start, err := strconv.ParseUint(bounds[0], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		end, err := strconv.ParseUint(bounds[1], 16, 64)
+		if err != nil || end <= start {
+			continue
+		}
+
+		regions = append(regions, region{start: int64(start), end: int64(end)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return regions, nil
+}
+
+// ScanProcessWithCallback scans the readable memory of a running
+// process. Each region is read through /proc/<pid>/mem and match
+// offsets are the virtual addresses of the matches. Matches do not span
+// regions, and regions that cannot be read are skipped. Each rule is
+// handed to fn as soon as its condition is evaluated, see
+// ScanWithCallback.
+func (sc *Scanner) ScanProcessWithCallback(pid int, s bool, timeout int, fn Callback) error {
+	regions, err := processRegions(pid)
+	if err != nil {
+		return err
+	}
+
+	mem, err := os.Open(fmt.Sprintf("/proc/%v/mem", pid))
+	if err != nil {
+		return err
+	}
+	defer mem.Close()
+
+	deadline := scanDeadline(timeout)
+	sc.stream.clear()
+
+	for _, region := range regions {
+		sc.stream.reset()
+
+		r := io.NewSectionReader(mem, region.start, region.end-region.start)
+
+		if _, err := sc.stream.feed(r, int(region.start), ChunkSize, deadline); err == ErrTimeout {
+			sc.flushProfile()
+			return err
+		}
+	}
+
+	// there is no file, filesize is zero for a process
+	return sc.evaluate(0, mem, s, deadline, fn)
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package exec
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestScanProcess(t *testing.T) {
+	rule := `rule Marker {
+    strings:
+        $a = "go-yara process marker"
+    condition:
+        $a
+}`
+
+	compiled, err := Compile(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// build the marker at runtime so it lives on the heap
+	marker := []byte("go-yara process ")
+	marker = append(marker, []byte("marker")...)
+	address := int(uintptr(unsafe.Pointer(&marker[0])))
+
+	out, err := compiled.ScanProcess(os.Getpid(), true, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.KeepAlive(marker)
+
+	if len(out) == 0 {
+		t.Fatal("failed to find marker in process memory")
+	}
+
+	found := false
+	for _, str := range out[0].Strings {
+		if str.Offset == address {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("expecting a match at virtual address 0x%x", address)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package exec
+
+import (
+	"errors"
+)
+
+// ScanProcessWithCallback scans the memory of a running process, this
+// is only supported on Linux.
+func (sc *Scanner) ScanProcessWithCallback(pid int, s bool, timeout int, fn Callback) error {
+	return errors.New("exec: process scanning is only supported on linux")
+}
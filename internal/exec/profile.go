@@ -0,0 +1,177 @@
+package exec
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Profile is the work done by the scans of rules compiled with
+// Compiler.Profile, summed over every scan since they were compiled.
+type Profile struct {
+	// the scans counted, including the scans that failed, e.g. timed
+	// out
+	Scans int64
+	// the rules, the slowest first
+	Rules []RuleProfile
+	// the strings, the ones verified the most first
+	Strings []StringProfile
+}
+
+// RuleProfile is the work done evaluating the condition of a rule. A
+// rule whose required strings did not match is false without running
+// its instructions, it is not counted as an evaluation.
+type RuleProfile struct {
+	Name         string
+	Evaluations  int64
+	Instructions int64
+	Time         time.Duration
+}
+
+// StringProfile is the work done finding the matches of a string.
+//
+// Hits are the atoms of the string the automata found, or every offset
+// of the input for a string without an atom. Verifications are the hits
+// that had to be confirmed against the input, the whole string for
+// strings longer than their atom or the regex for regexes. Matches are
+// the matches recorded.
+//
+// Identical strings share their pattern, their counts are those of the
+// pattern and are the same for every rule declaring the string.
+type StringProfile struct {
+	Rule          string
+	Name          string
+	Hits          int64
+	Verifications int64
+	Matches       int64
+}
+
+type ruleCounters struct {
+	evaluations  int64
+	instructions int64
+	time         time.Duration
+}
+
+type stringCounters struct {
+	hits          int64
+	verifications int64
+	matches       int64
+}
+
+// counters are the counts of a profile, by rule index and by match
+// index. A Scanner counts into its own, the profiler of the rules sums
+// them once the scan is done.
+type counters struct {
+	rules   []ruleCounters
+	strings []stringCounters
+}
+
+func newCounters(rules *CompiledRules) *counters {
+	return &counters{
+		rules:   make([]ruleCounters, len(rules.rules)),
+		strings: make([]stringCounters, rules.patternCount),
+	}
+}
+
+// profiler sums the counters of the scans sharing the compiled rules.
+type profiler struct {
+	mu    sync.Mutex
+	scans int64
+	total *counters
+}
+
+// add sums c into the profile and zeroes it for the next scan.
+func (p *profiler) add(c *counters) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scans++
+
+	for i := range c.rules {
+		p.total.rules[i].evaluations += c.rules[i].evaluations
+		p.total.rules[i].instructions += c.rules[i].instructions
+		p.total.rules[i].time += c.rules[i].time
+		c.rules[i] = ruleCounters{}
+	}
+
+	for i := range c.strings {
+		p.total.strings[i].hits += c.strings[i].hits
+		p.total.strings[i].verifications += c.strings[i].verifications
+		p.total.strings[i].matches += c.strings[i].matches
+		c.strings[i] = stringCounters{}
+	}
+}
+
+// Profile returns the work done by the scans so far, nil if the rules
+// were not compiled with Compiler.Profile. It is safe to call while
+// scans are running, the scans still running are not counted yet.
+func (c *CompiledRules) Profile() *Profile {
+	if c.profiler == nil {
+		return nil
+	}
+
+	p := c.profiler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	profile := &Profile{
+		Scans:   p.scans,
+		Rules:   make([]RuleProfile, 0, len(c.rules)),
+		Strings: make([]StringProfile, 0),
+	}
+
+	for i, rule := range c.rules {
+		counts := p.total.rules[i]
+
+		profile.Rules = append(profile.Rules, RuleProfile{
+			Name:         rule.name,
+			Evaluations:  counts.evaluations,
+			Instructions: counts.instructions,
+			Time:         counts.time,
+		})
+
+		for _, str := range rule.strings {
+			counts := p.total.strings[str.index]
+
+			profile.Strings = append(profile.Strings, StringProfile{
+				Rule:          rule.name,
+				Name:          str.name,
+				Hits:          counts.hits,
+				Verifications: counts.verifications,
+				Matches:       counts.matches,
+			})
+		}
+	}
+
+	sort.SliceStable(profile.Rules, func(i, j int) bool {
+		return profile.Rules[i].Time > profile.Rules[j].Time
+	})
+
+	sort.SliceStable(profile.Strings, func(i, j int) bool {
+		a, b := profile.Strings[i], profile.Strings[j]
+		if a.Verifications != b.Verifications {
+			return a.Verifications > b.Verifications
+		}
+
+		return a.Hits > b.Hits
+	})
+
+	return profile
+}
+
+// flushProfile adds the counts of the scan to the profile of the rules,
+// the matches are counted from the match lists of the scan.
+func (sc *Scanner) flushProfile() {
+	c := sc.stream.counters
+	if c == nil {
+		return
+	}
+
+	for i, lst := range sc.stream.matches {
+		if lst != nil {
+			c.strings[i].matches += int64(len(*lst))
+		}
+	}
+
+	sc.rules.profiler.add(c)
+}
@@ -0,0 +1,351 @@
+package exec
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+type EventType int
+
+const (
+	RuleMatching EventType = iota
+	RuleNotMatching
+	ModuleImported
+	ScanFinished
+)
+
+func (e EventType) String() string {
+	switch e {
+	case RuleMatching:
+		return "RuleMatching"
+	case RuleNotMatching:
+		return "RuleNotMatching"
+	case ModuleImported:
+		return "ModuleImported"
+	case ScanFinished:
+		return "ScanFinished"
+	default:
+		return "WAT"
+	}
+}
+
+// Action is returned by a Callback to tell the scan how to proceed.
+type Action int
+
+const (
+	Continue Action = iota
+	Abort
+)
+
+// Event is handed to a Callback as the scan progresses, mirroring the
+// callback messages of libyara.
+type Event struct {
+	Type EventType
+	// the rule for RuleMatching and RuleNotMatching events. Strings are
+	// only set for matching rules.
+	Rule *ScanOutput
+	// the module name for ModuleImported events
+	Module string
+}
+
+// Callback receives the events of a scan. Returning Abort stops the
+// scan, no further events are sent.
+type Callback func(Event) Action
+
+// Scanner scans inputs against a set of compiled rules. The buffers a
+// scan needs, e.g. the match lists and the stream window, are kept and
+// reset between scans instead of being allocated for every input.
+//
+// A Scanner is not safe for concurrent use, create one per goroutine.
+// The CompiledRules it is created from are never modified once
+// compiled and can be shared by any number of scanners.
+type Scanner struct {
+	rules  *CompiledRules
+	stream *stream
+	static []value
+	// stack of the instructions, sized for the deepest rule
+	stack []value
+}
+
+// NewScanner creates a Scanner for the compiled rules.
+func (c *CompiledRules) NewScanner() *Scanner {
+	return &Scanner{
+		rules:  c,
+		stream: newStream(c),
+		static: make([]value, 0, staticRules+len(c.rules)),
+		stack:  make([]value, c.maxDepth),
+	}
+}
+
+// Scan scans the input with a Scanner from the pool of the compiled
+// rules. It is safe to call from multiple goroutines.
+func (c *CompiledRules) Scan(input []byte, s bool, timeout int) ([]*ScanOutput, error) {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.Scan(input, s, timeout)
+}
+
+// ScanReader scans the input read from r in chunks, without holding the
+// whole input in memory. If r is also an io.ReaderAt, it is used to read
+// integers from the input, e.g. uint32(0).
+func (c *CompiledRules) ScanReader(r io.Reader, s bool, timeout int) ([]*ScanOutput, error) {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanReader(r, s, timeout)
+}
+
+// ScanFile scans the file at path.
+func (c *CompiledRules) ScanFile(path string, s bool, timeout int) ([]*ScanOutput, error) {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanFile(path, s, timeout)
+}
+
+// ScanFileWithCallback scans the file at path with a Scanner from the
+// pool of the compiled rules, see Scanner.ScanFileWithCallback.
+func (c *CompiledRules) ScanFileWithCallback(path string, s bool, timeout int, fn Callback) error {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanFileWithCallback(path, s, timeout, fn)
+}
+
+// ScanProcess scans the readable memory of a running process.
+func (c *CompiledRules) ScanProcess(pid int, s bool, timeout int) ([]*ScanOutput, error) {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanProcess(pid, s, timeout)
+}
+
+// ScanProcessWithCallback scans the readable memory of a running process
+// with a Scanner from the pool of the compiled rules, see
+// Scanner.ScanProcessWithCallback.
+func (c *CompiledRules) ScanProcessWithCallback(pid int, s bool, timeout int, fn Callback) error {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanProcessWithCallback(pid, s, timeout, fn)
+}
+
+func (c *CompiledRules) scanReader(r io.Reader, data io.ReaderAt, chunkSize int, s bool, timeout int) ([]*ScanOutput, error) {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	output := make([]*ScanOutput, 0)
+	if err := scanner.scanReader(r, data, chunkSize, s, timeout, collect(&output)); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// ScanWithCallback scans the input with a Scanner from the pool of the
+// compiled rules, see Scanner.ScanWithCallback.
+func (c *CompiledRules) ScanWithCallback(input []byte, s bool, timeout int, fn Callback) error {
+	scanner := c.pool.Get().(*Scanner)
+	defer c.pool.Put(scanner)
+
+	return scanner.ScanWithCallback(input, s, timeout, fn)
+}
+
+// Scan scans an input held in memory.
+func (sc *Scanner) Scan(input []byte, s bool, timeout int) ([]*ScanOutput, error) {
+	output := make([]*ScanOutput, 0)
+
+	err := sc.ScanWithCallback(input, s, timeout, collect(&output))
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// ScanWithCallback scans an input held in memory, handing each rule to
+// fn as soon as its condition is evaluated. The scan stops early if fn
+// returns Abort.
+func (sc *Scanner) ScanWithCallback(input []byte, s bool, timeout int, fn Callback) error {
+
+	deadline := scanDeadline(timeout)
+	sc.stream.clear()
+
+	// the input belongs to the caller, e.g. a mapped file unmapped once
+	// the scan returns, do not hold on to it
+	defer func() {
+		sc.stream.window = nil
+	}()
+
+	// the whole input is the window, only the automata run chunk by
+	// chunk so the timeout can be checked
+	for from := 0; from < len(input); from += ChunkSize {
+		to := from + ChunkSize
+		if to > len(input) {
+			to = len(input)
+		}
+
+		sc.stream.scan(input, 0, from, to, true)
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			sc.flushProfile()
+			return ErrTimeout
+		}
+	}
+
+	return sc.evaluate(len(input), bytes.NewReader(input), s, deadline, fn)
+}
+
+// ScanFile scans the file at path, the outputs have the path of the
+// file.
+func (sc *Scanner) ScanFile(path string, s bool, timeout int) ([]*ScanOutput, error) {
+	output := make([]*ScanOutput, 0)
+	if err := sc.ScanFileWithCallback(path, s, timeout, collect(&output)); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// ScanFileWithCallback scans the file at path, handing each rule to fn
+// as soon as its condition is evaluated, see ScanWithCallback. The rules
+// have the path of the file.
+func (sc *Scanner) ScanFileWithCallback(path string, s bool, timeout int, fn Callback) error {
+	return sc.scanFile(path, s, timeout, func(event Event) Action {
+		if event.Rule != nil {
+			event.Rule.Path = path
+		}
+
+		return fn(event)
+	})
+}
+
+// ScanReader scans the input read from r in chunks, without holding the
+// whole input in memory. If r is also an io.ReaderAt, it is used to read
+// integers from the input, e.g. uint32(0).
+func (sc *Scanner) ScanReader(r io.Reader, s bool, timeout int) ([]*ScanOutput, error) {
+	data, _ := r.(io.ReaderAt)
+
+	output := make([]*ScanOutput, 0)
+	if err := sc.scanReader(r, data, ChunkSize, s, timeout, collect(&output)); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// ScanProcess scans the readable memory of a running process, see
+// ScanProcessWithCallback.
+func (sc *Scanner) ScanProcess(pid int, s bool, timeout int) ([]*ScanOutput, error) {
+	output := make([]*ScanOutput, 0)
+	if err := sc.ScanProcessWithCallback(pid, s, timeout, collect(&output)); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (sc *Scanner) scanReader(r io.Reader, data io.ReaderAt, chunkSize int, s bool, timeout int, fn Callback) error {
+
+	deadline := scanDeadline(timeout)
+	sc.stream.clear()
+
+	n, err := sc.stream.feed(r, 0, chunkSize, deadline)
+	if err != nil {
+		sc.flushProfile()
+		return err
+	}
+
+	return sc.evaluate(n, data, s, deadline, fn)
+}
+
+// collect returns a Callback appending each matching rule to output.
+func collect(output *[]*ScanOutput) Callback {
+	return func(event Event) Action {
+		if event.Type == RuleMatching {
+			*output = append(*output, event.Rule)
+		}
+
+		return Continue
+	}
+}
+
+// evaluate runs the condition of each rule against the matches found in
+// the input, sending the events of the scan to fn. A condition looping
+// past the deadline stops the scan with ErrTimeout.
+func (sc *Scanner) evaluate(filesize int, data io.ReaderAt, s bool, deadline time.Time, fn Callback) error {
+
+	matches := sc.stream.matches
+	counters := sc.stream.counters
+
+	normalizeMatches(matches)
+	defer sc.flushProfile()
+
+	entry := undefined
+	if sc.rules.entryPoint {
+		entry = entryPoint(data, int64(filesize))
+	}
+
+	sc.static = append(sc.static[:0], value{n: int64(filesize)}, entry)
+
+	for _, name := range sc.rules.imports {
+		if fn(Event{Type: ModuleImported, Module: name}) == Abort {
+			return nil
+		}
+	}
+
+	for i, rule := range sc.rules.rules {
+		// rules whose required strings did not match are false without
+		// running their instructions
+		out := int64(0)
+
+		if !rule.prefiltered(matches) {
+			var start time.Time
+			if counters != nil {
+				start = time.Now()
+			}
+
+			var executed int64
+			var err error
+			out, executed, err = eval(rule, sc.stack, matches, sc.static, data, deadline)
+
+			if counters != nil {
+				counts := &counters.rules[i]
+				counts.evaluations++
+				counts.instructions += executed
+				counts.time += time.Since(start)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		scanOutput := rule.output()
+
+		event := Event{Type: RuleNotMatching, Rule: scanOutput}
+
+		if out != 0 {
+			event.Type = RuleMatching
+
+			if s {
+				scanOutput.Strings = rule.stringMatches(matches, data)
+			}
+
+		}
+
+		// add this rule to the global state for other rules to
+		// reference
+		sc.static = append(sc.static, value{n: boolInt(out != 0)})
+
+		if fn(event) == Abort {
+			return nil
+		}
+	}
+
+	fn(Event{Type: ScanFinished})
+
+	return nil
+}
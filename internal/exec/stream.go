@@ -0,0 +1,336 @@
+package exec
+
+import (
+	"io"
+	"time"
+)
+
+// RegexScanLimit is the longest match, in bytes, a regex string can
+// confirm counting from the start of its prefix. Bounding regexes keeps
+// a streaming scan from buffering unbounded input, and is the same limit
+// libyara uses.
+const RegexScanLimit = 4096
+
+// ChunkSize is the number of input bytes handed to the automata at once.
+// Timeouts are checked between chunks.
+const ChunkSize = 1 << 20
+
+type Match struct {
+	Offset int
+	Length int
+}
+
+// pending is an atom hit whose verification needs input past the end
+// of the current window.
+type pending struct {
+	output *ACOutput
+	start  int
+}
+
+// stream holds the state of the automata across chunks of input. The
+// current node of each automaton and any partial matches waiting on
+// more input carry from one chunk to the next, so feeding the input in
+// chunks finds the same matches as feeding it all at once.
+type stream struct {
+	rules      *CompiledRules
+	matches    []*[]Match
+	node       *ACNode
+	nodeNocase *ACNode
+	pending    []pending
+	// input available to verify matches, window[0] is at offset base
+	// of the input
+	window []byte
+	base   int
+	// no input follows the end of the window
+	eof bool
+	// buffer holding the window when reading input, reused by each
+	// call to feed
+	buf []byte
+	// the work of the scan, nil unless the rules are profiled
+	counters *counters
+}
+
+// maxReusedMatches is the capacity above which a match list is dropped
+// rather than reused by the next scan.
+const maxReusedMatches = 1024
+
+func newStream(rules *CompiledRules) *stream {
+	s := &stream{
+		rules:   rules,
+		matches: make([]*[]Match, rules.patternCount),
+	}
+
+	if rules.profiler != nil {
+		s.counters = newCounters(rules)
+	}
+
+	if rules.automataCount > 0 {
+		s.node = rules.automata[0]
+	}
+
+	if rules.automataNocaseCount > 0 {
+		s.nodeNocase = rules.automataNocase[0]
+	}
+
+	return s
+}
+
+// scan runs the automata over window[from:to]. Matches are verified
+// against the whole window, bytes before from are input that was already
+// scanned and kept around for verifying matches that cross chunks.
+func (s *stream) scan(window []byte, base, from, to int, eof bool) {
+	s.window = window
+	s.base = base
+	s.eof = eof
+
+	if len(s.pending) > 0 {
+		waiting := s.pending
+		s.pending = nil
+
+		for _, p := range waiting {
+			s.verify(p.output, p.start)
+		}
+	}
+
+	if s.node != nil {
+		s.node = s.next(s.rules.automata[0], s.node, from, to, false)
+	}
+
+	if s.nodeNocase != nil {
+		s.nodeNocase = s.next(s.rules.automataNocase[0], s.nodeNocase, from, to, true)
+	}
+}
+
+// feed reads r to the end in chunks of chunkSize and scans each chunk.
+// The first byte read from r is at offset base of the input. feed
+// returns the number of bytes read, if reading fails the bytes read so
+// far are still scanned before the error is returned.
+func (s *stream) feed(r io.Reader, base int, chunkSize int, deadline time.Time) (int, error) {
+
+	buf := s.buf[:0]
+	if cap(buf) < s.rules.lookBehind+chunkSize {
+		buf = make([]byte, 0, s.rules.lookBehind+chunkSize)
+	}
+
+	// hand the buffer back for the next call, the window must not
+	// outlive the call either way
+	defer func() {
+		if cap(buf) <= 2*(s.rules.lookBehind+chunkSize) {
+			s.buf = buf[:0]
+		}
+		s.window = nil
+	}()
+
+	start := base
+
+	for {
+		// matches waiting on more input can grow the window past the
+		// look behind
+		if cap(buf)-len(buf) < chunkSize {
+			temp := make([]byte, len(buf), 2*cap(buf)+chunkSize)
+			copy(temp, buf)
+			buf = temp
+		}
+
+		from := len(buf)
+		n, err := io.ReadFull(r, buf[from:from+chunkSize])
+		buf = buf[:from+n]
+
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.scan(buf, base, from, len(buf), true)
+			return base + len(buf) - start, err
+		}
+
+		eof := err != nil
+		s.scan(buf, base, from, len(buf), eof)
+
+		if eof {
+			break
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return base + len(buf) - start, ErrTimeout
+		}
+
+		// drop the input that can no longer be part of a match
+		keep := s.retain() - base
+		copy(buf, buf[keep:])
+		buf = buf[:len(buf)-keep]
+		base += keep
+	}
+
+	return base + len(buf) - start, nil
+}
+
+// reset moves the automata back to their roots, the next input scanned
+// does not continue the input scanned so far.
+func (s *stream) reset() {
+	if s.node != nil {
+		s.node = s.rules.automata[0]
+	}
+
+	if s.nodeNocase != nil {
+		s.nodeNocase = s.rules.automataNocase[0]
+	}
+
+	s.pending = nil
+}
+
+// clear readies the stream for a new input. The match lists are kept
+// for reuse, unless they grew large.
+func (s *stream) clear() {
+	s.reset()
+	s.window = nil
+	s.base = 0
+
+	for i, lst := range s.matches {
+		if lst == nil {
+			continue
+		}
+
+		if cap(*lst) > maxReusedMatches {
+			s.matches[i] = nil
+		} else {
+			*lst = (*lst)[:0]
+		}
+	}
+}
+
+// retain returns the offset of the first input byte that must be kept
+// in the window for the next chunk.
+func (s *stream) retain() int {
+	keep := s.base + len(s.window) - s.rules.lookBehind
+
+	for _, p := range s.pending {
+		if p.start < keep {
+			keep = p.start
+		}
+	}
+
+	if keep < s.base {
+		keep = s.base
+	}
+
+	return keep
+}
+
+// next performs the byte transitions of an automaton over
+// window[from:to] and returns the node it stopped on.
+func (s *stream) next(root *ACNode, node *ACNode, from, to int, nocase bool) *ACNode {
+
+	for i := from; i < to; i++ {
+		b := s.window[i]
+		if nocase {
+			b = ToLower(b)
+		}
+
+		// jump to each failure node until a next matching
+		// transition node is found, or back at the root.
+		for node.children[b] == nil && node != root {
+			node = node.fail
+		}
+
+		if next := node.children[b]; next != nil {
+			node = next
+		}
+
+		// patterns without an atom are verified at every offset
+		for _, output := range root.outputs {
+			if s.counters != nil {
+				s.counters.strings[output.matchIndex].hits++
+			}
+
+			s.verify(output, s.base+i)
+		}
+
+		// check this node and each alternative matching node
+		for temp := node; temp != nil && temp != root; temp = temp.alternative {
+			for _, output := range temp.outputs {
+				if s.counters != nil {
+					s.counters.strings[output.matchIndex].hits++
+				}
+
+				s.verify(output, s.base+i-temp.matchOffset-output.atomOffset)
+			}
+		}
+	}
+
+	return node
+}
+
+// verify confirms an output whose atom was found in the input and
+// records the match. Verifications needing input past the end of the
+// window wait until the next chunk.
+func (s *stream) verify(output *ACOutput, start int) {
+	if start < s.base {
+		return
+	}
+
+	// in fast mode a string that matched once is not verified again
+	if s.rules.fast {
+		if lst := s.matches[output.matchIndex]; lst != nil && len(*lst) > 0 {
+			return
+		}
+	}
+
+	end := s.base + len(s.window)
+	offset := start - s.base
+
+	if output.fullMatch != nil {
+		if start+len(output.fullMatch) > end {
+			if !s.eof {
+				s.pending = append(s.pending, pending{output: output, start: start})
+			}
+			return
+		}
+
+		if s.counters != nil {
+			s.counters.strings[output.matchIndex].verifications++
+		}
+
+		for j, part := range output.fullMatch {
+			if part&0x1000 == 0x1000 {
+				continue
+			}
+
+			if byte(part) != s.window[offset+j] {
+				return
+			}
+		}
+
+		s.record(output.matchIndex, start, len(output.fullMatch))
+		return
+	}
+
+	if output.re != nil {
+		limit := start + RegexScanLimit
+		if limit > end {
+			if !s.eof {
+				s.pending = append(s.pending, pending{output: output, start: start})
+				return
+			}
+
+			limit = end
+		}
+
+		if s.counters != nil {
+			s.counters.strings[output.matchIndex].verifications++
+		}
+
+		if index := output.re.FindIndex(s.window[offset : limit-s.base]); index != nil {
+			s.record(output.matchIndex, start+index[0], index[1]-index[0])
+		}
+
+		return
+	}
+
+	s.record(output.matchIndex, start, output.length)
+}
+
+func (s *stream) record(index int, offset int, length int) {
+	if lst := s.matches[index]; lst != nil {
+		*lst = append(*lst, Match{Offset: offset, Length: length})
+	} else {
+		s.matches[index] = &[]Match{{Offset: offset, Length: length}}
+	}
+}
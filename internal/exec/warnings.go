@@ -0,0 +1,130 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+)
+
+// warn records a warning about a node of a rule, at the start of the
+// rule if the node has no position.
+func (c *compiler) warn(rule *ast.Rule, node ast.Node, msg string) {
+	c.warnings.add(rule, at(node, errors.New(msg)))
+}
+
+// warnString warns about a string that is slow to scan for or that is
+// declared twice in the same rule. hash identifies the bytes and
+// modifiers of the string.
+func (c *compiler) warnString(rule *ast.Rule, assign *ast.Assignment, bytePattern *ast.BytePattern, hash string) {
+	for _, warning := range bytePattern.Warnings {
+		c.warnings.add(rule, warning)
+	}
+
+	if name, ok := c.ruleHashes[hash]; ok {
+		c.warn(rule, assign, fmt.Sprintf("duplicate string %v, same as %v", assign.Left, name))
+	} else {
+		c.ruleHashes[hash] = assign.Left
+	}
+
+	// the atom of a text string is its best window of bytes
+	if _, ok := assign.Right.(*ast.String); ok {
+		pattern := bytePattern.Patterns[0]
+
+		ints := make([]int, len(pattern))
+		for i, b := range pattern {
+			ints[i] = int(b)
+		}
+
+		if _, _, quality := ast.SelectAtom(ints); quality < ast.MinAtomQuality {
+			c.warn(rule, assign, fmt.Sprintf("slow string %v, atoms are too common", assign.Left))
+		}
+	}
+}
+
+// warnCondition warns about slow ways a condition uses its strings.
+// This must run before compileNode, which rewrites the variables of the
+// condition.
+func (c *compiler) warnCondition(rule *ast.Rule) {
+
+	strs := make(map[string]*ast.Assignment)
+	for _, node := range rule.Strings {
+		if assign, ok := node.(*ast.Assignment); ok {
+			strs[assign.Left] = assign
+		}
+	}
+
+	ast.Walk(rule.Condition, func(node ast.Node) bool {
+		if infix, ok := node.(*ast.Infix); ok {
+			c.warnAtZero(rule, infix, strs)
+		}
+
+		return true
+	})
+}
+
+// warnAtZero warns about '$a at 0' on a nocase wide string, every
+// offset of the input is scanned for the string while comparing the
+// first bytes, e.g. with uint16(0), is enough.
+func (c *compiler) warnAtZero(rule *ast.Rule, infix *ast.Infix, strs map[string]*ast.Assignment) {
+	if infix.Token.Type != lexer.AT {
+		return
+	}
+
+	v, ok := infix.Left.(*ast.Variable)
+	if !ok {
+		return
+	}
+
+	offset, ok := infix.Right.(*ast.Integer)
+	if !ok || offset.Value != 0 {
+		return
+	}
+
+	assign, ok := strs[v.Value]
+	if !ok {
+		return
+	}
+
+	_, nocase := assign.Attributes[lexer.NOCASE]
+	_, wide := assign.Attributes[lexer.WIDE]
+
+	if nocase && wide {
+		c.warn(rule, infix, fmt.Sprintf("slow condition, '%v at 0' scans the whole input for a nocase wide string, compare the first bytes instead", v.Value))
+	}
+}
+
+// warnConstant warns about a condition that is always true or always
+// false once optimized, other than a plain 'true' or 'false' or a
+// condition on external variables, which are constant by design.
+func (c *compiler) warnConstant(rule *ast.Rule, compiled *CompiledRule) {
+	if _, ok := rule.Condition.(*ast.Bool); ok {
+		return
+	}
+
+	external := false
+	ast.Walk(rule.Condition, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Identity); ok {
+			if _, ok := c.externals[ident.Value]; ok {
+				external = true
+			}
+		}
+
+		return !external
+	})
+
+	if external {
+		return
+	}
+
+	if len(compiled.instr) != 1 || compiled.instr[0].OpCode != PUSH {
+		return
+	}
+
+	if compiled.instr[0].IntParam != 0 {
+		c.warn(rule, rule.Condition, "condition is always true")
+	} else {
+		c.warn(rule, rule.Condition, "condition is always false")
+	}
+}
@@ -1,7 +1,6 @@
 package lexer
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -98,6 +97,7 @@ const (
 	DEFINED
 	KB
 	MB
+	WITH
 )
 
 var keywords = map[string]int{
@@ -116,6 +116,7 @@ var keywords = map[string]int{
 	"not":         NOT,
 	"all":         ALL,
 	"any":         ANY,
+	"none":        NONE,
 	"ascii":       ASCII,
 	"nocase":      NOCASE,
 	"at":          AT,
@@ -143,6 +144,7 @@ var keywords = map[string]int{
 	"rule":        RULE,
 	"of":          OF,
 	"private":     PRIVATE,
+	"global":      GLOBAL,
 	"them":        THEM,
 	"xor":         XOR,
 	"wide":        WIDE,
@@ -152,6 +154,7 @@ var keywords = map[string]int{
 	"meta":        META,
 	"KB":          KB,
 	"MB":          MB,
+	"with":        WITH,
 }
 
 type Token struct {
@@ -168,6 +171,9 @@ type Lexer struct {
 	err   error
 	row   int
 	col   int
+	// Next and Peek skip the comments, they are kept in Comments
+	skipComments bool
+	Comments     []*Token
 }
 
 func New(input string) *Lexer {
@@ -211,7 +217,24 @@ func (s *Lexer) Next() (*Token, error) {
 	tok := s.cur
 	err := s.err
 
-	s.cur, s.err = s.next()
+	s.cur, s.err = s.skip(s.next())
+	return tok, err
+}
+
+// SkipComments makes Next and Peek skip the comments of the input, they
+// are collected in Comments in the order they appear instead. The raw
+// value of a comment includes its delimiters, e.g. '// foo'.
+func (s *Lexer) SkipComments() {
+	s.skipComments = true
+	s.cur, s.err = s.skip(s.cur, s.err)
+}
+
+func (s *Lexer) skip(tok *Token, err error) (*Token, error) {
+	for s.skipComments && err == nil && tok.Type == COMMENT {
+		s.Comments = append(s.Comments, tok)
+		tok, err = s.next()
+	}
+
 	return tok, err
 }
 
@@ -264,6 +287,9 @@ func (s *Lexer) next() (*Token, error) {
 		return nil, io.EOF
 	}
 
+	// the 1 based position of the first char of the token
+	row, col := s.row, s.col+1
+
 	switch s.input[s.index] {
 	case '/':
 		s.read()
@@ -271,6 +297,7 @@ func (s *Lexer) next() (*Token, error) {
 		if s.peek() == '/' {
 			s.read()
 			var builder strings.Builder
+			builder.WriteString("//")
 
 			for {
 				if s.peek() == '\n' {
@@ -286,7 +313,7 @@ func (s *Lexer) next() (*Token, error) {
 				builder.WriteRune(r)
 			}
 
-			return &Token{Raw: builder.String(), Type: COMMENT, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: builder.String(), Type: COMMENT, Row: row, Col: col}, nil
 		}
 
 		if s.peek() == '*' {
@@ -297,116 +324,117 @@ func (s *Lexer) next() (*Token, error) {
 		return s.readRegex()
 
 	case '\\':
-		return &Token{Raw: "\\", Type: DIVIDE, Row: s.row, Col: s.col}, nil
+		s.read()
+		return &Token{Raw: "\\", Type: DIVIDE, Row: row, Col: col}, nil
 
 	case ',':
 		s.read()
-		return &Token{Raw: ",", Type: COMMA, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: ",", Type: COMMA, Row: row, Col: col}, nil
 
 	case ':':
 		s.read()
-		return &Token{Raw: ":", Type: COLON, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: ":", Type: COLON, Row: row, Col: col}, nil
 
 	case '(':
 		s.read()
-		return &Token{Raw: "(", Type: LPAREN, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "(", Type: LPAREN, Row: row, Col: col}, nil
 
 	case ')':
 		s.read()
-		return &Token{Raw: ")", Type: RPAREN, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: ")", Type: RPAREN, Row: row, Col: col}, nil
 
 	case '{':
 		s.read()
-		return &Token{Raw: "{", Type: LBRACE, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "{", Type: LBRACE, Row: row, Col: col}, nil
 
 	case '}':
 		s.read()
-		return &Token{Raw: "}", Type: RBRACE, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "}", Type: RBRACE, Row: row, Col: col}, nil
 
 	case '[':
 		s.read()
-		return &Token{Raw: "[", Type: LBRACKET, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "[", Type: LBRACKET, Row: row, Col: col}, nil
 
 	case ']':
 		s.read()
-		return &Token{Raw: "]", Type: RBRACKET, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "]", Type: RBRACKET, Row: row, Col: col}, nil
 
 	case '+':
 		s.read()
-		return &Token{Raw: "+", Type: PLUS, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "+", Type: PLUS, Row: row, Col: col}, nil
 
 	case '-':
 		s.read()
-		return &Token{Raw: "-", Type: MINUS, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "-", Type: MINUS, Row: row, Col: col}, nil
 
 	case '*':
 		s.read()
-		return &Token{Raw: "*", Type: ASTERISK, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "*", Type: ASTERISK, Row: row, Col: col}, nil
 
 	case '%':
 		s.read()
-		return &Token{Raw: "%", Type: MOD, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "%", Type: MOD, Row: row, Col: col}, nil
 
 	case '.':
 		s.read()
 		if s.peek() == '.' {
 			s.read()
-			return &Token{Raw: "..", Type: RANGE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "..", Type: RANGE, Row: row, Col: col}, nil
 		}
-		return &Token{Raw: ".", Type: DOT, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: ".", Type: DOT, Row: row, Col: col}, nil
 
 	case '|':
 		s.read()
-		return &Token{Raw: "|", Type: PIPE, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "|", Type: PIPE, Row: row, Col: col}, nil
 
 	case '&':
 		s.read()
-		return &Token{Raw: "&", Type: AMPERSAND, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "&", Type: AMPERSAND, Row: row, Col: col}, nil
 
 	case '>':
 		s.read()
 
 		if s.peek() == '>' {
 			s.read()
-			return &Token{Raw: ">>", Type: SHIFTRIGHT, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: ">>", Type: SHIFTRIGHT, Row: row, Col: col}, nil
 
 		}
 
 		if s.peek() == '=' {
 			s.read()
-			return &Token{Raw: ">=", Type: GTE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: ">=", Type: GTE, Row: row, Col: col}, nil
 
 		}
 
-		return &Token{Raw: ">", Type: GT, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: ">", Type: GT, Row: row, Col: col}, nil
 
 	case '<':
 		s.read()
 
 		if s.peek() == '<' {
 			s.read()
-			return &Token{Raw: "<<", Type: SHIFTLEFT, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "<<", Type: SHIFTLEFT, Row: row, Col: col}, nil
 
 		}
 
 		if s.peek() == '=' {
 			s.read()
-			return &Token{Raw: "<=", Type: LTE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "<=", Type: LTE, Row: row, Col: col}, nil
 
 		}
 
-		return &Token{Raw: "<", Type: LT, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "<", Type: LT, Row: row, Col: col}, nil
 
 	case '^':
 		s.read()
-		return &Token{Raw: "^", Type: CARET, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "^", Type: CARET, Row: row, Col: col}, nil
 
 	case '!':
 		s.read()
 
 		if s.peek() == '=' {
 			s.read()
-			return &Token{Raw: "!=", Type: NOTEQUAL, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "!=", Type: NOTEQUAL, Row: row, Col: col}, nil
 		}
 
 		return nil, s.readError(s.row, s.col, "invalid character")
@@ -416,11 +444,11 @@ func (s *Lexer) next() (*Token, error) {
 
 		if s.peek() == '=' {
 			s.read()
-			return &Token{Raw: "==", Type: EQUAL, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "==", Type: EQUAL, Row: row, Col: col}, nil
 
 		}
 
-		return &Token{Raw: "=", Type: ASSIGNMENT, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "=", Type: ASSIGNMENT, Row: row, Col: col}, nil
 	case '"':
 		return s.readString()
 
@@ -435,18 +463,18 @@ func (s *Lexer) next() (*Token, error) {
 		}
 
 		if r == '$' {
-			return &Token{Raw: "$" + ident.Raw, Type: VARIABLE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "$" + ident.Raw, Type: VARIABLE, Row: row, Col: col}, nil
 		}
 
 		if r == '#' {
-			return &Token{Raw: "#" + ident.Raw, Type: VARIABLE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "#" + ident.Raw, Type: VARIABLE, Row: row, Col: col}, nil
 		}
 
 		if r == '@' {
-			return &Token{Raw: "@" + ident.Raw, Type: VARIABLE, Row: s.row, Col: s.col}, nil
+			return &Token{Raw: "@" + ident.Raw, Type: VARIABLE, Row: row, Col: col}, nil
 		}
 
-		return &Token{Raw: "?" + ident.Raw, Type: IDENTITY, Row: s.row, Col: s.col}, nil
+		return &Token{Raw: "?" + ident.Raw, Type: IDENTITY, Row: row, Col: col}, nil
 
 	default:
 
@@ -471,7 +499,7 @@ func (s *Lexer) next() (*Token, error) {
 func (s *Lexer) readIdentity() (*Token, error) {
 	var builder strings.Builder
 	row := s.row
-	col := s.col
+	col := s.col + 1
 
 	tok := s.peek()
 
@@ -511,7 +539,9 @@ func (s *Lexer) readIdentity() (*Token, error) {
 func (s *Lexer) readComment() (*Token, error) {
 	var builder strings.Builder
 	row := s.row
-	col := s.col
+	col := s.col - 1
+
+	builder.WriteString("/*")
 
 	for {
 		r := s.peek()
@@ -525,6 +555,7 @@ func (s *Lexer) readComment() (*Token, error) {
 
 			if s.peek() == '/' {
 				s.read()
+				builder.WriteString("*/")
 				break
 			} else {
 				builder.WriteRune(r)
@@ -553,7 +584,7 @@ func isHexDigit(r rune) bool {
 func (s *Lexer) readNumber() (*Token, error) {
 	var builder strings.Builder
 	row := s.row
-	col := s.col
+	col := s.col + 1
 	isHex := false
 
 	if s.peek() == '0' {
@@ -583,7 +614,7 @@ func (s *Lexer) readNumber() (*Token, error) {
 			break
 		}
 
-		if !unicode.IsDigit(tok) {
+		if !isHex && !unicode.IsDigit(tok) {
 			break
 		}
 
@@ -661,14 +692,15 @@ func (s *Lexer) readRegex() (*Token, error) {
 func (s *Lexer) readString() (*Token, error) {
 	var builder strings.Builder
 	row := s.row
-	col := s.col
+	col := s.col + 1
 
 	s.read() // initial quote
 
 	for {
 		tok := s.peek()
 
-		if tok == '\000' {
+		// strings end on the line they start on
+		if tok == '\000' || tok == '\n' {
 			return nil, s.readError(row, col, "non-terminated string")
 		}
 
@@ -694,5 +726,29 @@ func (s *Lexer) readString() (*Token, error) {
 }
 
 func (l *Lexer) readError(row, col int, errorMsg string) error {
-	return errors.New(fmt.Sprintf("error %v:%v: %v", row, col, errorMsg))
+	return &Error{Row: row, Col: col, Message: errorMsg}
+}
+
+// Error is an error at a position of the input, rows and columns start
+// at 1.
+type Error struct {
+	Row     int
+	Col     int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %v:%v: %v", e.Row, e.Col, e.Message)
+}
+
+// Position returns the row and column of the last char read.
+func (s *Lexer) Position() (int, int) {
+	return s.row, s.col
+}
+
+// Skip drops the next char of the input, moving past an invalid char
+// to resume reading tokens after an error.
+func (s *Lexer) Skip() {
+	s.read()
+	s.cur, s.err = s.skip(s.next())
 }
@@ -61,3 +61,88 @@ foobaz
 	}
 
 }
+
+func TestSkipComments(t *testing.T) {
+	input := `// first
+rule /* inline */ A // trailing
+/* last
+*/`
+	lexer := New(input)
+	lexer.SkipComments()
+
+	toks, err := lexer.scanAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(toks) != 2 || toks[0].Type != RULE || toks[1].Raw != "A" {
+		t.Fatalf("expecting the rule tokens only, got %v", toks)
+	}
+
+	expected := []string{"// first", "/* inline */", "// trailing", "/* last\n*/"}
+
+	if len(lexer.Comments) != len(expected) {
+		t.Fatalf("expecting %v comments, got %v", len(expected), lexer.Comments)
+	}
+
+	for i, comment := range lexer.Comments {
+		if comment.Raw != expected[i] {
+			t.Fatalf("expecting '%v', got '%v'", expected[i], comment.Raw)
+		}
+	}
+
+	if c := lexer.Comments[2]; c.Row != 2 || c.Col != 21 {
+		t.Fatalf("expecting the trailing comment at 2:21, got %v:%v", c.Row, c.Col)
+	}
+}
+
+func TestScanHexLetters(t *testing.T) {
+	input := "0x5a4D"
+	lexer := New(input)
+	tok, err := lexer.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tok.Raw != input {
+		t.Fatalf("invalid raw value %v", tok.Raw)
+	}
+}
+
+func TestScanDivide(t *testing.T) {
+	lexer := New(`10 \ 2`)
+
+	types := []int{INTEGER, DIVIDE, INTEGER}
+	for _, typ := range types {
+		tok, err := lexer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tok.Type != typ {
+			t.Fatalf("invalid token %v", tok.Raw)
+		}
+	}
+}
+
+func TestScanPosition(t *testing.T) {
+	input := "rule Foo {\n\tcondition: $a at 0x10 >= \"x\"\n}"
+	lexer := New(input)
+
+	toks, err := lexer.scanAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first char of each token, rows and columns start at 1
+	expected := [][]int{{1, 1}, {1, 6}, {1, 10}, {2, 2}, {2, 11}, {2, 13}, {2, 16}, {2, 19}, {2, 24}, {2, 27}, {3, 1}}
+	if len(toks) != len(expected) {
+		t.Fatalf("expecting %v tokens, got %v", len(expected), len(toks))
+	}
+
+	for i, tok := range toks {
+		if tok.Row != expected[i][0] || tok.Col != expected[i][1] {
+			t.Fatalf("%v: expecting %v:%v, got %v:%v", tok.Raw, expected[i][0], expected[i][1], tok.Row, tok.Col)
+		}
+	}
+}
@@ -14,19 +14,62 @@ import (
 type Parser struct {
 	lexer *lexer.Lexer
 	Nodes []ast.Node
+	// the comments of the input in the order they appear, the parser
+	// skips them
+	Comments []*ast.Comment
+	// the name of the rule being parsed, for errors
+	rule string
+	// the syntax errors found so far, the parser skips to the next rule
+	// after each of them
+	errors Errors
+}
+
+// Error is a syntax error at a position of the input.
+type Error struct {
+	Row int
+	Col int
+	// the rule the error is in, empty outside of a rule
+	Rule    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %v:%v: %v", e.Row, e.Col, e.Message)
+}
+
+// Errors holds every syntax error of an input, in the order they were
+// found.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
 }
 
 func New(input string) (*Parser, error) {
 	lexer := lexer.New(input)
+	lexer.SkipComments()
 
 	parser := &Parser{
 		lexer: lexer,
 		Nodes: make([]ast.Node, 0),
 	}
 
-	err := parser.parse()
+	parser.parse()
+
+	for _, tok := range lexer.Comments {
+		parser.Comments = append(parser.Comments, &ast.Comment{Token: tok, Text: tok.Raw})
+	}
+
+	if len(parser.errors) > 0 {
+		return parser, parser.errors
+	}
 
-	return parser, err
+	return parser, nil
 }
 
 func test(input string) *Parser {
@@ -39,25 +82,32 @@ func test(input string) *Parser {
 
 }
 
-func (p *Parser) parse() error {
+// parse reads the imports and rules of the input. A syntax error skips
+// the rest of the rule it is in, parsing resumes at the next rule so
+// that every broken rule is reported.
+func (p *Parser) parse() {
 	p.Nodes = make([]ast.Node, 0)
 
 	for p.lexer.HasNext() {
 
+		p.rule = ""
+
 		tok, err := p.lexer.Peek()
 		if err == io.EOF {
 			break
 		}
 
 		if err != nil {
-			return err
+			p.recover(err)
+			continue
 		}
 
 		switch tok.Type {
 		case lexer.IMPORT:
 			mod, err := p.parseImport()
 			if err != nil {
-				return err
+				p.recover(err)
+				continue
 			}
 			p.Nodes = append(p.Nodes, mod)
 
@@ -65,17 +115,67 @@ func (p *Parser) parse() error {
 			rule, err := p.parseRule()
 
 			if err != nil {
-				return err
+				p.recover(err)
+				continue
 			}
 
 			p.Nodes = append(p.Nodes, rule)
 
+		case lexer.NEWLINE, lexer.COMMENT:
+			p.lexer.Next()
+
 		default:
-			return p.parseError(tok, "invalid token")
+			p.recover(p.parseError(tok, "invalid token"))
 		}
 	}
+}
+
+// recover records a syntax error and skips the input up to the start of
+// the next rule or import.
+func (p *Parser) recover(err error) {
+	p.errors = append(p.errors, p.toError(err))
 
-	return nil
+	for {
+		tok, err := p.lexer.Peek()
+		if err == io.EOF {
+			return
+		}
+
+		// the rest of a broken token is skipped char by char
+		if err != nil {
+			p.lexer.Skip()
+			continue
+		}
+
+		switch tok.Type {
+		case lexer.IMPORT, lexer.PRIVATE, lexer.GLOBAL, lexer.RULE:
+			return
+		}
+
+		p.lexer.Next()
+	}
+}
+
+// toError gives a position to the errors of the lexer and the errors
+// without one, e.g. the end of the input in the middle of a rule.
+func (p *Parser) toError(err error) *Error {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr
+	}
+
+	var lerr *lexer.Error
+	if errors.As(err, &lerr) {
+		return &Error{Row: lerr.Row, Col: lerr.Col, Rule: p.rule, Message: lerr.Message}
+	}
+
+	row, col := p.lexer.Position()
+
+	if err == io.EOF {
+		return &Error{Row: row, Col: col, Rule: p.rule, Message: "unexpected end of input"}
+	}
+
+	return &Error{Row: row, Col: col, Rule: p.rule, Message: err.Error()}
 }
 
 func (p *Parser) parseImport() (ast.Node, error) {
@@ -121,6 +221,8 @@ func (p *Parser) parseRule() (ast.Node, error) {
 		return nil, err
 	}
 	rule.Name = name.Raw
+	rule.Token = name
+	p.rule = name.Raw
 
 	tok, err = p.lexer.Peek()
 	if err != nil {
@@ -145,7 +247,7 @@ func (p *Parser) parseRule() (ast.Node, error) {
 		}
 
 		if tok.Type == lexer.META {
-			p.lexer.Next()
+			rule.MetaToken, _ = p.lexer.Next()
 			_, err := p.expectRead(lexer.COLON, "expecting colon, e.g. 'meta:'")
 			if err != nil {
 				return nil, err
@@ -158,7 +260,7 @@ func (p *Parser) parseRule() (ast.Node, error) {
 
 			rule.Meta = nodes
 		} else if tok.Type == lexer.STRINGS {
-			p.lexer.Next()
+			rule.StringsToken, _ = p.lexer.Next()
 			_, err := p.expectRead(lexer.COLON, "expecting colon, e.g. 'strings:'")
 			if err != nil {
 				return nil, err
@@ -172,7 +274,7 @@ func (p *Parser) parseRule() (ast.Node, error) {
 			rule.Strings = nodes
 
 		} else if tok.Type == lexer.CONDITION {
-			p.lexer.Next()
+			rule.ConditionToken, _ = p.lexer.Next()
 
 			_, err := p.expectRead(lexer.COLON, "expecting colon, e.g. 'condition:'")
 			if err != nil {
@@ -190,7 +292,7 @@ func (p *Parser) parseRule() (ast.Node, error) {
 		}
 	}
 
-	_, err = p.expectRead(lexer.RBRACE, "expecting closing brace for rule")
+	rule.End, err = p.expectRead(lexer.RBRACE, "expecting closing brace for rule")
 	if err != nil {
 		return nil, err
 	}
@@ -223,6 +325,7 @@ func (p *Parser) parseBody() ([]ast.Node, error) {
 			return nil, err
 		}
 		assignment.Left = name.Raw
+		assignment.Token = name
 
 		if name.Type != lexer.IDENTITY && name.Type != lexer.VARIABLE {
 			return nil, p.parseError(name, "assignment must be an identity or variable")
@@ -316,6 +419,7 @@ var prefixPower = map[int][]int{
 	lexer.LBRACKET: {0, 0},
 	lexer.PLUS:     {0, 24},
 	lexer.MINUS:    {0, 24},
+	lexer.NOT:      {0, 5},
 }
 
 var infixPower = map[int][]int{
@@ -339,6 +443,7 @@ var infixPower = map[int][]int{
 	lexer.GT:          {9, 10},
 	lexer.LTE:         {9, 10},
 	lexer.LT:          {9, 10},
+	lexer.RANGE:       {10, 11},
 	lexer.PIPE:        {11, 12},
 	lexer.CARET:       {13, 14},
 	lexer.AMPERSAND:   {15, 16},
@@ -351,7 +456,6 @@ var infixPower = map[int][]int{
 	lexer.ASTERISK:    {21, 22},
 	lexer.TILDE:       {23, 24},
 	lexer.DOT:         {25, 26},
-	lexer.RANGE:       {25, 26},
 	lexer.LBRACKET:    {25, 26},
 }
 
@@ -371,6 +475,12 @@ func (p *Parser) makeSet(node ast.Node) ast.Node {
 		break
 	}
 
+	// the commas nest to the left, the items were collected last to
+	// first
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+
 	return &ast.Set{Nodes: ret}
 }
 
@@ -386,9 +496,13 @@ func (p *Parser) parseFor() (ast.Node, error) {
 	}
 
 	switch expr.Type {
-	case lexer.INTEGER, lexer.ANY, lexer.ALL:
+	case lexer.INTEGER, lexer.ANY, lexer.ALL, lexer.NONE:
 	default:
-		return nil, p.parseError(expr, "'for' expression expects 'any' or 'all' keywords")
+		return nil, p.parseError(expr, "'for' expression expects 'any', 'all', 'none' or an integer")
+	}
+
+	loop := &ast.For{
+		Expr: expr,
 	}
 
 	tok, err := p.lexer.Peek()
@@ -396,87 +510,156 @@ func (p *Parser) parseFor() (ast.Node, error) {
 		return nil, err
 	}
 
-	if tok.Type == lexer.IDENTITY {
-		_var, _ := p.lexer.Next()
-		if _var.Type != lexer.IDENTITY {
-			return nil, p.parseError(_var, "expecting an identity")
-		}
-
-		_, _ = p.lexer.Next()
+	// for 50% of them
+	if expr.Type == lexer.INTEGER && tok.Type == lexer.MOD {
+		p.lexer.Next()
+		loop.Percent = true
 
-		set, err := p.parseExpr(0)
+		tok, err = p.lexer.Peek()
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		if prefix, ok := set.(*ast.Prefix); ok {
-			set = prefix.Right
-		}
+	if tok.Type == lexer.IDENTITY {
+		// for any k, v in dict
+		for {
+			_var, err := p.expectRead(lexer.IDENTITY, "expecting an identity")
+			if err != nil {
+				return nil, err
+			}
 
-		_, err = p.expectRead(lexer.COLON, "expecting colon")
-		if err != nil {
-			return nil, err
-		}
+			loop.Vars = append(loop.Vars, _var.Raw)
 
-		_, err = p.expectRead(lexer.LPAREN, "expecting left paren")
-		if err != nil {
-			return nil, err
-		}
+			tok, err = p.lexer.Peek()
+			if err != nil {
+				return nil, err
+			}
 
-		body, err := p.parseExpr(0)
-		if err != nil {
-			return nil, err
+			if tok.Type != lexer.COMMA {
+				break
+			}
+
+			p.lexer.Next()
 		}
 
-		_, err = p.expectRead(lexer.RPAREN, "expecting right paren")
+		_, err = p.expectRead(lexer.IN, "expecting 'in' after the loop variables")
 		if err != nil {
 			return nil, err
 		}
 
-		return &ast.For{
-			Expr:      expr,
-			Var:       _var.Raw,
-			StringSet: set,
-			Body:      body,
-		}, nil
-
 	} else if tok.Type == lexer.IN || tok.Type == lexer.OF {
 		_, _ = p.lexer.Next()
-		set, err := p.parseExpr(0)
+	} else {
+		return nil, p.parseError(tok, "'for' expression expects 'of' or 'in' keywords or an identity like 'i'")
+	}
+
+	set, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// a range or a single value in parens, e.g. (0..10), sets keep
+	// their own node
+	if prefix, ok := set.(*ast.Prefix); ok && prefix.Token.Type == lexer.LPAREN && len(loop.Vars) > 0 {
+		set = prefix.Right
+	}
+
+	loop.Iterable = set
+
+	_, err = p.expectRead(lexer.COLON, "expecting colon")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.expectRead(lexer.LPAREN, "expecting left paren")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.expectRead(lexer.RPAREN, "expecting right paren")
+	if err != nil {
+		return nil, err
+	}
+
+	loop.Body = body
+
+	return loop, nil
+}
+
+func (p *Parser) parseWith() (ast.Node, error) {
+	tok, err := p.expectRead(lexer.WITH, "expecting a with keyword")
+	if err != nil {
+		return nil, err
+	}
+
+	with := &ast.With{
+		Token: tok,
+	}
+
+	for {
+		name, err := p.expectRead(lexer.IDENTITY, "expecting an identity to bind in 'with'")
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = p.expectRead(lexer.COLON, "expecting colon")
+		_, err = p.expectRead(lexer.ASSIGNMENT, "expecting equals char after the identity")
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = p.expectRead(lexer.LPAREN, "expecting left paren")
+		// the value stops at the comma separating the bindings
+		value, err := p.parseExpr(infixPower[lexer.COMMA][1])
 		if err != nil {
 			return nil, err
 		}
 
-		body, err := p.parseExpr(0)
+		with.Bindings = append(with.Bindings, &ast.Binding{
+			Token: name,
+			Name:  name.Raw,
+			Value: value,
+		})
+
+		tok, err = p.lexer.Peek()
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = p.expectRead(lexer.RPAREN, "expecting right paren")
-		if err != nil {
-			return nil, err
+		if tok.Type != lexer.COMMA {
+			break
 		}
 
-		return &ast.For{
-			Expr:      expr,
-			Var:       "",
-			StringSet: set,
-			Body:      body,
-		}, nil
-	} else {
-		return nil, p.parseError(tok, "'for' expression expects 'of' or 'in' keywords or an identity like 'i'")
+		p.lexer.Next()
+	}
+
+	_, err = p.expectRead(lexer.COLON, "expecting colon")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.expectRead(lexer.LPAREN, "expecting left paren")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.expectRead(lexer.RPAREN, "expecting right paren")
+	if err != nil {
+		return nil, err
 	}
 
+	with.Body = body
+
+	return with, nil
 }
 
 func (p *Parser) parseExpr(power int) (ast.Node, error) {
@@ -567,7 +750,15 @@ func (p *Parser) parseExpr(power int) (ast.Node, error) {
 
 			left = node
 
-		case lexer.FILESIZE, lexer.WIDE, lexer.NOCASE, lexer.ASCII, lexer.THEM, lexer.NONE, lexer.ALL, lexer.ANY:
+		case lexer.WITH:
+			node, err := p.parseWith()
+			if err != nil {
+				return nil, err
+			}
+
+			left = node
+
+		case lexer.FILESIZE, lexer.ENTRYPOINT, lexer.WIDE, lexer.NOCASE, lexer.ASCII, lexer.THEM, lexer.NONE, lexer.ALL, lexer.ANY:
 			tok, _ := p.lexer.Next()
 			left = &ast.Keyword{
 				Token: tok,
@@ -607,6 +798,31 @@ func (p *Parser) parseExpr(power int) (ast.Node, error) {
 				}
 			}
 
+		case lexer.INT8, lexer.INT16, lexer.INT32, lexer.INT8BE, lexer.INT16BE, lexer.INT32BE,
+			lexer.UINT8, lexer.UINT16, lexer.UINT32, lexer.UINT8BE, lexer.UINT16BE, lexer.UINT32BE:
+			fn, _ := p.lexer.Next()
+
+			_, err := p.expectRead(lexer.LPAREN, fmt.Sprintf("expecting left paren, e.g. '%v(0)'", fn.Raw))
+			if err != nil {
+				return nil, err
+			}
+
+			node, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = p.expectRead(lexer.RPAREN, "missing right paren in integer function")
+			if err != nil {
+				return nil, err
+			}
+
+			left = &ast.Keyword{
+				Token:     fn,
+				Value:     fn.Raw,
+				Attribute: node,
+			}
+
 		case lexer.STRING:
 			tok, _ := p.lexer.Next()
 			left = &ast.String{
@@ -663,6 +879,30 @@ func (p *Parser) parseExpr(power int) (ast.Node, error) {
 				Value: tok.Raw,
 			}
 
+			// a rule wildcard in a set, e.g. 'any of (Rule*)', or a
+			// multiplication
+			if next, _ := p.lexer.Peek(); next != nil && next.Type == lexer.ASTERISK && power <= infixPower[lexer.ASTERISK][0] {
+				op, _ := p.lexer.Next()
+
+				if next, _ := p.lexer.Peek(); next != nil && (next.Type == lexer.RPAREN || next.Type == lexer.COMMA) {
+					left = &ast.Identity{
+						Token: tok,
+						Value: tok.Raw + "*",
+					}
+				} else {
+					right, err := p.parseExpr(infixPower[lexer.ASTERISK][1])
+					if err != nil {
+						return nil, err
+					}
+
+					left = &ast.Infix{
+						Token: op,
+						Left:  left,
+						Right: right,
+					}
+				}
+			}
+
 		case lexer.LBRACE:
 			return p.parseBytes()
 
@@ -677,12 +917,40 @@ func (p *Parser) parseExpr(power int) (ast.Node, error) {
 			return nil, err
 		}
 
-		if tok.Type == lexer.KB {
-			p.lexer.Next()
-			integer.Value = integer.Value * 1024
-		} else if tok.Type == lexer.MB {
+		// the raw value keeps the unit, e.g. 10KB
+		if tok.Type == lexer.KB || tok.Type == lexer.MB {
 			p.lexer.Next()
-			integer.Value = integer.Value * (2 ^ 20)
+			integer.Token = &lexer.Token{Raw: integer.Token.Raw + tok.Raw, Type: lexer.INTEGER, Row: integer.Token.Row, Col: integer.Token.Col}
+
+			if tok.Type == lexer.KB {
+				integer.Value = integer.Value * 1024
+			} else {
+				integer.Value = integer.Value * (1 << 20)
+			}
+		}
+
+		// a percentage is the quantifier of an 'of', e.g. '50% of
+		// them', otherwise the '%' is the modulo operator
+		if tok, _ := p.lexer.Peek(); tok != nil && tok.Type == lexer.MOD && power <= infixPower[lexer.MOD][0] {
+			op, _ := p.lexer.Next()
+
+			if next, _ := p.lexer.Peek(); next != nil && next.Type == lexer.OF {
+				left = &ast.Percentage{
+					Token: op,
+					Value: integer,
+				}
+			} else {
+				right, err := p.parseExpr(infixPower[lexer.MOD][1])
+				if err != nil {
+					return nil, err
+				}
+
+				left = &ast.Infix{
+					Token: op,
+					Left:  left,
+					Right: right,
+				}
+			}
 		}
 	}
 
@@ -817,22 +1085,26 @@ func (p *Parser) parseBytes() (ast.Node, error) {
 }
 
 func (p *Parser) expectRead(tokenType int, errorMsg string) (*lexer.Token, error) {
-	tok, err := p.lexer.Next()
+	// a token of the wrong type is left for the next rule to start
+	// from, e.g. the 'rule' following a rule missing its closing brace
+	tok, err := p.lexer.Peek()
 	if err != nil {
 		return nil, err
 	}
 
 	if tok.Type != tokenType {
-		return nil, errors.New(fmt.Sprintf("error %v:%v: %v", tok.Row, tok.Col, errorMsg))
+		return nil, p.parseError(tok, errorMsg)
 	}
 
-	return tok, nil
+	return p.lexer.Next()
 }
 
 func (p *Parser) parseError(tok *lexer.Token, errorMsg string) error {
 	if tok != nil {
-		return errors.New(fmt.Sprintf("error %v:%v: %v", tok.Row, tok.Col, errorMsg))
+		return &Error{Row: tok.Row, Col: tok.Col, Rule: p.rule, Message: errorMsg}
 	}
 
-	return errors.New(fmt.Sprintf("error %v", errorMsg))
+	row, col := p.lexer.Position()
+
+	return &Error{Row: row, Col: col, Rule: p.rule, Message: errorMsg}
 }
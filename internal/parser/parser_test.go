@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -175,6 +176,185 @@ func TestParseSet(t *testing.T) {
 	}
 }
 
+func TestParsePercentage(t *testing.T) {
+	parser := test("50% of them and 10 % 3 == filesize")
+	node, err := parser.parseExpr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	and, ok := node.(*ast.Infix)
+	if !ok || and.Token.Type != lexer.AND {
+		t.Fatalf("expecting and, got %v", node)
+	}
+
+	of, ok := and.Left.(*ast.Infix)
+	if !ok || of.Token.Type != lexer.OF {
+		t.Fatalf("expecting of, got %v", and.Left)
+	}
+
+	if _, ok := of.Left.(*ast.Percentage); !ok {
+		t.Fatalf("expecting a percentage, got %v", of.Left)
+	}
+
+	equal, ok := and.Right.(*ast.Infix)
+	if !ok || equal.Token.Type != lexer.EQUAL {
+		t.Fatalf("expecting equal, got %v", and.Right)
+	}
+
+	if mod, ok := equal.Left.(*ast.Infix); !ok || mod.Token.Type != lexer.MOD {
+		t.Fatalf("expecting modulo, got %v", equal.Left)
+	}
+}
+
+func TestParseRuleWildcard(t *testing.T) {
+	parser := test("any of (Foo*, Bar) and Foo * 2 > filesize")
+	node, err := parser.parseExpr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	and := node.(*ast.Infix)
+	set, ok := and.Left.(*ast.Infix).Right.(*ast.Set)
+	if !ok {
+		t.Fatalf("expecting a set, got %v", and.Left)
+	}
+
+	if ident, ok := set.Nodes[0].(*ast.Identity); !ok || ident.Value != "Foo*" {
+		t.Fatalf("expecting a rule wildcard, got %v", set.Nodes[0])
+	}
+
+	if mul, ok := and.Right.(*ast.Infix).Left.(*ast.Infix); !ok || mul.Token.Type != lexer.ASTERISK {
+		t.Fatalf("expecting a multiplication, got %v", and.Right)
+	}
+}
+
+func TestParseFor(t *testing.T) {
+	tests := map[string]string{
+		"for any i in (1, 5, 9) : ( i == 5 )":         "for any i in (1,5,9) : (i == 5)",
+		"for none k, v in pe.version : ( k == v )":    "for none k, v in pe . version : (k == v)",
+		"for 50% of ($a, $b) : ( # > 1 )":             "for 50% of ($a,$b) : (#a > 1)",
+		"for all i in (0..#a) : ( @a[i] > filesize )": "for all i in 0 .. #a : (@a[i] > filesize)",
+	}
+
+	for input := range tests {
+		parser := test(input)
+		node, err := parser.parseExpr(0)
+		if err != nil {
+			t.Fatalf("%v: %v", input, err)
+		}
+
+		if _, ok := node.(*ast.For); !ok {
+			t.Fatalf("%v: expecting a for loop, got %v", input, node)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	// the bounds of a range are whole expressions
+	for _, input := range []string{"(0..filesize * 2 - 1)", "(#a + 1..filesize | 1)"} {
+		parser := test(input)
+		node, err := parser.parseExpr(0)
+		if err != nil {
+			t.Fatalf("%v: %v", input, err)
+		}
+
+		group, ok := node.(*ast.Prefix)
+		if !ok {
+			t.Fatalf("%v: expecting a group, got %v", input, node)
+		}
+
+		r, ok := group.Right.(*ast.Infix)
+		if !ok || r.Token.Type != lexer.RANGE {
+			t.Fatalf("%v: expecting a range, got %v", input, group.Right)
+		}
+
+		if _, ok := r.Right.(*ast.Infix); !ok {
+			t.Fatalf("%v: expecting the end of the range to be an expression, got %v", input, r.Right)
+		}
+	}
+}
+
+func TestParseWith(t *testing.T) {
+	parser := test("with x = @a[1], y = x + 4 : ( uint32(y) == x )")
+	node, err := parser.parseExpr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with, ok := node.(*ast.With)
+	if !ok {
+		t.Fatalf("expecting a with statement, got %v", node)
+	}
+
+	if len(with.Bindings) != 2 || with.Bindings[0].Name != "x" || with.Bindings[1].Name != "y" {
+		t.Fatalf("invalid bindings: %v", with)
+	}
+
+	for _, input := range []string{
+		"with x : ( x )",
+		"with x = 1 ( x )",
+		"with 1 = x : ( x )",
+	} {
+		if _, err := test(input).parseExpr(0); err == nil {
+			t.Fatalf("%v: expecting a parse error", input)
+		}
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	input := `
+rule A {
+    condition:
+        $a and
+}
+
+// the rules after a broken rule are still parsed
+rule B {
+    condition:
+        true
+}
+
+rule C {
+    strings:
+        $c = "x
+}
+
+rule D {
+    condition: true
+`
+
+	parser, err := New(input)
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expecting syntax errors, got %v", err)
+	}
+
+	expected := []struct {
+		row  int
+		rule string
+	}{
+		{5, "A"},
+		{15, "C"},
+		{20, "D"},
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("expecting %v errors, got %v", len(expected), errs)
+	}
+
+	for i, e := range expected {
+		if errs[i].Row != e.row || errs[i].Rule != e.rule {
+			t.Fatalf("expecting an error at row %v in rule %v, got %v in rule %v", e.row, e.rule, errs[i], errs[i].Rule)
+		}
+	}
+
+	if len(parser.Nodes) != 1 || parser.Nodes[0].(*ast.Rule).Name != "B" {
+		t.Fatalf("expecting rule B to parse, got %v", parser.Nodes)
+	}
+}
+
 func FuzzParser(f *testing.F) {
 	s := "{ 68 65 6c 6c 6f }"
 	f.Add(s, "$s1 and #s1 > 0")
@@ -205,3 +385,34 @@ func FuzzParser(f *testing.F) {
 
 	})
 }
+
+func TestParseComments(t *testing.T) {
+	input := `// first
+rule A {
+    strings:
+        $a = "foo" // trailing
+    condition:
+        $a and /* inline */ filesize < 1KB
+}`
+
+	parser, err := New(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parser.Comments) != 3 || parser.Comments[2].Text != "/* inline */" {
+		t.Fatalf("expecting three comments, got %v", parser.Comments)
+	}
+
+	rule := parser.Nodes[0].(*ast.Rule)
+
+	if rule.StringsToken.Row != 3 || rule.ConditionToken.Row != 5 || rule.End.Row != 7 || rule.MetaToken != nil {
+		t.Fatal("expecting the positions of the sections")
+	}
+
+	// the unit is part of the raw integer
+	size := rule.Condition.(*ast.Infix).Right.(*ast.Infix).Right.(*ast.Integer)
+	if size.Token.Raw != "1KB" || size.Value != 1024 {
+		t.Fatalf("unexpected integer %v %v", size.Token.Raw, size.Value)
+	}
+}
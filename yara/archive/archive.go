@@ -0,0 +1,324 @@
+// Package archive unpacks the files inside containers, zip and tar
+// archives and gzip and bzip2 streams, so rules can be run against them.
+//
+// Containers nested in containers are unpacked too, up to the depth and
+// size of the Limits. A member is named by the path of its container and
+// its name in it, separated by '!', e.g. outer.zip!inner/a.exe. A gzip or
+// bzip2 stream holding a tar archive is unpacked as a single container,
+// e.g. outer.tar.gz!inner/a.exe.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrBudget is the error of the member unpacked past the size or the
+	// number of files of the Limits, nothing more is unpacked.
+	ErrBudget = errors.New("archive: size budget exceeded")
+	// ErrBomb is the error of a member unpacking to more than MaxRatio
+	// times its compressed size, it is skipped.
+	ErrBomb = errors.New("archive: compression ratio exceeded, possible decompression bomb")
+)
+
+// Limits bound the unpacking of an input.
+type Limits struct {
+	// the containers nested deeper than MaxDepth are not unpacked, the
+	// members of the input are at depth 1
+	MaxDepth int
+	// the most bytes unpacked from an input, all members included
+	MaxSize int64
+	// the most members unpacked from an input
+	MaxFiles int
+	// the largest unpacked size of a member over its compressed size
+	MaxRatio int64
+}
+
+// DefaultLimits are the limits used by the yara command.
+var DefaultLimits = Limits{
+	MaxDepth: 4,
+	MaxSize:  256 << 20,
+	MaxFiles: 10000,
+	MaxRatio: 250,
+}
+
+// Member is a file unpacked from a container. Err is set if it could
+// not be unpacked, e.g. a corrupt container or ErrBomb, Data is nil then.
+type Member struct {
+	Path string
+	Data []byte
+	Err  error
+}
+
+// Format is the kind of a container.
+type Format int
+
+const (
+	None Format = iota
+	Zip
+	Tar
+	Gzip
+	Bzip2
+)
+
+func (f Format) String() string {
+	switch f {
+	case Zip:
+		return "zip"
+	case Tar:
+		return "tar"
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	default:
+		return "none"
+	}
+}
+
+// Detect returns the format of the container starting with head, from
+// its magic bytes. The head must hold the first 512 bytes of the input to
+// find a tar archive.
+func Detect(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return Zip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return Bzip2
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return Tar
+	}
+
+	return None
+}
+
+// unpacker holds the budget left while unpacking an input.
+type unpacker struct {
+	limits Limits
+	size   int64
+	files  int
+	fn     func(Member) error
+	// the budget ran out, nothing more is unpacked
+	done bool
+}
+
+// Unpack calls fn with each member of the container r, size bytes long,
+// named name. Nothing is unpacked if r is not a container. The errors
+// unpacking a member are handed to fn in the member, Unpack only returns
+// the errors of fn, which stop the unpacking.
+func Unpack(name string, r io.ReaderAt, size int64, limits Limits, fn func(Member) error) error {
+	u := &unpacker{limits: limits, fn: fn}
+	return u.unpack(name, r, size, 1)
+}
+
+func (u *unpacker) unpack(name string, r io.ReaderAt, size int64, depth int) error {
+	if depth > u.limits.MaxDepth {
+		return nil
+	}
+
+	head := make([]byte, 512)
+	n, _ := r.ReadAt(head, 0)
+
+	switch Detect(head[:n]) {
+	case Zip:
+		return u.zip(name, r, size, depth)
+	case Tar:
+		return u.tar(name, io.NewSectionReader(r, 0, size), depth)
+	case Gzip:
+		gz, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return u.fn(Member{Path: name, Err: err})
+		}
+
+		return u.stream(name, gz.Name, gz, size, depth)
+	case Bzip2:
+		return u.stream(name, "", bzip2.NewReader(io.NewSectionReader(r, 0, size)), size, depth)
+	}
+
+	return nil
+}
+
+// member hands a member to fn, then unpacks it if it is a container.
+func (u *unpacker) member(name string, r io.Reader, compressed int64, depth int) error {
+	if u.done {
+		return nil
+	}
+
+	u.files++
+	if u.files > u.limits.MaxFiles {
+		u.done = true
+		return u.fn(Member{Path: name, Err: ErrBudget})
+	}
+
+	data, err := u.read(r, compressed)
+	if err != nil {
+		return u.fn(Member{Path: name, Err: err})
+	}
+
+	if err := u.fn(Member{Path: name, Data: data}); err != nil {
+		return err
+	}
+
+	return u.unpack(name, bytes.NewReader(data), int64(len(data)), depth+1)
+}
+
+// read reads a member within the budget left, and within MaxRatio times
+// its compressed size if it is compressed.
+func (u *unpacker) read(r io.Reader, compressed int64) ([]byte, error) {
+	left := u.limits.MaxSize - u.size
+	limit := left
+
+	bomb := compressed > 0 && u.limits.MaxRatio > 0 && compressed*u.limits.MaxRatio < left
+	if bomb {
+		limit = compressed * u.limits.MaxRatio
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		if bomb {
+			return nil, ErrBomb
+		}
+
+		u.done = true
+		return nil, ErrBudget
+	}
+
+	u.size += int64(len(data))
+
+	return data, nil
+}
+
+func (u *unpacker) zip(name string, r io.ReaderAt, size int64, depth int) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return u.fn(Member{Path: name, Err: err})
+	}
+
+	for _, file := range archive.File {
+		if u.done {
+			return nil
+		}
+
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		member := name + "!" + file.Name
+
+		rc, err := file.Open()
+		if err != nil {
+			if err := u.fn(Member{Path: member, Err: err}); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// a stored file is not compressed, its ratio is 1
+		compressed := int64(file.CompressedSize64)
+		if file.Method == zip.Store {
+			compressed = 0
+		}
+
+		err = u.member(member, rc, compressed, depth)
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *unpacker) tar(name string, r io.Reader, depth int) error {
+	archive := tar.NewReader(r)
+
+	for !u.done {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return u.fn(Member{Path: name, Err: err})
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := u.member(name+"!"+header.Name, archive, 0, depth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stream unpacks a gzip or bzip2 stream. A stream holding a tar archive
+// is unpacked as the tar archive, otherwise the stream is a member named
+// by its header or by the name of the container without its extension.
+func (u *unpacker) stream(name string, header string, r io.Reader, compressed int64, depth int) error {
+	if u.done {
+		return nil
+	}
+
+	data, err := u.read(r, compressed)
+	if err != nil {
+		return u.fn(Member{Path: name, Err: err})
+	}
+
+	if Detect(data) == Tar {
+		// the bytes of the stream are counted again by its members
+		u.size -= int64(len(data))
+		return u.tar(name, bytes.NewReader(data), depth)
+	}
+
+	if header == "" {
+		header = streamName(name)
+	}
+
+	u.files++
+	if u.files > u.limits.MaxFiles {
+		u.done = true
+		return u.fn(Member{Path: name, Err: ErrBudget})
+	}
+
+	member := name + "!" + header
+
+	if err := u.fn(Member{Path: member, Data: data}); err != nil {
+		return err
+	}
+
+	return u.unpack(member, bytes.NewReader(data), int64(len(data)), depth+1)
+}
+
+// streamName returns the name of the file compressed in the stream
+// named name, e.g. a.txt for dir/a.txt.gz.
+func streamName(name string) string {
+	base := path.Base(name[strings.LastIndex(name, "!")+1:])
+
+	for _, ext := range []string{".gz", ".gzip", ".bz2", ".bzip2"} {
+		if strings.HasSuffix(base, ext) && len(base) > len(ext) {
+			return strings.TrimSuffix(base, ext)
+		}
+	}
+
+	return fmt.Sprintf("%v.out", base)
+}
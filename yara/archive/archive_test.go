@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func zipFile(t *testing.T, files map[string][]byte, order ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	for _, name := range order {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write(files[name])
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func tarGzFile(t *testing.T, files map[string][]byte, order ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+
+	for _, name := range order {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		w.Write(files[name])
+	}
+
+	w.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func unpack(t *testing.T, name string, data []byte, limits Limits) []string {
+	members := make([]string, 0)
+
+	err := Unpack(name, bytes.NewReader(data), int64(len(data)), limits, func(m Member) error {
+		if m.Err != nil {
+			members = append(members, fmt.Sprintf("%v: %v", m.Path, m.Err))
+		} else {
+			members = append(members, fmt.Sprintf("%v: %v", m.Path, len(m.Data)))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return members
+}
+
+func TestUnpack(t *testing.T) {
+	inner := tarGzFile(t, map[string][]byte{"dir/b.exe": []byte("MZbbb"), "c.txt": []byte("cc")}, "dir/b.exe", "c.txt")
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("plain"))
+	w.Close()
+
+	outer := zipFile(t, map[string][]byte{
+		"inner/a.exe":  []byte("MZaaaa"),
+		"inner.tar.gz": inner,
+		"notes.txt.gz": gz.Bytes(),
+	}, "inner/a.exe", "inner.tar.gz", "notes.txt.gz")
+
+	expected := []string{
+		"outer.zip!inner/a.exe: 6",
+		fmt.Sprintf("outer.zip!inner.tar.gz: %v", len(inner)),
+		"outer.zip!inner.tar.gz!dir/b.exe: 5",
+		"outer.zip!inner.tar.gz!c.txt: 2",
+		fmt.Sprintf("outer.zip!notes.txt.gz: %v", gz.Len()),
+		"outer.zip!notes.txt.gz!notes.txt: 5",
+	}
+
+	if members := unpack(t, "outer.zip", outer, DefaultLimits); !reflect.DeepEqual(members, expected) {
+		t.Fatalf("expecting %v, got %v", expected, members)
+	}
+
+	// the tar.gz is a member but is not unpacked at depth 1
+	limits := DefaultLimits
+	limits.MaxDepth = 1
+
+	if members := unpack(t, "outer.zip", outer, limits); len(members) != 3 {
+		t.Fatalf("expecting only the members of the zip, got %v", members)
+	}
+
+	if members := unpack(t, "plain", []byte("not a container"), DefaultLimits); len(members) != 0 {
+		t.Fatalf("expecting no members, got %v", members)
+	}
+
+	if members := unpack(t, "broken.zip", outer[:40], DefaultLimits); len(members) != 1 || members[0] != "broken.zip: zip: not a valid zip file" {
+		t.Fatalf("expecting a corrupt container, got %v", members)
+	}
+}
+
+func TestUnpackLimits(t *testing.T) {
+	// a megabyte of zeros compresses a thousand times
+	bomb := zipFile(t, map[string][]byte{"small": []byte("small"), "zeros": make([]byte, 1<<20), "after": []byte("after")}, "small", "zeros", "after")
+
+	members := unpack(t, "bomb.zip", bomb, DefaultLimits)
+	expected := []string{"bomb.zip!small: 5", "bomb.zip!zeros: " + ErrBomb.Error(), "bomb.zip!after: 5"}
+
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("expecting %v, got %v", expected, members)
+	}
+
+	limits := DefaultLimits
+	limits.MaxSize = 8
+	limits.MaxRatio = 0
+
+	members = unpack(t, "bomb.zip", bomb, limits)
+	expected = []string{"bomb.zip!small: 5", "bomb.zip!zeros: " + ErrBudget.Error()}
+
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("expecting %v, got %v", expected, members)
+	}
+
+	limits = DefaultLimits
+	limits.MaxFiles = 1
+
+	members = unpack(t, "bomb.zip", bomb, limits)
+	if len(members) != 2 || members[1] != "bomb.zip!zeros: "+ErrBudget.Error() {
+		t.Fatalf("expecting the budget to stop at one file, got %v", members)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	header := make([]byte, 512)
+	copy(header[257:], "ustar")
+
+	tests := map[string]Format{
+		"PK\x03\x04rest":     Zip,
+		"\x1f\x8b\x08":       Gzip,
+		"BZh91AY":            Bzip2,
+		string(header):       Tar,
+		"MZ\x90\x00\x03":     None,
+		"":                   None,
+		"PK\x05\x06\x00\x00": Zip,
+	}
+
+	for head, expected := range tests {
+		if format := Detect([]byte(head)); format != expected {
+			t.Fatalf("%q: expecting %v, got %v", head, expected, format)
+		}
+	}
+}
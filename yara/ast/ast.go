@@ -0,0 +1,98 @@
+// Package ast is the syntax tree of yara rules, for tools reading or
+// rewriting rules, e.g. linters and formatters.
+//
+// Every node keeps the token it was parsed from, Token.Raw is its source
+// text and Token.Row and Token.Col its position, both starting at 1.
+// Comments are not part of the tree, a File keeps them aside.
+//
+// The operator of an Infix or a Prefix is the kind of its token, one of
+// the Kind constants, e.g. KindAnd or KindShiftLeft. An expression in
+// parentheses is a Prefix of kind KindLParen.
+package ast
+
+import (
+	"github.com/kgwinnup/go-yara/internal/ast"
+	"github.com/kgwinnup/go-yara/internal/lexer"
+	"github.com/kgwinnup/go-yara/internal/parser"
+)
+
+type (
+	Node    = ast.Node
+	Token   = lexer.Token
+	Comment = ast.Comment
+
+	Import     = ast.Import
+	Rule       = ast.Rule
+	Assignment = ast.Assignment
+
+	String   = ast.String
+	Regex    = ast.Regex
+	Bytes    = ast.Bytes
+	Integer  = ast.Integer
+	Bool     = ast.Bool
+	Identity = ast.Identity
+	Variable = ast.Variable
+	Keyword  = ast.Keyword
+
+	Prefix     = ast.Prefix
+	Infix      = ast.Infix
+	Set        = ast.Set
+	Percentage = ast.Percentage
+	For        = ast.For
+	With       = ast.With
+	Binding    = ast.Binding
+)
+
+// The values returned by Node.Type.
+const (
+	RULE       = ast.RULE
+	PREFIX     = ast.PREFIX
+	INFIX      = ast.INFIX
+	INTEGER    = ast.INTEGER
+	STRING     = ast.STRING
+	REGEX      = ast.REGEX
+	BOOL       = ast.BOOL
+	ASSIGNMENT = ast.ASSIGNMENT
+	IDENTITY   = ast.IDENTITY
+	VARIABLE   = ast.VARIABLE
+	KEYWORD    = ast.KEYWORD
+	BYTES      = ast.BYTES
+	IMPORT     = ast.IMPORT
+	SET        = ast.SET
+	FOR        = ast.FOR
+	PERCENTAGE = ast.PERCENTAGE
+	WITH       = ast.WITH
+)
+
+// Error is a syntax error, Errors holds every syntax error of an input.
+type (
+	Error  = parser.Error
+	Errors = parser.Errors
+)
+
+// File is a parsed input, its imports and rules in the order they are
+// declared and its comments in the order they appear.
+type File struct {
+	Nodes    []Node
+	Comments []*Comment
+}
+
+// Parse parses the imports and rules of src. On syntax errors the File
+// holds the rules that did parse and the error is Errors.
+func Parse(src string) (*File, error) {
+	p, err := parser.New(src)
+
+	return &File{Nodes: p.Nodes, Comments: p.Comments}, err
+}
+
+// Walk calls fn for node and every node below it, depth first in source
+// order. Returning false from fn skips the nodes below the node.
+func Walk(node Node, fn func(Node) bool) {
+	ast.Walk(node, fn)
+}
+
+// TokenOf returns the token a node was parsed from, nil for nodes
+// without one, e.g. a Set.
+func TokenOf(node Node) *Token {
+	return ast.TokenOf(node)
+}
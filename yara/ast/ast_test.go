@@ -0,0 +1,119 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the operators of the Infix and Prefix nodes are told apart by the
+// kinds of their tokens
+func TestOperatorKinds(t *testing.T) {
+	file, err := Parse(`
+rule A {
+    strings:
+        $a = "foo" nocase wide
+    condition:
+        not $a or (1 << 2 == 4 and 8 >> 1 != 3 and 5 \ 2 + 1 - 1 * 1 % 2 <= 9) and 1 & 3 | 2 ^ 1 > 0
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"not": KindNot, "or": KindOr, "and": KindAnd, "<<": KindShiftLeft,
+		">>": KindShiftRight, "==": KindEqual, "!=": KindNotEqual, "\\": KindDivide,
+		"+": KindPlus, "-": KindMinus, "*": KindAsterisk, "%": KindMod,
+		"<=": KindLTE, "&": KindAmpersand, "|": KindPipe,
+		"^": KindCaret, ">": KindGT, "(": KindLParen,
+	}
+
+	seen := make(map[string]bool)
+	rule := file.Nodes[0].(*Rule)
+
+	Walk(rule.Condition, func(node Node) bool {
+		var tok *Token
+
+		switch n := node.(type) {
+		case *Infix:
+			tok = n.Token
+		case *Prefix:
+			tok = n.Token
+		default:
+			return true
+		}
+
+		kind, ok := expected[tok.Raw]
+		if !ok {
+			t.Fatalf("unexpected operator %q", tok.Raw)
+		}
+
+		if tok.Type != kind {
+			t.Fatalf("expecting the kind of %q to be %v, got %v", tok.Raw, kind, tok.Type)
+		}
+
+		seen[tok.Raw] = true
+		return true
+	})
+
+	if len(seen) != len(expected) {
+		t.Fatalf("expecting %v operators, got %v", len(expected), seen)
+	}
+
+	// the modifiers of a string are keyed by kind
+	assign := rule.Strings[0].(*Assignment)
+	if _, ok := assign.Attributes[KindNocase]; !ok {
+		t.Fatalf("expecting a nocase modifier, got %v", assign.Attributes)
+	}
+
+	if _, ok := assign.Attributes[KindWide]; !ok {
+		t.Fatalf("expecting a wide modifier, got %v", assign.Attributes)
+	}
+}
+
+// the nodes are shared with the parser, a change to their fields is a
+// change to the public API and has to update this list
+func TestNodeFields(t *testing.T) {
+	tests := []struct {
+		node   interface{}
+		fields string
+	}{
+		{Token{}, "Raw string; Type int; Row int; Col int"},
+		{Comment{}, "Token *lexer.Token; Text string"},
+		{Import{}, "Token *lexer.Token; Value string"},
+		{Rule{}, "Token *lexer.Token; Private bool; Global bool; Name string; Tags []string; Condition ast.Node; Strings []ast.Node; Meta []ast.Node; MetaToken *lexer.Token; StringsToken *lexer.Token; ConditionToken *lexer.Token; End *lexer.Token"},
+		{Assignment{}, "Token *lexer.Token; Left string; Right ast.Node; Attributes map[int]ast.Node"},
+		{String{}, "Token *lexer.Token; Value string"},
+		{Regex{}, "Token *lexer.Token; Value string"},
+		{Bytes{}, "Token *lexer.Token; Items []string"},
+		{Integer{}, "Token *lexer.Token; Value int64"},
+		{Bool{}, "Token *lexer.Token; Value bool"},
+		{Identity{}, "Token *lexer.Token; Value string"},
+		{Variable{}, "Token *lexer.Token; Value string"},
+		{Keyword{}, "Token *lexer.Token; Value string; Attribute ast.Node"},
+		{Prefix{}, "Token *lexer.Token; Right ast.Node"},
+		{Infix{}, "Token *lexer.Token; Left ast.Node; Right ast.Node"},
+		{Set{}, "Nodes []ast.Node"},
+		{Percentage{}, "Token *lexer.Token; Value ast.Node"},
+		{For{}, "Expr *lexer.Token; Percent bool; Iterable ast.Node; Vars []string; Body ast.Node"},
+		{With{}, "Token *lexer.Token; Bindings []*ast.Binding; Body ast.Node"},
+		{Binding{}, "Token *lexer.Token; Name string; Value ast.Node"},
+		{Error{}, "Row int; Col int; Rule string; Message string"},
+	}
+
+	for _, test := range tests {
+		typ := reflect.TypeOf(test.node)
+
+		fields := make([]string, 0)
+		for i := 0; i < typ.NumField(); i++ {
+			if field := typ.Field(i); field.IsExported() {
+				fields = append(fields, fmt.Sprintf("%v %v", field.Name, field.Type))
+			}
+		}
+
+		if got := strings.Join(fields, "; "); got != test.fields {
+			t.Fatalf("%v: expecting the fields %v, got %v", typ.Name(), test.fields, got)
+		}
+	}
+}
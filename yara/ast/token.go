@@ -0,0 +1,101 @@
+package ast
+
+import "github.com/kgwinnup/go-yara/internal/lexer"
+
+// The kinds of tokens, the values of Token.Type. The operator of an
+// Infix or a Prefix is the kind of its Token, e.g. KindShiftLeft for
+// 'a << b' and KindNot for 'not a', the quantifier of a For is the kind
+// of its Expr, e.g. KindAll. Compare the kinds by name, their values
+// are not stable across versions.
+const (
+	KindEOF         = lexer.EOF
+	KindNewline     = lexer.NEWLINE
+	KindComment     = lexer.COMMENT
+	KindLParen      = lexer.LPAREN
+	KindRParen      = lexer.RPAREN
+	KindLBrace      = lexer.LBRACE
+	KindRBrace      = lexer.RBRACE
+	KindLBracket    = lexer.LBRACKET
+	KindRBracket    = lexer.RBRACKET
+	KindDot         = lexer.DOT
+	KindRange       = lexer.RANGE
+	KindPlus        = lexer.PLUS
+	KindMinus       = lexer.MINUS
+	KindDivide      = lexer.DIVIDE
+	KindAsterisk    = lexer.ASTERISK
+	KindMod         = lexer.MOD
+	KindCaret       = lexer.CARET
+	KindTilde       = lexer.TILDE
+	KindShiftLeft   = lexer.SHIFTLEFT
+	KindShiftRight  = lexer.SHIFTRIGHT
+	KindAmpersand   = lexer.AMPERSAND
+	KindPipe        = lexer.PIPE
+	KindLT          = lexer.LT
+	KindLTE         = lexer.LTE
+	KindGT          = lexer.GT
+	KindGTE         = lexer.GTE
+	KindEqual       = lexer.EQUAL
+	KindNotEqual    = lexer.NOTEQUAL
+	KindContains    = lexer.CONTAINS
+	KindIContains   = lexer.ICONTAINS
+	KindStartsWith  = lexer.STARTSWITH
+	KindIStartsWith = lexer.ISTARTSWITH
+	KindEndsWith    = lexer.ENDSWITH
+	KindIEndsWith   = lexer.IENDSWITH
+	KindIEquals     = lexer.IEQUALS
+	KindMatches     = lexer.MATCHES
+	KindNotDefined  = lexer.NOTDEFINED
+	KindAnd         = lexer.AND
+	KindOr          = lexer.OR
+	KindComma       = lexer.COMMA
+	KindColon       = lexer.COLON
+	KindAssignment  = lexer.ASSIGNMENT
+	KindInteger     = lexer.INTEGER
+	KindIdentity    = lexer.IDENTITY
+	KindVariable    = lexer.VARIABLE
+	KindString      = lexer.STRING
+	KindRegex       = lexer.REGEX
+	KindBool        = lexer.BOOL
+	KindNocase      = lexer.NOCASE
+	KindWide        = lexer.WIDE
+	KindAscii       = lexer.ASCII
+	KindXor         = lexer.XOR
+	KindBase64      = lexer.BASE64
+	KindBase64Wide  = lexer.BASE64WIDE
+	KindFullword    = lexer.FULLWORD
+	KindPrivate     = lexer.PRIVATE
+	KindAll         = lexer.ALL
+	KindAny         = lexer.ANY
+	KindAt          = lexer.AT
+	KindCondition   = lexer.CONDITION
+	KindGlobal      = lexer.GLOBAL
+	KindStrings     = lexer.STRINGS
+	KindInt16       = lexer.INT16
+	KindInt16BE     = lexer.INT16BE
+	KindInt32       = lexer.INT32
+	KindInt32BE     = lexer.INT32BE
+	KindInt8        = lexer.INT8
+	KindInt8BE      = lexer.INT8BE
+	KindUint16      = lexer.UINT16
+	KindUint16BE    = lexer.UINT16BE
+	KindUint32      = lexer.UINT32
+	KindUint32BE    = lexer.UINT32BE
+	KindUint8       = lexer.UINT8
+	KindUint8BE     = lexer.UINT8BE
+	KindMeta        = lexer.META
+	KindNone        = lexer.NONE
+	KindOf          = lexer.OF
+	KindRule        = lexer.RULE
+	KindThem        = lexer.THEM
+	KindEntryPoint  = lexer.ENTRYPOINT
+	KindFilesize    = lexer.FILESIZE
+	KindFor         = lexer.FOR
+	KindImport      = lexer.IMPORT
+	KindInclude     = lexer.INCLUDE
+	KindIn          = lexer.IN
+	KindNot         = lexer.NOT
+	KindDefined     = lexer.DEFINED
+	KindKB          = lexer.KB
+	KindMB          = lexer.MB
+	KindWith        = lexer.WITH
+)
@@ -0,0 +1,488 @@
+// Package decode finds the encoded segments of an input, base64 and hex
+// blobs, percent-encoded text and UTF-16LE text, and decodes them into
+// views the rules can be run against.
+//
+// A view keeps the offset in the input of each byte it decodes, so a
+// match in a view is reported at the offset of its encoded bytes in the
+// input. The views are decoded again once, e.g. the base64 of UTF-16LE
+// text of a PowerShell -EncodedCommand is a base64/utf16le view.
+package decode
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encoding is an encoding of the segments decoded into views, the
+// encodings are combined with |.
+type Encoding int
+
+const (
+	Base64 Encoding = 1 << iota
+	Hex
+	Percent
+	UTF16LE
+
+	All = Base64 | Hex | Percent | UTF16LE
+)
+
+var encodingNames = []struct {
+	encoding Encoding
+	name     string
+}{
+	{Base64, "base64"},
+	{Hex, "hex"},
+	{Percent, "percent"},
+	{UTF16LE, "utf16le"},
+}
+
+func (e Encoding) String() string {
+	names := make([]string, 0)
+
+	for _, n := range encodingNames {
+		if e&n.encoding != 0 {
+			names = append(names, n.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// ParseEncoding parses a list of encodings separated by commas, e.g.
+// "base64,hex", or "all".
+func ParseEncoding(s string) (Encoding, error) {
+	var e Encoding
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			e |= All
+			continue
+		}
+
+		found := false
+		for _, n := range encodingNames {
+			if n.name == name {
+				e |= n.encoding
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, errors.New(fmt.Sprintf("decode: unknown encoding '%v', expecting base64, hex, percent, utf16le or all", name))
+		}
+	}
+
+	return e, nil
+}
+
+const (
+	// MinLength is the shortest base64 or hex segment decoded, in bytes
+	// of the input, shorter runs are too likely to be plain words
+	MinLength = 16
+	// MinWrap is the shortest line of a base64 blob wrapped on several
+	// lines
+	MinWrap = 60
+	// MinEscapes is the fewest %XX escapes of a percent-encoded segment
+	MinEscapes = 3
+	// MinChars is the fewest characters of a UTF-16LE segment
+	MinChars = 8
+	// MaxDepth is the number of times a view is decoded, a view of a
+	// view is at depth 2
+	MaxDepth = 2
+)
+
+// View is a segment of an input decoded.
+type View struct {
+	// the encodings decoded, the outermost first
+	Encodings []Encoding
+	// the offset and length of the segment in the input
+	Offset int
+	Length int
+	// the decoded bytes
+	Data []byte
+	// the offset in the input of each decoded byte, and the offset
+	// past the last input byte encoding it
+	offsets []int
+	ends    []int
+}
+
+// Name returns the encodings of the view and the offset of its segment,
+// e.g. base64@0x1f or base64/utf16le@0x1f.
+func (v *View) Name() string {
+	names := make([]string, len(v.Encodings))
+	for i, e := range v.Encodings {
+		names[i] = e.String()
+	}
+
+	return fmt.Sprintf("%v@0x%x", strings.Join(names, "/"), v.Offset)
+}
+
+// SourceOffset returns the offset in the input of the byte at offset of
+// the decoded data.
+func (v *View) SourceOffset(offset int) int {
+	if offset < 0 || len(v.offsets) == 0 {
+		return v.Offset
+	}
+
+	if offset >= len(v.offsets) {
+		return v.Offset + v.Length
+	}
+
+	return v.offsets[offset]
+}
+
+// sourceEnd returns the offset in the input past the last byte encoding
+// the byte at offset of the decoded data.
+func (v *View) sourceEnd(offset int) int {
+	if offset < 0 || len(v.ends) == 0 {
+		return v.Offset
+	}
+
+	if offset >= len(v.ends) {
+		return v.Offset + v.Length
+	}
+
+	return v.ends[offset]
+}
+
+// SourceSpan returns the offset and the length in the input of the
+// length bytes at offset of the decoded data, from the first input byte
+// encoding them to the last. A base64 span can start or end inside a
+// group of 4 characters.
+func (v *View) SourceSpan(offset, length int) (int, int) {
+	start := v.SourceOffset(offset)
+	if length <= 0 {
+		return start, 0
+	}
+
+	return start, v.sourceEnd(offset+length-1) - start
+}
+
+// Views returns the views of the segments of input in the encodings,
+// ordered by their offset, followed by the views decoded from them.
+func Views(input []byte, encodings Encoding) []*View {
+	views := segments(input, encodings)
+
+	for depth := 2; depth <= MaxDepth; depth++ {
+		nested := make([]*View, 0)
+
+		for _, view := range views {
+			if len(view.Encodings) != depth-1 {
+				continue
+			}
+
+			for _, inner := range segments(view.Data, encodings) {
+				inner.Encodings = append(append([]Encoding{}, view.Encodings...), inner.Encodings...)
+
+				// the offsets of the inner view are in the outer view,
+				// map them to the input
+				end := inner.Offset + inner.Length
+				for i, offset := range inner.offsets {
+					inner.offsets[i] = view.SourceOffset(offset)
+					inner.ends[i] = view.sourceEnd(inner.ends[i] - 1)
+				}
+
+				inner.Offset, inner.Length = view.SourceSpan(inner.Offset, end-inner.Offset)
+
+				nested = append(nested, inner)
+			}
+		}
+
+		views = append(views, nested...)
+	}
+
+	return views
+}
+
+func segments(input []byte, encodings Encoding) []*View {
+	views := make([]*View, 0)
+
+	if encodings&Base64 != 0 {
+		views = append(views, base64Views(input)...)
+	}
+
+	if encodings&Hex != 0 {
+		views = append(views, hexViews(input)...)
+	}
+
+	if encodings&Percent != 0 {
+		views = append(views, percentViews(input)...)
+	}
+
+	if encodings&UTF16LE != 0 {
+		views = append(views, utf16Views(input)...)
+	}
+
+	sortViews(views)
+
+	return views
+}
+
+func sortViews(views []*View) {
+	// insertion sort, the views of each encoding are already ordered
+	for i := 1; i < len(views); i++ {
+		for j := i; j > 0 && views[j].Offset < views[j-1].Offset; j-- {
+			views[j], views[j-1] = views[j-1], views[j]
+		}
+	}
+}
+
+func isBase64(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/'
+}
+
+func isHex(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+// base64Views decodes the runs of base64 characters, a run can be
+// wrapped on several lines. A run of hex digits only is left to the hex
+// views.
+func base64Views(input []byte) []*View {
+	views := make([]*View, 0)
+
+	for i := 0; i < len(input); {
+		if !isBase64(input[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		chars := make([]byte, 0)
+		positions := make([]int, 0)
+		hexOnly := true
+		// the characters on the current line of the run
+		line := 0
+
+		for i < len(input) {
+			b := input[i]
+
+			if isBase64(b) {
+				chars = append(chars, b)
+				positions = append(positions, i)
+				hexOnly = hexOnly && isHex(b)
+				line++
+				i++
+				continue
+			}
+
+			// a line break inside a blob wrapped at a fixed width, e.g.
+			// 64 or 76 characters
+			if (b == '\r' || b == '\n') && line >= MinWrap && line%4 == 0 && i+1 < len(input) && (isBase64(input[i+1]) || input[i+1] == '\n') {
+				if b == '\n' {
+					line = 0
+				}
+
+				i++
+				continue
+			}
+
+			break
+		}
+
+		end := i
+		for i < len(input) && input[i] == '=' {
+			i++
+		}
+
+		if len(chars) < MinLength || hexOnly {
+			continue
+		}
+
+		// a single character past a multiple of 4 decodes to nothing
+		if len(chars)%4 == 1 {
+			chars = chars[:len(chars)-1]
+		}
+
+		data, err := base64.RawStdEncoding.DecodeString(string(chars))
+		if err != nil {
+			continue
+		}
+
+		// byte j of the data starts in character j*4/3 of the run and
+		// ends in the next one
+		offsets := make([]int, len(data))
+		ends := make([]int, len(data))
+		for j := range data {
+			offsets[j] = positions[j/3*4+j%3]
+			ends[j] = positions[j/3*4+j%3+1] + 1
+		}
+
+		views = append(views, &View{
+			Encodings: []Encoding{Base64},
+			Offset:    start,
+			Length:    end - start,
+			Data:      data,
+			offsets:   offsets,
+			ends:      ends,
+		})
+	}
+
+	return views
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
+
+// hexViews decodes the runs of hex digits.
+func hexViews(input []byte) []*View {
+	views := make([]*View, 0)
+
+	for i := 0; i < len(input); {
+		if !isHex(input[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(input) && isHex(input[i]) {
+			i++
+		}
+
+		// a hex run inside a word, e.g. the end of an identifier, is
+		// not a blob
+		if start > 0 && isBase64(input[start-1]) || i < len(input) && isBase64(input[i]) {
+			continue
+		}
+
+		length := (i - start) &^ 1
+		if length < MinLength {
+			continue
+		}
+
+		data := make([]byte, length/2)
+		offsets := make([]int, length/2)
+		ends := make([]int, length/2)
+
+		for j := range data {
+			data[j] = unhex(input[start+2*j])<<4 | unhex(input[start+2*j+1])
+			offsets[j] = start + 2*j
+			ends[j] = start + 2*j + 2
+		}
+
+		views = append(views, &View{
+			Encodings: []Encoding{Hex},
+			Offset:    start,
+			Length:    length,
+			Data:      data,
+			offsets:   offsets,
+			ends:      ends,
+		})
+	}
+
+	return views
+}
+
+// percentViews decodes the runs of text with %XX escapes, a run ends at
+// a space, a quote or a bracket.
+func percentViews(input []byte) []*View {
+	views := make([]*View, 0)
+
+	stop := func(b byte) bool {
+		return b <= ' ' || b >= 0x7f || strings.IndexByte("\"'<>`", b) >= 0
+	}
+
+	for i := 0; i < len(input); {
+		if stop(input[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		data := make([]byte, 0)
+		offsets := make([]int, 0)
+		ends := make([]int, 0)
+		escapes := 0
+
+		for i < len(input) && !stop(input[i]) {
+			offsets = append(offsets, i)
+
+			if input[i] == '%' && i+2 < len(input) && isHex(input[i+1]) && isHex(input[i+2]) {
+				data = append(data, unhex(input[i+1])<<4|unhex(input[i+2]))
+				escapes++
+				i += 3
+				ends = append(ends, i)
+				continue
+			}
+
+			data = append(data, input[i])
+			i++
+			ends = append(ends, i)
+		}
+
+		if escapes < MinEscapes {
+			continue
+		}
+
+		views = append(views, &View{
+			Encodings: []Encoding{Percent},
+			Offset:    start,
+			Length:    i - start,
+			Data:      data,
+			offsets:   offsets,
+			ends:      ends,
+		})
+	}
+
+	return views
+}
+
+// utf16Views decodes the runs of printable ASCII characters encoded as
+// UTF-16LE, at even or odd offsets.
+func utf16Views(input []byte) []*View {
+	views := make([]*View, 0)
+
+	printable := func(i int) bool {
+		b := input[i]
+		return i+1 < len(input) && input[i+1] == 0 && (b >= ' ' && b < 0x7f || b == '\t' || b == '\r' || b == '\n')
+	}
+
+	for i := 0; i+1 < len(input); {
+		if !printable(i) {
+			i++
+			continue
+		}
+
+		start := i
+		for i+1 < len(input) && printable(i) {
+			i += 2
+		}
+
+		chars := (i - start) / 2
+		if chars < MinChars {
+			continue
+		}
+
+		data := make([]byte, chars)
+		offsets := make([]int, chars)
+		ends := make([]int, chars)
+
+		for j := range data {
+			data[j] = input[start+2*j]
+			offsets[j] = start + 2*j
+			ends[j] = start + 2*j + 2
+		}
+
+		views = append(views, &View{
+			Encodings: []Encoding{UTF16LE},
+			Offset:    start,
+			Length:    i - start,
+			Data:      data,
+			offsets:   offsets,
+			ends:      ends,
+		})
+	}
+
+	return views
+}
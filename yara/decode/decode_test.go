@@ -0,0 +1,127 @@
+package decode
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func viewNames(views []*View) []string {
+	names := make([]string, len(views))
+	for i, view := range views {
+		names[i] = fmt.Sprintf("%v %q", view.Name(), view.Data)
+	}
+
+	return names
+}
+
+func TestViews(t *testing.T) {
+	utf16 := []byte("w\x00h\x00o\x00a\x00m\x00i\x00 \x00/\x00a\x00l\x00l\x00")
+	encoded := base64.StdEncoding.EncodeToString(utf16)
+
+	input := "x = \"" + base64.StdEncoding.EncodeToString([]byte("MZ payload here!")) + "\"\n" +
+		"y = 4d5a9000030000000400\n" +
+		"url = http://host/?q=%3Cscript%3Ealert(1)%3C/script%3E\n" +
+		"cmd = powershell -enc " + encoded + "\n" +
+		"identifier_that_is_longer_than_sixteen\n"
+
+	expected := []string{
+		`base64@0x5 "MZ payload here!"`,
+		`hex@0x23 "MZ\x90\x00\x03\x00\x00\x00\x04\x00"`,
+		`percent@0x3e "http://host/?q=<script>alert(1)</script>"`,
+		fmt.Sprintf(`base64@0x85 %q`, utf16),
+		`base64/utf16le@0x85 "whoami /all"`,
+	}
+
+	names := viewNames(Views([]byte(input), All))
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expecting\n%v\ngot\n%v", expected, names)
+	}
+
+	if names := viewNames(Views([]byte(input), Hex)); len(names) != 1 || names[0] != expected[1] {
+		t.Fatalf("expecting the hex view only, got %v", names)
+	}
+}
+
+func TestWrappedBase64(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	input := "-----BEGIN DATA-----\r\n" + encoded[:64] + "\r\n" + encoded[64:] + "\r\n-----END DATA-----\r\n"
+
+	// the bytes 65 to 90 are base64 too, the view is decoded again
+	views := Views([]byte(input), Base64)
+	if len(views) != 2 || views[0].Name() != "base64@0x16" || string(views[0].Data) != string(data) {
+		t.Fatalf("expecting the wrapped blob, got %v", viewNames(views))
+	}
+
+	// the first byte of the second line
+	if offset := views[0].SourceOffset(48); offset != 22+64+2 {
+		t.Fatalf("expecting offset %v, got %v", 22+64+2, offset)
+	}
+}
+
+func TestSourceOffset(t *testing.T) {
+	input := []byte("....TVqQAAMAAAAEAAAA//8AALgA....")
+
+	views := Views(input, Base64)
+	if len(views) != 1 {
+		t.Fatalf("expecting one view, got %v", viewNames(views))
+	}
+
+	view := views[0]
+
+	// each group of 4 characters decodes to 3 bytes
+	for offset, expected := range map[int]int{0: 4, 1: 5, 2: 6, 3: 8, 6: 12, 100: 4 + 24} {
+		if source := view.SourceOffset(offset); source != expected {
+			t.Fatalf("offset %v: expecting %v, got %v", offset, expected, source)
+		}
+	}
+
+	// a span ends past the last character encoding its last byte
+	for _, span := range [][4]int{{0, 3, 4, 4}, {1, 1, 5, 2}, {2, 2, 6, 4}, {0, 0, 4, 0}} {
+		if offset, length := view.SourceSpan(span[0], span[1]); offset != span[2] || length != span[3] {
+			t.Fatalf("span %v: expecting %v %v, got %v %v", span[:2], span[2], span[3], offset, length)
+		}
+	}
+
+	input = []byte("a%41%42%43b")
+	view = Views(input, Percent)[0]
+
+	if string(view.Data) != "aABCb" || view.SourceOffset(2) != 4 || view.SourceOffset(4) != 10 {
+		t.Fatalf("unexpected view %q %v", view.Data, view.offsets)
+	}
+
+	if offset, length := view.SourceSpan(1, 3); offset != 1 || length != 9 {
+		t.Fatalf("expecting the span of %%41%%42%%43, got %v %v", offset, length)
+	}
+
+	// a view of a view maps to the input
+	input = []byte("   " + base64.StdEncoding.EncodeToString([]byte("\x00t\x00e\x00s\x00t\x00i\x00n\x00g\x00!\x00")))
+	views = Views(input, All)
+
+	if len(views) != 2 || views[1].Name() != "base64/utf16le@0x4" || views[1].SourceOffset(0) != 4 {
+		t.Fatalf("unexpected views %v", viewNames(views))
+	}
+
+	if offset, length := views[1].SourceSpan(0, 7); offset != 4 || length != 19 || string(views[1].Data[:7]) != "testing" {
+		t.Fatalf("expecting the span of testing, got %v %v", offset, length)
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	if e, err := ParseEncoding("base64, hex"); err != nil || e != Base64|Hex {
+		t.Fatalf("unexpected %v %v", e, err)
+	}
+
+	if e, err := ParseEncoding("all"); err != nil || e != All || e.String() != "base64,hex,percent,utf16le" {
+		t.Fatalf("unexpected %v %v", e, err)
+	}
+
+	if _, err := ParseEncoding("rot13"); err == nil {
+		t.Fatal("expecting an error for an unknown encoding")
+	}
+}
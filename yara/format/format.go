@@ -0,0 +1,620 @@
+// Package format formats yara rules in a canonical style. Imports come
+// first, rules are separated by a blank line, sections and strings are
+// indented with spaces and the '=' of the meta and strings line up.
+// Comments and single blank lines between strings are kept, formatting
+// formatted rules changes nothing.
+//
+// A condition keeps the lines of the operands of its top 'and' or 'or'
+// chain, each operand is printed on one line. The comments inside an
+// operand spread over several lines, e.g. '$a and $b' in '$a and $b or
+// $c' with $b on its own line, are not kept in place: the first one
+// follows the line the operand is joined on and the others go on their
+// own lines after it. No comment is dropped.
+package format
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kgwinnup/go-yara/yara/ast"
+)
+
+const (
+	sectionIndent = "    "
+	itemIndent    = "        "
+)
+
+// Source formats the rules of src. The rules must parse, the syntax
+// errors are returned otherwise.
+func Source(src []byte) ([]byte, error) {
+	file, err := ast.Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	return File(file), nil
+}
+
+// File formats a parsed file and its comments.
+func File(file *ast.File) []byte {
+	p := &printer{comments: file.Comments}
+
+	for i, node := range file.Nodes {
+		// rules are separated by a blank line, the imports keep theirs
+		if i > 0 {
+			_, prevImport := file.Nodes[i-1].(*ast.Import)
+			_, isImport := node.(*ast.Import)
+
+			if !prevImport || !isImport {
+				p.blankLine()
+			}
+		}
+
+		switch n := node.(type) {
+		case *ast.Import:
+			p.leading(n.Token, "", false)
+			p.add(&line{blank: p.gap(n.Token.Row), text: `import "` + n.Value + `"`, comment: p.trailing(n.Token.Row, nil)})
+		case *ast.Rule:
+			p.rule(n)
+		}
+	}
+
+	p.leading(nil, "", true)
+
+	return p.bytes()
+}
+
+// Node formats a node without its comments, a rule over several lines
+// and an expression on a single line.
+func Node(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Rule:
+		p := &printer{}
+		p.rule(n)
+
+		return strings.TrimSuffix(string(p.bytes()), "\n")
+
+	case *ast.Import:
+		return `import "` + n.Value + `"`
+
+	case *ast.Assignment:
+		return n.Left + " = " + value(n)
+	}
+
+	return expr(node)
+}
+
+// line is a line of output. The items of the meta and strings sections
+// keep their name and value apart to line up the '=' of the items.
+type line struct {
+	// a blank line comes before the line
+	blank  bool
+	indent string
+	text   string
+	// the value of an item
+	item  bool
+	value string
+	// the trailing comments, with the space before them
+	comment string
+}
+
+type printer struct {
+	lines    []*line
+	comments []*ast.Comment
+	// the first comment not printed yet
+	next int
+	// the last row of the input printed, and whether a blank line can
+	// follow it, e.g. not after the opening of a rule
+	last  int
+	fresh bool
+}
+
+func (p *printer) add(l *line) {
+	p.lines = append(p.lines, l)
+	p.fresh = false
+}
+
+// blankLine adds a blank line, no matter the input.
+func (p *printer) blankLine() {
+	p.add(&line{})
+	p.fresh = true
+}
+
+// gap reports whether the input has a blank line before row that should
+// be kept.
+func (p *printer) gap(row int) bool {
+	return !p.fresh && p.last > 0 && row > p.last+1
+}
+
+func before(comment *ast.Comment, tok *ast.Token) bool {
+	c := comment.Token
+
+	return c.Row < tok.Row || (c.Row == tok.Row && c.Col < tok.Col)
+}
+
+// leading adds the comments before tok on their own lines, all of the
+// comments left if end is true.
+func (p *printer) leading(tok *ast.Token, indent string, end bool) {
+	if tok == nil && !end {
+		return
+	}
+
+	for p.next < len(p.comments) && (end || before(p.comments[p.next], tok)) {
+		comment := p.comments[p.next]
+		p.next++
+
+		blank := p.gap(comment.Token.Row)
+		p.add(&line{blank: blank, indent: indent, text: comment.Text})
+		p.last = comment.Token.Row + strings.Count(comment.Text, "\n")
+	}
+}
+
+// trailing returns the comments up to the end of row, they follow the
+// code on its line. The comments after the closing brace of a rule on
+// the same line follow the brace instead.
+func (p *printer) trailing(row int, end *ast.Token) string {
+	var builder strings.Builder
+
+	for p.next < len(p.comments) && p.comments[p.next].Token.Row <= row && (end == nil || before(p.comments[p.next], end)) {
+		comment := p.comments[p.next]
+		p.next++
+
+		builder.WriteRune(' ')
+		builder.WriteString(comment.Text)
+		row = comment.Token.Row + strings.Count(comment.Text, "\n")
+	}
+
+	p.last = row
+
+	return builder.String()
+}
+
+func (p *printer) rule(rule *ast.Rule) {
+	p.leading(rule.Token, "", false)
+
+	var header strings.Builder
+
+	if rule.Private {
+		header.WriteString("private ")
+	}
+
+	if rule.Global {
+		header.WriteString("global ")
+	}
+
+	header.WriteString("rule ")
+	header.WriteString(rule.Name)
+
+	if len(rule.Tags) > 0 {
+		header.WriteString(" : ")
+		header.WriteString(strings.Join(rule.Tags, " "))
+	}
+
+	header.WriteString(" {")
+
+	// the first section may be on the line of the rule
+	next := rule.End
+	for _, tok := range []*ast.Token{rule.ConditionToken, rule.StringsToken, rule.MetaToken} {
+		if tok != nil {
+			next = tok
+		}
+	}
+
+	p.add(&line{blank: p.gap(row(rule.Token)), text: header.String(), comment: p.trailing(row(rule.Token), next)})
+	p.fresh = true
+
+	sections := 0
+
+	if len(rule.Meta) > 0 || rule.MetaToken != nil {
+		p.section("meta", rule.MetaToken, rule.Meta)
+		sections++
+	}
+
+	if len(rule.Strings) > 0 || rule.StringsToken != nil {
+		if sections > 0 {
+			p.blankLine()
+		}
+
+		p.section("strings", rule.StringsToken, rule.Strings)
+		sections++
+	}
+
+	if rule.Condition != nil {
+		if sections > 0 {
+			p.blankLine()
+		}
+
+		p.condition(rule.ConditionToken, rule.Condition, rule.End)
+	}
+
+	p.leading(rule.End, itemIndent, false)
+	p.add(&line{text: "}", comment: p.trailing(row(rule.End), nil)})
+}
+
+// row returns the row of a token, 0 for a node built rather than parsed.
+func row(tok *ast.Token) int {
+	if tok == nil {
+		return 0
+	}
+
+	return tok.Row
+}
+
+// header adds the header of a section, next is the first token of the
+// section.
+func (p *printer) header(name string, tok *ast.Token, next *ast.Token) {
+	p.leading(tok, sectionIndent, false)
+	p.add(&line{blank: p.gap(row(tok)), indent: sectionIndent, text: name + ":", comment: p.trailing(row(tok), next)})
+	p.fresh = true
+}
+
+func (p *printer) section(name string, tok *ast.Token, nodes []ast.Node) {
+	var next *ast.Token
+	if len(nodes) > 0 {
+		next = ast.TokenOf(nodes[0])
+	}
+
+	p.header(name, tok, next)
+
+	for _, node := range nodes {
+		assign, ok := node.(*ast.Assignment)
+		if !ok {
+			continue
+		}
+
+		p.leading(assign.Token, itemIndent, false)
+
+		blank := p.gap(row(assign.Token))
+		p.add(&line{
+			blank:   blank,
+			indent:  itemIndent,
+			text:    assign.Left,
+			item:    true,
+			value:   value(assign),
+			comment: p.trailing(lastRow(assign), nil),
+		})
+	}
+}
+
+// condition adds the condition, a chain of 'and' or 'or' spread over
+// several lines keeps its operands on the lines they are on.
+func (p *printer) condition(tok *ast.Token, node ast.Node, end *ast.Token) {
+	p.header("condition", tok, first(node))
+
+	op, operands := chain(node)
+
+	// the operands of each line
+	var lines [][]ast.Node
+	for i, operand := range operands {
+		if i == 0 || firstRow(operand) > lastRow(operands[i-1]) {
+			lines = append(lines, nil)
+		}
+
+		lines[len(lines)-1] = append(lines[len(lines)-1], operand)
+	}
+
+	for i, operands := range lines {
+		parts := make([]string, len(operands))
+		for j, operand := range operands {
+			parts[j] = expr(operand)
+		}
+
+		text := strings.Join(parts, " "+op+" ")
+		if i < len(lines)-1 {
+			text += " " + op
+		}
+
+		p.leading(first(operands[0]), itemIndent, false)
+
+		blank := p.gap(firstRow(operands[0]))
+		p.add(&line{blank: blank, indent: itemIndent, text: text, comment: p.trailing(lastRow(operands[len(operands)-1]), end)})
+	}
+}
+
+// chain returns the operands of a chain of the same 'and' or 'or'
+// operator, e.g. the three operands of '$a and $b and $c'.
+func chain(node ast.Node) (string, []ast.Node) {
+	root, ok := node.(*ast.Infix)
+	if !ok || (root.Token.Type != ast.KindAnd && root.Token.Type != ast.KindOr) {
+		return "", []ast.Node{node}
+	}
+
+	var operands []ast.Node
+
+	for {
+		infix, ok := node.(*ast.Infix)
+		if !ok || infix.Token.Type != root.Token.Type {
+			operands = append(operands, node)
+			break
+		}
+
+		operands = append(operands, infix.Right)
+		node = infix.Left
+	}
+
+	// the operators nest to the left, the operands were collected last
+	// to first
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+
+	return root.Token.Raw, operands
+}
+
+// tokens returns the tokens of a node and of the nodes below it.
+func tokens(node ast.Node) []*ast.Token {
+	var toks []*ast.Token
+
+	ast.Walk(node, func(n ast.Node) bool {
+		if tok := ast.TokenOf(n); tok != nil {
+			toks = append(toks, tok)
+		}
+
+		// the modifiers of a string are not walked
+		if assign, ok := n.(*ast.Assignment); ok {
+			for _, attr := range assign.Attributes {
+				toks = append(toks, tokens(attr)...)
+			}
+		}
+
+		return true
+	})
+
+	return toks
+}
+
+// first returns the first token of a node in the input.
+func first(node ast.Node) *ast.Token {
+	var first *ast.Token
+
+	for _, tok := range tokens(node) {
+		if first == nil || tok.Row < first.Row || (tok.Row == first.Row && tok.Col < first.Col) {
+			first = tok
+		}
+	}
+
+	return first
+}
+
+func firstRow(node ast.Node) int {
+	return row(first(node))
+}
+
+// lastRow returns the row of the last token of a node in the input.
+func lastRow(node ast.Node) int {
+	last := 0
+
+	for _, tok := range tokens(node) {
+		if tok.Row > last {
+			last = tok.Row
+		}
+	}
+
+	return last
+}
+
+// bytes writes out the lines, lining up the '=' of the items of each
+// block of items. A blank line ends a block, comments do not.
+func (p *printer) bytes() []byte {
+	width := make([]int, len(p.lines))
+
+	for start := 0; start < len(p.lines); {
+		end := start + 1
+		for end < len(p.lines) && !p.lines[end].blank && (p.lines[end].item || p.lines[end].indent == itemIndent) {
+			end++
+		}
+
+		max := 0
+		for _, l := range p.lines[start:end] {
+			if n := len([]rune(l.text)); l.item && n > max {
+				max = n
+			}
+		}
+
+		for i := start; i < end; i++ {
+			width[i] = max
+		}
+
+		start = end
+	}
+
+	var builder strings.Builder
+
+	for i, l := range p.lines {
+		if l.blank {
+			builder.WriteRune('\n')
+		}
+
+		builder.WriteString(l.indent)
+		builder.WriteString(l.text)
+
+		if l.item {
+			builder.WriteString(strings.Repeat(" ", width[i]-len([]rune(l.text))))
+			builder.WriteString(" = ")
+			builder.WriteString(l.value)
+		}
+
+		builder.WriteString(l.comment)
+		builder.WriteRune('\n')
+	}
+
+	return []byte(builder.String())
+}
+
+// value formats the value of a meta or string and its modifiers in the
+// order they are written.
+func value(assign *ast.Assignment) string {
+	var builder strings.Builder
+	builder.WriteString(expr(assign.Right))
+
+	modifiers := make([]ast.Node, 0, len(assign.Attributes))
+	for _, attr := range assign.Attributes {
+		modifiers = append(modifiers, attr)
+	}
+
+	sort.Slice(modifiers, func(i, j int) bool {
+		a, b := ast.TokenOf(modifiers[i]), ast.TokenOf(modifiers[j])
+		if a == nil || b == nil {
+			return b != nil
+		}
+
+		return a.Row < b.Row || (a.Row == b.Row && a.Col < b.Col)
+	})
+
+	for _, modifier := range modifiers {
+		builder.WriteRune(' ')
+		builder.WriteString(expr(modifier))
+	}
+
+	return builder.String()
+}
+
+// expr formats an expression on a single line. The parens of the input
+// are nodes of their own, none are added.
+func expr(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Integer:
+		return n.Token.Raw
+
+	case *ast.Bool:
+		if n.Value {
+			return "true"
+		}
+
+		return "false"
+
+	case *ast.String:
+		return `"` + n.Value + `"`
+
+	case *ast.Regex:
+		return "/" + n.Value + "/"
+
+	case *ast.Bytes:
+		return hex(n)
+
+	case *ast.Identity:
+		return n.Value
+
+	case *ast.Variable:
+		return n.Value
+
+	case *ast.Keyword:
+		if n.Attribute == nil {
+			return n.Value
+		}
+
+		// a range of keys, e.g. xor(0x01-0xff)
+		if infix, ok := n.Attribute.(*ast.Infix); ok && n.Token.Type == ast.KindXor && infix.Token.Type == ast.KindMinus {
+			return n.Value + "(" + expr(infix.Left) + "-" + expr(infix.Right) + ")"
+		}
+
+		return n.Value + "(" + expr(n.Attribute) + ")"
+
+	case *ast.Percentage:
+		return expr(n.Value) + "%"
+
+	case *ast.Set:
+		items := make([]string, len(n.Nodes))
+		for i, item := range n.Nodes {
+			items[i] = expr(item)
+		}
+
+		return "(" + strings.Join(items, ", ") + ")"
+
+	case *ast.Prefix:
+		switch n.Token.Type {
+		case ast.KindLParen:
+			return "(" + expr(n.Right) + ")"
+		case ast.KindLBracket:
+			return "[" + expr(n.Right) + "]"
+		case ast.KindNot:
+			return "not " + expr(n.Right)
+		}
+
+		return n.Token.Raw + expr(n.Right)
+
+	case *ast.Infix:
+		switch n.Token.Type {
+		case ast.KindLBracket:
+			return expr(n.Left) + "[" + expr(n.Right) + "]"
+		case ast.KindDot, ast.KindRange:
+			return expr(n.Left) + n.Token.Raw + expr(n.Right)
+		case ast.KindComma:
+			return expr(n.Left) + ", " + expr(n.Right)
+		}
+
+		return expr(n.Left) + " " + n.Token.Raw + " " + expr(n.Right)
+
+	case *ast.For:
+		return loop(n)
+
+	case *ast.With:
+		bindings := make([]string, len(n.Bindings))
+		for i, binding := range n.Bindings {
+			bindings[i] = binding.Name + " = " + expr(binding.Value)
+		}
+
+		return "with " + strings.Join(bindings, ", ") + " : ( " + expr(n.Body) + " )"
+	}
+
+	if node == nil {
+		return ""
+	}
+
+	return node.String()
+}
+
+func loop(f *ast.For) string {
+	quantifier := f.Expr.Raw
+	if f.Percent {
+		quantifier += "%"
+	}
+
+	if len(f.Vars) == 0 {
+		return "for " + quantifier + " of " + expr(f.Iterable) + " : ( " + expr(f.Body) + " )"
+	}
+
+	// the parser drops the parens of a range or of a single value
+	iterable := expr(f.Iterable)
+
+	switch n := f.Iterable.(type) {
+	case *ast.Set, *ast.Identity:
+	case *ast.Infix:
+		if n.Token.Type != ast.KindDot && n.Token.Type != ast.KindLBracket {
+			iterable = "(" + iterable + ")"
+		}
+	default:
+		iterable = "(" + iterable + ")"
+	}
+
+	return "for " + quantifier + " " + strings.Join(f.Vars, ", ") + " in " + iterable + " : ( " + expr(f.Body) + " )"
+}
+
+// hex formats a hex string with upper case bytes, e.g. '{ 4D 5A [2-4]
+// ( 90 | CC ) }'.
+func hex(b *ast.Bytes) string {
+	parts := make([]string, 0, len(b.Items))
+	jump := ""
+	inJump := false
+
+	for _, item := range b.Items {
+		switch {
+		case item == "[":
+			inJump = true
+			jump = item
+		case item == "]":
+			inJump = false
+			parts = append(parts, jump+item)
+		case inJump:
+			jump += item
+		default:
+			parts = append(parts, strings.ToUpper(item))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "{ }"
+	}
+
+	return "{ " + strings.Join(parts, " ") + " }"
+}
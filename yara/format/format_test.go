@@ -0,0 +1,80 @@
+package format
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kgwinnup/go-yara/yara/ast"
+)
+
+// each testdata/*.input formats to its .golden file, which formats to
+// itself
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.input")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) == 0 {
+		t.Fatal("expecting test inputs")
+	}
+
+	for _, input := range inputs {
+		src, err := os.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		golden, err := os.ReadFile(strings.TrimSuffix(input, ".input") + ".golden")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := Source(src)
+		if err != nil {
+			t.Fatalf("%v: %v", input, err)
+		}
+
+		if string(out) != string(golden) {
+			t.Fatalf("%v: expecting\n%s\ngot\n%s", input, golden, out)
+		}
+
+		again, err := Source(out)
+		if err != nil {
+			t.Fatalf("%v: %v", input, err)
+		}
+
+		if string(again) != string(out) {
+			t.Fatalf("%v: formatting is not stable, got\n%s", input, again)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := Source([]byte("rule A { condition: $a and }"))
+
+	var errs ast.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expecting syntax errors, got %v", err)
+	}
+}
+
+func TestNode(t *testing.T) {
+	file, err := ast.Parse(`rule A { strings: $a = "foo" condition: not $a and (#a>1 or @a[1]==0x10) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := file.Nodes[0].(*ast.Rule)
+
+	if out := Node(rule.Condition); out != "not $a and (#a > 1 or @a[1] == 0x10)" {
+		t.Fatalf("unexpected condition '%v'", out)
+	}
+
+	if out := Node(rule.Strings[0]); out != `$a = "foo"` {
+		t.Fatalf("unexpected string '%v'", out)
+	}
+}
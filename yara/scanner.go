@@ -0,0 +1,58 @@
+package yara
+
+import (
+	"io"
+
+	"github.com/kgwinnup/go-yara/internal/exec"
+)
+
+// Scanner scans inputs against the rules it was created from, reusing
+// its buffers between scans. A Scanner is not safe for concurrent use,
+// create one per goroutine. The Yara rules themselves are immutable once
+// compiled and can be shared by any number of scanners.
+type Scanner struct {
+	scanner *exec.Scanner
+}
+
+// NewScanner creates a Scanner for the compiled rules.
+func (y *Yara) NewScanner() *Scanner {
+	return &Scanner{scanner: y.compiled.NewScanner()}
+}
+
+func (s *Scanner) Scan(input []byte, timeout int, showStrings bool) ([]*exec.ScanOutput, error) {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return s.scanner.Scan(input, showStrings, timeout)
+}
+
+// ScanWithCallback scans an input held in memory and hands each event of
+// the scan to fn as it happens. Returning Abort from fn stops the scan.
+func (s *Scanner) ScanWithCallback(input []byte, timeout int, showStrings bool, fn Callback) error {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return s.scanner.ScanWithCallback(input, showStrings, timeout, fn)
+}
+
+// ScanReader scans the input read from r in chunks, see Yara.ScanReader.
+// A timeout of 0 or less scans without a deadline.
+func (s *Scanner) ScanReader(r io.Reader, timeout int, showStrings bool) ([]*exec.ScanOutput, error) {
+	return s.scanner.ScanReader(r, showStrings, timeout)
+}
+
+// ScanFile scans the file at path without reading it into memory. A
+// timeout of 0 or less scans without a deadline.
+func (s *Scanner) ScanFile(path string, timeout int, showStrings bool) ([]*exec.ScanOutput, error) {
+	return s.scanner.ScanFile(path, showStrings, timeout)
+}
+
+func (s *Scanner) ScanProcess(pid int, timeout int, showStrings bool) ([]*exec.ScanOutput, error) {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return s.scanner.ScanProcess(pid, showStrings, timeout)
+}
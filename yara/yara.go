@@ -1,11 +1,86 @@
 package yara
 
-import "github.com/kgwinnup/go-yara/internal/exec"
+import (
+	"io"
+	"os"
 
+	"github.com/kgwinnup/go-yara/internal/exec"
+	"github.com/kgwinnup/go-yara/yara/archive"
+	"github.com/kgwinnup/go-yara/yara/decode"
+)
+
+// Yara holds a set of compiled rules. It is safe for concurrent use,
+// the Scan methods take a Scanner from a pool for each call.
 type Yara struct {
 	compiled *exec.CompiledRules
 }
 
+type (
+	Event     = exec.Event
+	EventType = exec.EventType
+	Action    = exec.Action
+	Callback  = exec.Callback
+)
+
+const (
+	RuleMatching    = exec.RuleMatching
+	RuleNotMatching = exec.RuleNotMatching
+	ModuleImported  = exec.ModuleImported
+	ScanFinished    = exec.ScanFinished
+)
+
+const (
+	Continue = exec.Continue
+	Abort    = exec.Abort
+)
+
+// CompileError is an error in the rules, with its position and a
+// snippet of the line it is on. The error returned by New is a
+// CompileErrors holding every error of the rules, errors.As finds the
+// first one.
+type (
+	CompileError  = exec.CompileError
+	CompileErrors = exec.CompileErrors
+)
+
+// ScanOutput is a rule matching an input, it marshals to JSON with
+// stable field names: path, rule, namespace, tags, meta, strings and
+// errors. A StringMatch marshals to identifier, offset, length and data.
+type (
+	ScanOutput  = exec.ScanOutput
+	StringMatch = exec.StringMatch
+)
+
+// LineIndex maps the offsets of an input to lines and columns, it is
+// built the first time a match is looked up. A ContextLine is a line
+// around a match.
+type (
+	LineIndex   = exec.LineIndex
+	ContextLine = exec.ContextLine
+)
+
+// NewLineIndex creates a line index of the size bytes of data, e.g. the
+// file or the bytes an output was scanned from.
+func NewLineIndex(data io.ReaderAt, size int64) *LineIndex {
+	return exec.NewLineIndex(data, size)
+}
+
+// AddLines sets the Line and Column of each string match of the
+// outputs, and with a context of 0 or more the matching line and up to
+// context lines before and after it, like grep -C. LF and CRLF line
+// endings are both supported.
+func AddLines(output []*ScanOutput, index *LineIndex, context int) error {
+	return exec.AddLines(output, index, context)
+}
+
+// Profile is the work done by the scans of rules compiled with
+// Compiler.Profile, by rule and by string, the most expensive first.
+type (
+	Profile       = exec.Profile
+	RuleProfile   = exec.RuleProfile
+	StringProfile = exec.StringProfile
+)
+
 type Output struct {
 	Name string
 	Tags []string
@@ -20,6 +95,105 @@ func New(rule string) (*Yara, error) {
 	return &Yara{compiled: compiled}, nil
 }
 
+// Compiler compiles rules with options, keeping the warnings of the
+// last compile.
+type Compiler struct {
+	// fail Compile when the rules have warnings, the warnings are
+	// returned as errors
+	WarningsAsErrors bool
+	// record only the first match of each string, like yara's fast
+	// matching mode, conditions counting matches see at most one
+	FastScan bool
+	// count the work of each rule and string while scanning, see
+	// Yara.Profile. Profiled scans are slower.
+	Profile   bool
+	warnings  CompileErrors
+	variables map[string]interface{}
+}
+
+// NewCompiler creates a Compiler with the default options.
+func NewCompiler() *Compiler {
+	return &Compiler{}
+}
+
+// DefineVariable defines an external variable the conditions of the
+// rules compiled next can refer to by name. The value is a bool, an
+// integer or a string.
+func (c *Compiler) DefineVariable(name string, value interface{}) error {
+	// the value is checked now rather than by the next compile
+	if err := new(exec.Compiler).DefineVariable(name, value); err != nil {
+		return err
+	}
+
+	if c.variables == nil {
+		c.variables = make(map[string]interface{})
+	}
+
+	c.variables[name] = value
+	return nil
+}
+
+// compiler returns an exec.Compiler with the options and variables of c.
+func (c *Compiler) compiler() *exec.Compiler {
+	compiler := &exec.Compiler{
+		WarningsAsErrors: c.WarningsAsErrors,
+		FastScan:         c.FastScan,
+		Profile:          c.Profile,
+	}
+
+	for name, value := range c.variables {
+		compiler.DefineVariable(name, value)
+	}
+
+	return compiler
+}
+
+// Warnings returns the warnings of the last compile, e.g. slow strings
+// or strings declared twice.
+func (c *Compiler) Warnings() CompileErrors {
+	return c.warnings
+}
+
+// Compile compiles the rules of rule.
+func (c *Compiler) Compile(rule string) (*Yara, error) {
+	compiler := c.compiler()
+
+	compiled, err := compiler.Compile(rule)
+	c.warnings = compiler.Warnings()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Yara{compiled: compiled}, nil
+}
+
+// CompileFile compiles the rules in the file at path, the errors and
+// warnings refer to the path.
+func (c *Compiler) CompileFile(path string) (*Yara, error) {
+	compiler := c.compiler()
+
+	compiled, err := compiler.CompileFile(path)
+	c.warnings = compiler.Warnings()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Yara{compiled: compiled}, nil
+}
+
+// NewFromFile compiles the rules in the file at path, the errors refer
+// to the path.
+func NewFromFile(path string) (*Yara, error) {
+	compiled, err := exec.CompileFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Yara{compiled: compiled}, nil
+}
+
 func (y *Yara) Scan(input []byte, timeout int, s bool) ([]*exec.ScanOutput, error) {
 	if timeout <= 0 {
 		timeout = 3
@@ -33,6 +207,155 @@ func (y *Yara) Scan(input []byte, timeout int, s bool) ([]*exec.ScanOutput, erro
 	return output, nil
 }
 
+// ScanWithCallback scans an input held in memory and hands each event of
+// the scan to fn as it happens, e.g. a RuleMatching event as soon as a
+// rule matches. Returning Abort from fn stops the scan.
+func (y *Yara) ScanWithCallback(input []byte, timeout int, s bool, fn Callback) error {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return y.compiled.ScanWithCallback(input, s, timeout, fn)
+}
+
+// ScanReader scans the input read from r in chunks rather than holding
+// it all in memory. Integer functions like uint32(0) can only read the
+// input if r is also an io.ReaderAt. A timeout of 0 or less scans
+// without a deadline.
+func (y *Yara) ScanReader(r io.Reader, timeout int, s bool) ([]*exec.ScanOutput, error) {
+	return y.compiled.ScanReader(r, s, timeout)
+}
+
+// ScanFile scans the file at path without reading it into memory. A
+// timeout of 0 or less scans without a deadline, e.g. for disk images.
+func (y *Yara) ScanFile(path string, timeout int, s bool) ([]*exec.ScanOutput, error) {
+	return y.compiled.ScanFile(path, s, timeout)
+}
+
+// ArchiveLimits bound the unpacking of the containers scanned by
+// ScanArchive.
+type ArchiveLimits = archive.Limits
+
+// ScanArchive scans the file at path like ScanFile and, if it is a zip,
+// tar, gzip or bzip2 container, each file unpacked from it within the
+// limits, see archive.DefaultLimits. The outputs of a member have its
+// path, e.g. outer.zip!inner/a.exe. A member that could not be
+// unpacked, e.g. a possible decompression bomb, is an output with only
+// its path and Errors. A timeout of 0 or less scans the file and each
+// member without a deadline.
+func (y *Yara) ScanArchive(path string, timeout int, s bool, limits ArchiveLimits) ([]*exec.ScanOutput, error) {
+	output, err := y.ScanFile(path, timeout, s)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return output, nil
+	}
+
+	err = archive.Unpack(path, f, info.Size(), limits, func(member archive.Member) error {
+		if member.Err != nil {
+			output = append(output, &exec.ScanOutput{Path: member.Path, Errors: []string{member.Err.Error()}})
+			return nil
+		}
+
+		matches, err := y.compiled.Scan(member.Data, s, timeout)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			match.Path = member.Path
+		}
+
+		output = append(output, matches...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// ScanDecoded scans an input held in memory like Scan and each view of
+// it decoding its segments in the encodings, e.g. base64 blobs. The
+// outputs of a view have its name in View, e.g. base64@0x1f, and the
+// offsets and lengths of their strings are those of the encoded bytes
+// in the input, the data of the strings is decoded.
+func (y *Yara) ScanDecoded(input []byte, timeout int, s bool, encodings decode.Encoding) ([]*exec.ScanOutput, error) {
+	output, err := y.Scan(input, timeout, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, view := range decode.Views(input, encodings) {
+		matches, err := y.Scan(view.Data, timeout, s)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			match.View = view.Name()
+
+			for _, str := range match.Strings {
+				str.Offset, str.Length = view.SourceSpan(str.Offset, str.Length)
+			}
+		}
+
+		output = append(output, matches...)
+	}
+
+	return output, nil
+}
+
+// ScanFileWithCallback scans the file at path, handing each rule to fn
+// as soon as its condition is evaluated, see ScanWithCallback. A
+// timeout of 0 or less scans without a deadline.
+func (y *Yara) ScanFileWithCallback(path string, timeout int, s bool, fn Callback) error {
+	return y.compiled.ScanFileWithCallback(path, s, timeout, fn)
+}
+
+// ScanProcess scans the readable memory of the process with the given
+// pid. Match offsets are virtual addresses. Only supported on Linux.
+func (y *Yara) ScanProcess(pid int, timeout int, s bool) ([]*exec.ScanOutput, error) {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return y.compiled.ScanProcess(pid, s, timeout)
+}
+
+// ScanProcessWithCallback scans the readable memory of the process with
+// the given pid, handing each rule to fn as soon as its condition is
+// evaluated. Only supported on Linux.
+func (y *Yara) ScanProcessWithCallback(pid int, timeout int, s bool, fn Callback) error {
+	if timeout <= 0 {
+		timeout = 3
+	}
+
+	return y.compiled.ScanProcessWithCallback(pid, s, timeout, fn)
+}
+
+// Profile returns the time and instructions spent on the condition of
+// each rule and the automaton hits, verifications and matches of each
+// string, summed over the scans so far. It is nil unless the rules were
+// compiled with Compiler.Profile.
+func (y *Yara) Profile() *Profile {
+	return y.compiled.Profile()
+}
+
 func (y *Yara) Debug() {
 	y.compiled.Debug()
 }